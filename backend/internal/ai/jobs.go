@@ -0,0 +1,55 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"backend/internal/models"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+var (
+	jobs     sync.WaitGroup
+	jobsMu   sync.Mutex
+	stopping bool
+)
+
+// answers a request in the background, keeping track of it so shutdown can wait for it
+func StartAIResponse(req *models.AIRequest) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	if stopping {
+		return ErrShuttingDown
+	}
+
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		BroadcastAIResponse(req)
+	}()
+
+	return nil
+}
+
+// stops accepting requests and waits for the ones in flight, or until ctx is done
+func Wait(ctx context.Context) error {
+	jobsMu.Lock()
+	stopping = true
+	jobsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
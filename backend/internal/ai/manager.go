@@ -2,12 +2,12 @@ package ai
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"unicode/utf8"
 
 	"backend/internal/models"
-	"backend/internal/room"
 	"backend/internal/storage"
 	"backend/internal/utils"
 
@@ -35,13 +35,25 @@ const CONTEXT_SIZE = 600
 var openAIClient openai.Client
 
 func buildUserPrompt(documentContent string, rawPrompt string, cursorPosition int) string {
-	cursorPosition = min(cursorPosition, len(documentContent))
+	// the cursor position comes from the editor in utf-16 code units
+	cursor, err := utils.ByteOffset(documentContent, cursorPosition, models.UnitUTF16)
+	if err != nil {
+		cursor = len(documentContent)
+	}
+
+	start := max(cursor-CONTEXT_SIZE, 0)
+	end := min(cursor+CONTEXT_SIZE, len(documentContent))
 
-	start := max(cursorPosition-CONTEXT_SIZE, 0)
-	end := min(cursorPosition+CONTEXT_SIZE, len(documentContent))
+	// do not cut the context in the middle of a character
+	for start < cursor && !utf8.RuneStart(documentContent[start]) {
+		start++
+	}
+	for end > cursor && end < len(documentContent) && !utf8.RuneStart(documentContent[end]) {
+		end--
+	}
 
-	before := documentContent[start:cursorPosition]
-	after := documentContent[cursorPosition:end]
+	before := documentContent[start:cursor]
+	after := documentContent[cursor:end]
 
 	prompt := fmt.Sprintf(
 		"Before cursor:\n%s\n\nUser request:\n%s\n\nAfter cursor:\n%s",
@@ -63,6 +75,11 @@ func BroadcastAIResponse(req *models.AIRequest) {
 	var prompt string
 
 	content, err := storage.GetDocumentContent(req.RoomCode, req.DocId)
+	if errors.Is(err, storage.ErrDocumentNotFound) {
+		log.Printf("not answering ai request for missing document %d", req.DocId)
+		return
+	}
+
 	if err != nil {
 		// fall back to just the given prompt, dont add any context from the doc contents
 		prompt = req.Prompt
@@ -85,42 +102,26 @@ func BroadcastAIResponse(req *models.AIRequest) {
 		return
 	}
 
-	op := &models.Operation{
+	op := models.Operation{
 		Type:     "insert",
 		Position: req.CursorPosition,
 		Text:     chatCompletion.Choices[0].Message.Content,
+		Revision: req.Revision,
 	}
 
-	currentContent, err := storage.GetDocumentContent(req.RoomCode, req.DocId)
-	if err != nil {
-		log.Printf("error getting document %d\n", req.DocId)
-		return
-	}
+	// committed operations reach everyone on the document through the room
+	event := models.RoomEvent{SessionId: "ai", Username: "ai"}
 
-	newContent := utils.ApplyOperation(currentContent, op)
-
-	err = storage.UpdateDocumentContent(req.RoomCode, newContent, req.DocId)
-	if err != nil {
-		log.Printf("could not update document %d\n", req.DocId)
-		return
-	}
-
-	resp := models.Message{
-		Type:      "operation",
-		Operation: op,
-		UserID:    "ai",
+	_, _, err = storage.CommitOperation(req.RoomCode, req.DocId, op, event)
+	if errors.Is(err, storage.ErrInvalidRevision) || errors.Is(err, storage.ErrRevisionUnavailable) {
+		// the cursor can no longer be transformed, insert at its position in the current revision
+		_, op.Revision, err = storage.GetDocumentState(req.RoomCode, req.DocId)
+		if err == nil {
+			_, _, err = storage.CommitOperation(req.RoomCode, req.DocId, op, event)
+		}
 	}
 
-	data, err := json.Marshal(resp)
 	if err != nil {
-		log.Printf("could not marshal ai response operation: %v", err)
-		return
+		log.Printf("could not update document %d: %v\n", req.DocId, err)
 	}
-
-	rm := room.GetRoom(req.RoomCode)
-	if rm == nil {
-		return
-	}
-
-	room.BroadcastToEveryone(rm, req.DocId, data)
 }
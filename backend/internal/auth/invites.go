@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidInvite = errors.New("invalid invite token")
+
+// key invite and resume tokens are signed with, set by InitStore
+var tokenKey []byte
+
+// signs an invite so it can be shared as a token of form {inviteId}.{expiresAt}.{signature}.
+// the token only proves the invite was made by the server, its role, uses and whether it was
+// revoked are checked against the database when it is redeemed
+func SignInvite(inviteId int, expiresAt time.Time) string {
+	payload := fmt.Sprintf("%d.%d", inviteId, expiresAt.Unix())
+	return payload + "." + inviteSignature(payload)
+}
+
+// checks the signature and expiry of an invite token and returns the invite id
+func VerifyInvite(token string) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, ErrInvalidInvite
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(inviteSignature(payload))) {
+		return 0, ErrInvalidInvite
+	}
+
+	inviteId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, ErrInvalidInvite
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return 0, ErrInvalidInvite
+	}
+
+	return inviteId, nil
+}
+
+func inviteSignature(payload string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte("invite:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
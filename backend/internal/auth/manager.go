@@ -27,6 +27,8 @@ const (
 var store *sessions.CookieStore
 
 func InitStore(secret string) {
+	tokenKey = []byte(secret)
+
 	store = sessions.NewCookieStore(
 		[]byte(secret),
 		nil,
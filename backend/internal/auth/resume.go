@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// signs a websocket session so its client can take it over again after reconnecting,
+// as a token of form {sessionId}.{signature}. the signature also covers the user and room,
+// so the token is only accepted when connecting to the same room as the same user.
+// whether the session actually ended and can be resumed is checked against redis
+func SignResumeToken(sessionId string, username string, roomCode string) string {
+	return sessionId + "." + resumeSignature(sessionId, username, roomCode)
+}
+
+// checks a resume token against who is connecting to which room and returns its session id
+func VerifyResumeToken(token string, username string, roomCode string) (string, error) {
+	sessionId, signature, ok := strings.Cut(token, ".")
+	if !ok || sessionId == "" {
+		return "", ErrInvalidResumeToken
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(resumeSignature(sessionId, username, roomCode))) {
+		return "", ErrInvalidResumeToken
+	}
+
+	return sessionId, nil
+}
+
+func resumeSignature(sessionId string, username string, roomCode string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	fmt.Fprintf(mac, "resume:%s:%s:%s", sessionId, username, roomCode)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/internal/models"
+	"backend/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const roomRoleKey contextKey = "roomRole"
+
+// largest body read while looking for a room code
+const maxRoomCodeBodySize = 1 << 20
+
+var roleRanks = map[string]int{
+	models.RoleViewer: 1,
+	models.RoleEditor: 2,
+	models.RoleOwner:  3,
+}
+
+// finds which room a request is about
+type RoomCodeResolver func(r *http.Request) (string, error)
+
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// reports whether role allows everything required does
+func HasRole(role string, required string) bool {
+	return role != "" && roleRanks[role] >= roleRanks[required]
+}
+
+// role of the user in the room the request is about, set by RequireRoomRole
+func GetRoomRoleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(roomRoleKey).(string)
+	return role
+}
+
+// only lets through users who have at least the required role in the room the request is about.
+// must run after AuthMiddleware
+func RequireRoomRole(required string, resolve RoomCodeResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username := GetUsernameFromContext(r.Context())
+
+			roomCode, err := resolve(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			role, archived, err := storage.GetRoomRole(roomCode, username)
+			if errors.Is(err, storage.ErrRoomNotFound) {
+				roomNotFound(w, username)
+				return
+			}
+
+			if err != nil {
+				log.Printf("error getting role in room %s: %v", roomCode, err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			// private rooms look the same as missing ones to anyone outside of them
+			if role == "" {
+				roomNotFound(w, username)
+				return
+			}
+
+			// archived rooms are read-only, owners can still manage them
+			if archived && required != models.RoleOwner {
+				role = models.RoleViewer
+			}
+
+			if !HasRole(role, required) {
+				http.Error(w, fmt.Sprintf("%s role is required", required), http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), roomRoleKey, role)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// answers a lookup of a room the user can not see. to slow down anyone guessing room codes,
+// these are counted, and past the limit they are told to wait instead. rooms they can see
+// are never held up
+func roomNotFound(w http.ResponseWriter, username string) {
+	allowed, retryAfter, err := storage.CanLookUpRooms(username)
+	if err != nil {
+		log.Printf("error checking room lookups of %s: %v", username, err)
+	} else if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "too many rooms not found, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	if err := storage.RecordFailedRoomLookup(username); err != nil {
+		log.Printf("error recording room lookup of %s: %v", username, err)
+	}
+
+	http.Error(w, "room not found", http.StatusNotFound)
+}
+
+// reads the room code from a url parameter, e.g. /rooms/{id}
+func RoomFromURLParam(name string) RoomCodeResolver {
+	return func(r *http.Request) (string, error) {
+		roomCode := strings.TrimSpace(chi.URLParam(r, name))
+		if roomCode == "" {
+			return "", errors.New("room code is required")
+		}
+
+		return roomCode, nil
+	}
+}
+
+// reads the room code from the roomCode query parameter
+func RoomFromQuery(r *http.Request) (string, error) {
+	roomCode := strings.TrimSpace(r.URL.Query().Get("roomCode"))
+	if roomCode == "" {
+		return "", errors.New("room code is required")
+	}
+
+	return roomCode, nil
+}
+
+// reads the room code from the roomCode field of a json body, leaving the body for the handler
+func RoomFromBody(r *http.Request) (string, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRoomCodeBodySize))
+	if err != nil {
+		return "", errors.New("could not read body")
+	}
+
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		RoomCode string `json:"roomCode"`
+	}
+
+	if err := json.Unmarshal(body, &req); err != nil || req.RoomCode == "" {
+		return "", errors.New("room code is required")
+	}
+
+	return req.RoomCode, nil
+}
+
+// finds the room of the pdf in the pdfId query parameter
+func RoomFromPDF(r *http.Request) (string, error) {
+	pdfId, err := strconv.Atoi(r.URL.Query().Get("pdfId"))
+	if err != nil {
+		return "", errors.New("invalid pdf id")
+	}
+
+	_, roomCode, err := storage.GetPDFByID(pdfId)
+	if err != nil {
+		return "", errors.New("pdf not found")
+	}
+
+	return roomCode, nil
+}
@@ -1,12 +1,16 @@
 package client
 
 import (
+	"backend/internal/auth"
 	"backend/internal/models"
 	"backend/internal/storage"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"html"
 	"log"
+	"regexp"
 	"time"
 
 	"backend/internal/room"
@@ -15,13 +19,30 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func CreateClient(userId string, roomCode string, docId int, conn *websocket.Conn) *models.Client {
+const (
+	maxCursorNameLength = 50
+	// how many messages can wait to be written to a client before it counts as too slow
+	sendQueueSize = 256
+	// how long writing one message to a client may take before it counts as gone
+	writeWait = 10 * time.Second
+)
+
+var (
+	cursorColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	cursorColors       = []string{"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4", "#f032e6", "#9a6324"}
+)
+
+func CreateClient(sessionId string, username string, role string, roomCode string, docId int, conn *websocket.Conn) *models.Client {
 	return &models.Client{
-		ID:       userId,
-		DocId:    docId,
-		Conn:     conn,
-		RoomCode: roomCode,
-		SendChan: make(chan []byte, 256),
+		ID:        sessionId,
+		Username:  username,
+		Role:      role,
+		DocId:     docId,
+		Conn:      conn,
+		RoomCode:  roomCode,
+		SendChan:  make(chan []byte, sendQueueSize),
+		Documents: make(map[int]bool),
+		Cursors:   make(map[int]*models.Cursor),
 	}
 }
 
@@ -33,6 +54,11 @@ func WriteClient(client *models.Client) {
 		client.Conn.Close()
 	}()
 
+	messageType := websocket.TextMessage
+	if client.Yjs {
+		messageType = websocket.BinaryMessage
+	}
+
 	for {
 		select {
 		// there is a message to be sent
@@ -43,7 +69,8 @@ func WriteClient(client *models.Client) {
 			}
 
 			client.Mu.Lock()
-			err := client.Conn.WriteMessage(websocket.TextMessage, message)
+			client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := client.Conn.WriteMessage(messageType, message)
 			client.Mu.Unlock()
 
 			if err != nil {
@@ -54,6 +81,7 @@ func WriteClient(client *models.Client) {
 		// ping client to keep connection alive
 		case <-ticker.C:
 			client.Mu.Lock()
+			client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			err := client.Conn.WriteMessage(websocket.PingMessage, nil)
 			client.Mu.Unlock()
 
@@ -67,11 +95,24 @@ func WriteClient(client *models.Client) {
 
 func ReadClient(client *models.Client, rm *models.Room) {
 	defer func() {
+		docs := room.GetDocuments(rm, client)
 		room.RemoveClient(rm, client)
 		close(client.SendChan)
+
 		client.Conn.Close()
 		log.Printf("Client %s disconnected\n", client.ID)
-		room.BroadcastClientCount(rm, client.DocId)
+		room.BroadcastPresence(client.RoomCode)
+
+		// the client's cursors left with it
+		for _, docId := range docs {
+			broadcastCursorRemove(client, docId)
+		}
+
+		// the client may reconnect and pick up where it left off. done last, since a new
+		// connection may take over the session as soon as it is marked
+		if err := storage.MarkResumable(client.ID); err != nil {
+			log.Printf("could not keep session %s: %v", client.ID, err)
+		}
 	}()
 
 	client.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -81,30 +122,91 @@ func ReadClient(client *models.Client, rm *models.Room) {
 	})
 
 	for {
-		_, message, err := client.Conn.ReadMessage()
+		messageType, message, err := client.Conn.ReadMessage()
 		if err != nil {
 			break
 		}
 
-		var msg models.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("could not unmarshal message: %v", err)
+		msg, err := parseMessage(messageType, message)
+		if errors.Is(err, errUnknownType) {
+			replyError(client, &msg, models.ErrorUnknownType, err.Error())
+			continue
+		}
+
+		if err != nil {
+			replyError(client, &msg, models.ErrorInvalidMessage, err.Error())
+			continue
+		}
+
+		// messages that do not name a document are about the one the connection was opened for
+		if msg.DocumentId == 0 {
+			msg.DocumentId = client.DocId
+		}
+
+		if msg.DocumentId <= 0 {
+			replyError(client, &msg, models.ErrorInvalidMessage, "documentId is required")
 			continue
 		}
 
 		switch msg.Type {
+		case "subscribe":
+			handleSubscribe(client, rm, &msg)
+		case "unsubscribe":
+			handleUnsubscribe(client, rm, &msg)
+		case "resume":
+			handleResume(client, rm, &msg)
 		case "operation":
+			if !requireSubscription(client, rm, &msg) {
+				continue
+			}
+
+			if !canEdit(client, rm) {
+				replyError(client, &msg, models.ErrorForbidden, "viewers can not edit")
+				// the viewer's editor already shows its edit, put the document back
+				resyncClient(client, rm, msg.DocumentId)
+				continue
+			}
 			handleOperation(client, rm, &msg)
+		case "undo", "redo":
+			if !requireSubscription(client, rm, &msg) {
+				continue
+			}
+
+			if !canEdit(client, rm) {
+				replyError(client, &msg, models.ErrorForbidden, "viewers can not edit")
+				continue
+			}
+
+			revert := storage.Undo
+			if msg.Type == "redo" {
+				revert = storage.Redo
+			}
+			handleUndo(client, &msg, revert)
+		case "cursor":
+			if requireSubscription(client, rm, &msg) {
+				handleCursor(client, rm, &msg)
+			}
 		}
 	}
 }
 
-func SendInitialState(client *models.Client, content string, count int) error {
+// viewers can only read, everyone else can edit
+func canEdit(client *models.Client, rm *models.Room) bool {
+	return auth.HasRole(room.GetClientRole(rm, client), models.RoleEditor)
+}
+
+// sends a client the current state of a document it subscribed to
+func SendInitialState(client *models.Client, docId int, content string, revision int, count int, role string) error {
 	initMsg := models.Message{
-		Type:    "init",
-		Content: content,
-		UserID:  client.ID,
-		Count:   count,
+		Type:        "init",
+		DocumentId:  docId,
+		Content:     content,
+		UserID:      client.ID,
+		Username:    client.Username,
+		Role:        role,
+		Count:       count,
+		Revision:    revision,
+		ResumeToken: auth.SignResumeToken(client.ID, client.Username, client.RoomCode),
 	}
 
 	data, err := json.Marshal(initMsg)
@@ -112,36 +214,375 @@ func SendInitialState(client *models.Client, content string, count int) error {
 		return fmt.Errorf("failed to marshal init message: %w", err)
 	}
 
-	client.SendChan <- data
+	room.SendToClient(client, data)
+	return nil
+}
+
+// tells a client that connected to the whole room who it is. its documents each get an
+// init once it subscribes to them
+func SendConnected(client *models.Client, role string) error {
+	data, err := json.Marshal(models.Message{
+		Type:        "connected",
+		UserID:      client.ID,
+		Username:    client.Username,
+		Role:        role,
+		ResumeToken: auth.SignResumeToken(client.ID, client.Username, client.RoomCode),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal connected message: %w", err)
+	}
+
+	room.SendToClient(client, data)
 	return nil
 }
 
 func handleOperation(client *models.Client, rm *models.Room, msg *models.Message) {
-	if msg.Operation == nil {
+	// the operation reaches everyone else on the document through the room,
+	// and the client gets an ack in its place
+	event := models.RoomEvent{SessionId: client.ID, Username: client.Username, Ack: true}
+
+	committed, revision, err := storage.CommitOperation(client.RoomCode, msg.DocumentId, *msg.Operation, event)
+	if err != nil {
+		log.Printf("could not commit operation to document %d: %v\n", msg.DocumentId, err)
+
+		rejectOperations(client, rm, msg, err)
 		return
 	}
 
-	currentContent, err := storage.GetDocumentContent(client.RoomCode, client.DocId)
+	if err := storage.RecordUndoStep(client.RoomCode, msg.DocumentId, client.Username, committed); err != nil {
+		log.Printf("could not record undo step for client %s: %v\n", client.ID, err)
+	}
+
+	// nothing was committed, so nothing was published either
+	if len(committed) == 0 {
+		ack, _ := json.Marshal(models.Message{
+			Type:       "ack",
+			DocumentId: msg.DocumentId,
+			Revision:   revision,
+		})
+		room.SendToClient(client, ack)
+	}
+}
+
+// subscribes a client that reconnected to a document it had open, and catches it up. the
+// operations it made while disconnected are committed against the revision it last saw, and it
+// gets everything committed before them transformed to apply on top of them, in one step. if that
+// revision is no longer in the history, or its operations can not be taken, it gets a full init
+// instead and its operations are dropped
+func handleResume(client *models.Client, rm *models.Room, msg *models.Message) {
+	docId := msg.DocumentId
+	// compound operations are transformed for the client as the inserts and deletes they are made of
+	pending := utils.ExpandOperations(msg.Operations)
+
+	// the document must belong to the room
+	if _, err := storage.GetDocument(client.RoomCode, docId); err != nil {
+		rejectSubscription(client, msg, err)
+		return
+	}
+
+	// subscribed first, so that no operation committed in the meantime is missed
+	if !room.Subscribe(rm, client, docId) {
+		rejectSubscription(client, msg, errAlreadySubscribed)
+		return
+	}
+
+	room.BroadcastPresence(client.RoomCode)
+
+	if err := SendCursors(client, rm, docId); err != nil {
+		log.Printf("error sending cursors: %v", err)
+	}
+
+	if len(pending) > 0 && !canEdit(client, rm) {
+		replyError(client, msg, models.ErrorForbidden, "viewers can not edit")
+		resyncClient(client, rm, docId)
+		return
+	}
+
+	// the client already has its operations, everyone else gets them through the room
+	event := models.RoomEvent{SessionId: client.ID, Username: client.Username, Except: client.ID}
+
+	// operations whose ack the client missed were committed already, and must not be again
+	ops, base, received, err := skipCommittedOperations(client, docId, msg)
 	if err != nil {
-		log.Printf("error getting document %d\n", client.DocId)
+		log.Printf("could not resume client %s: %v\n", client.ID, err)
+		rejectOperations(client, rm, msg, err)
 		return
 	}
 
-	newContent := utils.ApplyOperation(currentContent, msg.Operation)
+	if base != msg.Revision {
+		pending = ops
+		// the compound operations among them were expanded, and are still never shown half applied
+		event.Atomic = hasCompounds(msg.Operations)
+	}
 
-	err = storage.UpdateDocumentContent(client.RoomCode, newContent, client.DocId)
+	committed, revision, err := storage.CommitOperations(client.RoomCode, docId, ops, base, event)
 	if err != nil {
-		log.Printf("could not update document %d\n", client.DocId)
+		log.Printf("could not resume client %s: %v\n", client.ID, err)
+		rejectOperations(client, rm, msg, err)
+		return
 	}
 
-	msg.Operation.Text = html.EscapeString(msg.Operation.Text)
+	room.TrackRevision(rm, docId, revision)
 
-	response := models.Message{
-		Type:      "operation",
-		Operation: msg.Operation,
-		UserID:    client.ID,
+	if err := storage.RecordUndoStep(client.RoomCode, docId, client.Username, committed); err != nil {
+		log.Printf("could not record undo step for client %s: %v\n", client.ID, err)
 	}
 
-	data, _ := json.Marshal(response)
-	room.BroadcastToOthers(rm, client.ID, client.DocId, data)
+	// what was committed between the revision the client saw and its own operations
+	missedCount := revision - len(committed) - base
+
+	history, err := storage.GetOperationsSince(client.RoomCode, docId, base)
+	if err != nil || len(history) < missedCount {
+		// its operations are already committed, it only needs the document they ended up in
+		resyncClient(client, rm, docId)
+		return
+	}
+
+	data, err := json.Marshal(models.Message{
+		Type:        "resumed",
+		DocumentId:  docId,
+		UserID:      client.ID,
+		Username:    client.Username,
+		Role:        room.GetClientRole(rm, client),
+		Count:       room.GetClientCount(client.RoomCode, docId),
+		Revision:    revision,
+		Operations:  append(received, utils.TransformCommitted(history[:missedCount], pending)...),
+		ResumeToken: auth.SignResumeToken(client.ID, client.Username, client.RoomCode),
+	})
+	if err != nil {
+		log.Printf("could not marshal resumed message: %v", err)
+		return
+	}
+
+	room.SendToClient(client, data)
+}
+
+// finds the operations a resuming client sends again that were committed before it lost its
+// connection, going by the numbers it gave them. the history since the revision the client saw is
+// replayed the way the client would have received it: its own committed operations stand in for
+// acks, and everything else is transformed to apply on top of its pending operations, which are
+// transformed in turn. returns the operations that are left to commit, the revision they apply
+// to now, and what the client has to apply to catch up with that revision. without committed
+// operations among them, the operations are returned as they are
+func skipCommittedOperations(client *models.Client, docId int, msg *models.Message) ([]models.Operation, int, []models.Operation, error) {
+	if len(msg.Operations) == 0 || msg.Operations[0].Seq == 0 {
+		return msg.Operations, msg.Revision, nil, nil
+	}
+
+	seqs, err := storage.GetCommittedSeqs(client.RoomCode, docId, client.ID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	committedAt := make(map[int]storage.CommittedSeq, len(seqs))
+	for _, c := range seqs {
+		committedAt[c.Seq] = c
+	}
+
+	// operations are committed in the order they were sent, so the committed ones come first
+	var acked []storage.CommittedSeq
+	for _, op := range msg.Operations {
+		c, ok := committedAt[op.Seq]
+		if !ok {
+			break
+		}
+
+		acked = append(acked, c)
+	}
+
+	if len(acked) == 0 {
+		return msg.Operations, msg.Revision, nil, nil
+	}
+
+	history, err := storage.GetOperationsSince(client.RoomCode, docId, msg.Revision)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	// one group per operation of the client, compound ones are transformed as what they are made of
+	groups := make([][]models.Operation, len(msg.Operations))
+	for i, op := range msg.Operations {
+		groups[i] = utils.ExpandOperation(op)
+	}
+
+	var received []models.Operation
+	revision := msg.Revision
+
+	for i := 0; i < len(history); {
+		if len(acked) > 0 && acked[0].Revision == revision {
+			// the client's own operation, which it already applied
+			i += acked[0].Count
+			revision += acked[0].Count
+			groups = groups[1:]
+			acked = acked[1:]
+			continue
+		}
+
+		incoming := history[i : i+1]
+		for g := range groups {
+			groups[g], incoming = utils.TransformOperations(groups[g], incoming), utils.TransformCommitted(incoming, groups[g])
+		}
+
+		received = append(received, incoming...)
+		i++
+		revision++
+	}
+
+	if len(acked) > 0 {
+		return nil, 0, nil, fmt.Errorf("%w: committed operations of the client are not in the history", storage.ErrRevisionUnavailable)
+	}
+
+	var ops []models.Operation
+	for g, group := range groups {
+		// still numbered, so they are remembered once committed
+		for j := range group {
+			group[j].Seq = msg.Operations[len(msg.Operations)-len(groups)+g].Seq
+		}
+
+		ops = append(ops, group...)
+	}
+
+	return ops, revision, received, nil
+}
+
+func hasCompounds(ops []models.Operation) bool {
+	for _, op := range ops {
+		if op.Type == "compound" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reverts the user's last step (or undo) and sends the result to everyone on the document,
+// including the client itself since it does not know how the step was transformed
+func handleUndo(
+	client *models.Client,
+	msg *models.Message,
+	revert func(roomCode string, documentId int, sessionId string, author string) ([]models.Operation, int, error),
+) {
+	_, _, err := revert(client.RoomCode, msg.DocumentId, client.ID, client.Username)
+	if err != nil && !errors.Is(err, storage.ErrNothingToUndo) {
+		log.Printf("could not revert step of client %s: %v\n", client.ID, err)
+		replyError(client, msg, models.ErrorInternal, "could not "+msg.Type)
+	}
+}
+
+// stores the client's caret and selection and shares it with everyone else on the document
+func handleCursor(client *models.Client, rm *models.Room, msg *models.Message) {
+	docId := msg.DocumentId
+	cursor := *msg.Cursor
+
+	// bring the cursor up to date with operations committed since the client saw the document
+	ops, err := storage.GetOperationsSince(client.RoomCode, docId, cursor.Revision)
+	if errors.Is(err, storage.ErrInvalidRevision) || errors.Is(err, storage.ErrRevisionUnavailable) {
+		replyError(client, msg, models.ErrorStaleRevision, "cursor revision is not available")
+		return
+	}
+
+	if err != nil {
+		log.Printf("could not get operations of document %d: %v\n", docId, err)
+		replyError(client, msg, models.ErrorInternal, "could not move cursor")
+		return
+	}
+
+	cursor = utils.TransformCursor(cursor, ops)
+
+	if cursor.Name == "" {
+		cursor.Name = client.Username
+	}
+
+	name := []rune(html.EscapeString(cursor.Name))
+	cursor.Name = string(name[:min(len(name), maxCursorNameLength)])
+
+	if !cursorColorPattern.MatchString(cursor.Color) {
+		cursor.Color = defaultCursorColor(client.ID)
+	}
+
+	room.SetCursor(rm, client, docId, &cursor)
+
+	data, _ := json.Marshal(models.Message{
+		Type:       "cursor",
+		DocumentId: docId,
+		UserID:     client.ID,
+		Username:   client.Username,
+		Cursor:     &cursor,
+	})
+	room.BroadcastToOthers(client.RoomCode, client.ID, docId, data)
+}
+
+// picks a stable colour for clients that did not choose one
+func defaultCursorColor(clientId string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(clientId))
+	return cursorColors[hash.Sum32()%uint32(len(cursorColors))]
+}
+
+// sends the cursors of everyone else on the document to a client that just subscribed to it
+func SendCursors(client *models.Client, rm *models.Room, docId int) error {
+	cursors := room.GetCursors(rm, docId, client.ID)
+	if len(cursors) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(models.Message{
+		Type:       "cursors",
+		DocumentId: docId,
+		Cursors:    cursors,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal cursors message: %w", err)
+	}
+
+	room.SendToClient(client, data)
+	return nil
+}
+
+// sends a client an error message and closes its connection
+func RejectClient(client *models.Client, code string, message string, closeCode int) {
+	data, _ := json.Marshal(models.Message{
+		Type:    "error",
+		Code:    code,
+		Message: message,
+	})
+
+	room.DisconnectClient(client, data, closeCode, message)
+}
+
+// tells a client why its operations were not committed. its editor already shows them, so
+// unless its document is gone it starts over from the current state
+func rejectOperations(client *models.Client, rm *models.Room, msg *models.Message, err error) {
+	switch {
+	case errors.Is(err, storage.ErrDocumentNotFound):
+		rejectMissingDocument(client, rm, msg)
+		return
+	case errors.Is(err, storage.ErrInvalidRevision), errors.Is(err, storage.ErrRevisionUnavailable):
+		// too far behind to transform its operations
+		replyError(client, msg, models.ErrorStaleRevision, "revision is not available")
+	case errors.Is(err, storage.ErrInvalidOperation):
+		replyError(client, msg, models.ErrorInvalidOperation, err.Error())
+	default:
+		replyError(client, msg, models.ErrorInternal, "could not commit operation")
+	}
+
+	resyncClient(client, rm, msg.DocumentId)
+}
+
+// sends the current document state to a client whose operations can no longer be transformed
+func resyncClient(client *models.Client, rm *models.Room, docId int) {
+	content, revision, err := storage.GetDocumentState(client.RoomCode, docId)
+	if errors.Is(err, storage.ErrDocumentNotFound) {
+		rejectMissingDocument(client, rm, &models.Message{DocumentId: docId})
+		return
+	}
+
+	if err != nil {
+		log.Printf("error getting document %d\n", docId)
+		return
+	}
+
+	if err := SendInitialState(client, docId, content, revision, room.GetClientCount(client.RoomCode, docId), room.GetClientRole(rm, client)); err != nil {
+		log.Printf("error resending initial state: %v", err)
+	}
 }
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"backend/internal/models"
+	"backend/internal/room"
+	"backend/internal/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// versions of the websocket protocol, offered by clients as a websocket subprotocol.
+// clients that offer none get the first version
+const ProtocolV1 = "studyhub.v1"
+
+// supported versions, the server picks the first one a client offers
+var Protocols = []string{ProtocolV1}
+
+var (
+	errMalformedMessage = errors.New("message is not a json object")
+	errUnknownType      = errors.New("unknown message type")
+)
+
+// checks that a message carries what its type needs before it is handled. every type a
+// client may send has one, messages of other types are rejected. the document a message
+// is about is checked when it is handled
+var validators = map[string]func(msg *models.Message) error{
+	"subscribe":   noPayload,
+	"unsubscribe": noPayload,
+	"operation":   validateOperationMessage,
+	"undo":        noPayload,
+	"redo":        noPayload,
+	"cursor":      validateCursorMessage,
+	"resume":      validateResumeMessage,
+}
+
+// whether the client asked for a version of the protocol that the server does not speak.
+// clients that do not ask for any version are served the first one
+func UnsupportedProtocol(requested []string) bool {
+	if len(requested) == 0 {
+		return false
+	}
+
+	for _, protocol := range requested {
+		for _, supported := range Protocols {
+			if protocol == supported {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// reads a message sent by a client and checks its payload
+func parseMessage(messageType int, data []byte) (models.Message, error) {
+	var msg models.Message
+
+	if messageType != websocket.TextMessage {
+		return msg, errMalformedMessage
+	}
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, fmt.Errorf("%w: %w", errMalformedMessage, err)
+	}
+
+	validate, ok := validators[msg.Type]
+	if !ok {
+		return msg, fmt.Errorf("%w: %q", errUnknownType, msg.Type)
+	}
+
+	return msg, validate(&msg)
+}
+
+func noPayload(*models.Message) error {
+	return nil
+}
+
+func validateOperationMessage(msg *models.Message) error {
+	if msg.Operation == nil {
+		return errors.New("operation is required")
+	}
+
+	return validateOperation(*msg.Operation)
+}
+
+func validateOperation(op models.Operation) error {
+	if err := utils.ValidateOperation(op); err != nil {
+		return err
+	}
+
+	if op.Revision < 0 {
+		return errors.New("revision must not be negative")
+	}
+
+	return nil
+}
+
+func validateCursorMessage(msg *models.Message) error {
+	cursor := msg.Cursor
+	if cursor == nil {
+		return errors.New("cursor is required")
+	}
+
+	if cursor.Position < 0 || cursor.SelectionStart < 0 || cursor.SelectionEnd < cursor.SelectionStart {
+		return errors.New("cursor positions must not be negative and the selection must not end before it starts")
+	}
+
+	if cursor.Revision < 0 {
+		return errors.New("revision must not be negative")
+	}
+
+	return nil
+}
+
+func validateResumeMessage(msg *models.Message) error {
+	if msg.Revision < 0 {
+		return errors.New("revision must not be negative")
+	}
+
+	for _, op := range msg.Operations {
+		if err := validateOperation(op); err != nil {
+			return err
+		}
+
+		// the client's operations are transformed for it too, which needs utf-16 positions
+		if op.Unit != "" && op.Unit != models.UnitUTF16 {
+			return errors.New("pending operations must have utf16 positions")
+		}
+	}
+
+	return nil
+}
+
+// answers a message the client sent that was not accepted. the connection stays open
+func replyError(client *models.Client, msg *models.Message, code string, message string) {
+	data, _ := json.Marshal(models.Message{
+		Type:       "error",
+		ID:         msg.ID,
+		DocumentId: msg.DocumentId,
+		Code:       code,
+		Message:    message,
+	})
+
+	room.SendToClient(client, data)
+}
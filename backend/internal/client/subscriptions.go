@@ -0,0 +1,119 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"backend/internal/models"
+	"backend/internal/room"
+	"backend/internal/storage"
+
+	"github.com/gorilla/websocket"
+)
+
+var errAlreadySubscribed = errors.New("already subscribed to the document")
+
+// subscribes a client in the room to a document of the room, and sends it the document's
+// current state and cursors
+func SubscribeDocument(client *models.Client, rm *models.Room, docId int) error {
+	if !room.Subscribe(rm, client, docId) {
+		return errAlreadySubscribed
+	}
+
+	// read after subscribing, so that no operation committed in the meantime is missed
+	content, revision, err := storage.GetDocumentState(client.RoomCode, docId)
+	if err != nil {
+		room.Unsubscribe(rm, client, docId)
+		return fmt.Errorf("could not get document state: %w", err)
+	}
+
+	room.TrackRevision(rm, docId, revision)
+
+	count := room.GetClientCount(client.RoomCode, docId)
+
+	if err := SendInitialState(client, docId, content, revision, count, room.GetClientRole(rm, client)); err != nil {
+		log.Printf("error sending initial state: %v", err)
+	}
+
+	if err := SendCursors(client, rm, docId); err != nil {
+		log.Printf("error sending cursors: %v", err)
+	}
+
+	return nil
+}
+
+func handleSubscribe(client *models.Client, rm *models.Room, msg *models.Message) {
+	// the document must belong to the room
+	_, err := storage.GetDocument(client.RoomCode, msg.DocumentId)
+	if err == nil {
+		err = SubscribeDocument(client, rm, msg.DocumentId)
+	}
+
+	if err != nil {
+		rejectSubscription(client, msg, err)
+		return
+	}
+
+	room.BroadcastPresence(client.RoomCode)
+}
+
+func handleUnsubscribe(client *models.Client, rm *models.Room, msg *models.Message) {
+	if !room.Unsubscribe(rm, client, msg.DocumentId) {
+		replyError(client, msg, models.ErrorNotSubscribed, "not subscribed to the document")
+		return
+	}
+
+	room.BroadcastPresence(client.RoomCode)
+	broadcastCursorRemove(client, msg.DocumentId)
+}
+
+// whether the client is subscribed to the document of a message, and tells it if not
+func requireSubscription(client *models.Client, rm *models.Room, msg *models.Message) bool {
+	if room.IsSubscribed(rm, client, msg.DocumentId) {
+		return true
+	}
+
+	replyError(client, msg, models.ErrorNotSubscribed, "not subscribed to the document")
+	return false
+}
+
+// tells a client why it could not subscribe to a document
+func rejectSubscription(client *models.Client, msg *models.Message, err error) {
+	switch {
+	case errors.Is(err, errAlreadySubscribed):
+		replyError(client, msg, models.ErrorAlreadySubscribed, err.Error())
+	case errors.Is(err, storage.ErrDocumentNotFound):
+		replyError(client, msg, models.ErrorDocumentNotFound, "document not found")
+	default:
+		log.Printf("could not subscribe client %s to document %d: %v", client.ID, msg.DocumentId, err)
+		replyError(client, msg, models.ErrorInternal, "could not load document")
+	}
+}
+
+// handles a document the client is subscribed to being gone, e.g. because it was deleted.
+// a connection that was opened for it is closed, otherwise the client is only unsubscribed
+func rejectMissingDocument(client *models.Client, rm *models.Room, msg *models.Message) {
+	if msg.DocumentId == client.DocId {
+		RejectClient(client, models.ErrorDocumentNotFound, "document not found", websocket.CloseNormalClosure)
+		return
+	}
+
+	if room.Unsubscribe(rm, client, msg.DocumentId) {
+		room.BroadcastPresence(client.RoomCode)
+		broadcastCursorRemove(client, msg.DocumentId)
+	}
+
+	replyError(client, msg, models.ErrorDocumentNotFound, "document not found")
+}
+
+// lets everyone else on a document know that the client's cursor left it
+func broadcastCursorRemove(client *models.Client, docId int) {
+	data, _ := json.Marshal(models.Message{
+		Type:       "cursorRemove",
+		DocumentId: docId,
+		UserID:     client.ID,
+	})
+	room.BroadcastToOthers(client.RoomCode, client.ID, docId, data)
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"log"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/room"
+	"backend/internal/yjs"
+
+	"github.com/gorilla/websocket"
+)
+
+// clients of the yjs endpoint speak the y-websocket protocol: binary sync and awareness
+// messages about the one document they connected to
+
+// largest message a yjs client may send, a whole document when it syncs for the first time
+const maxYjsMessageSize = 8 << 20
+
+func CreateYjsClient(sessionId string, username string, role string, roomCode string, docId int, conn *websocket.Conn) *models.Client {
+	return &models.Client{
+		ID:        sessionId,
+		Username:  username,
+		Role:      role,
+		DocId:     docId,
+		Conn:      conn,
+		RoomCode:  roomCode,
+		SendChan:  make(chan []byte, sendQueueSize),
+		Yjs:       true,
+		Awareness: make(map[uint64]uint64),
+	}
+}
+
+// starts syncing a yjs client that just joined: it is asked for what it has that the server
+// misses, and gets the awareness states of everyone else on the document
+func StartYjsSync(client *models.Client) error {
+	sv, err := room.GetYjsStateVector(client.RoomCode, client.DocId)
+	if err != nil {
+		return err
+	}
+
+	room.SendToClient(client, yjs.SyncStep1Message(sv))
+
+	if states := room.GetAwareness(client.RoomCode, client.DocId); states != nil {
+		room.SendToClient(client, yjs.AwarenessMessage(states))
+	}
+
+	return nil
+}
+
+func ReadYjsClient(client *models.Client, rm *models.Room) {
+	defer func() {
+		room.RemoveYjsClient(rm, client)
+		close(client.SendChan)
+
+		client.Conn.Close()
+		log.Printf("Yjs client %s disconnected\n", client.ID)
+		room.BroadcastPresence(client.RoomCode)
+	}()
+
+	client.Conn.SetReadLimit(maxYjsMessageSize)
+	client.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	client.Conn.SetPongHandler(func(string) error {
+		client.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+
+	for {
+		messageType, data, err := client.Conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		msg, err := yjs.ParseMessage(data)
+		if err != nil {
+			log.Printf("invalid message from yjs client %s: %v\n", client.ID, err)
+			room.DisconnectClient(client, nil, websocket.CloseUnsupportedData, "invalid message")
+			break
+		}
+
+		switch msg.Type {
+		case yjs.MessageSync:
+			handleYjsSync(client, rm, &msg)
+		case yjs.MessageAwareness:
+			if err := room.UpdateAwareness(rm, client, msg.Payload); err != nil {
+				log.Printf("invalid awareness update from yjs client %s: %v\n", client.ID, err)
+			}
+		case yjs.MessageQueryAwareness:
+			if states := room.GetAwareness(client.RoomCode, client.DocId); states != nil {
+				room.SendToClient(client, yjs.AwarenessMessage(states))
+			}
+		}
+	}
+}
+
+func handleYjsSync(client *models.Client, rm *models.Room, msg *yjs.Message) {
+	switch msg.Step {
+	case yjs.SyncStep1:
+		update, err := room.GetYjsDiff(client.RoomCode, client.DocId, msg.Payload)
+		if err != nil {
+			log.Printf("could not answer yjs client %s: %v\n", client.ID, err)
+			room.DisconnectClient(client, nil, websocket.CloseInternalServerErr, "could not sync document")
+			return
+		}
+
+		room.SendToClient(client, yjs.SyncStep2Message(update))
+	case yjs.SyncStep2, yjs.SyncUpdate:
+		if !canEdit(client, rm) {
+			// every client answers the server's first step, with nothing new if it only reads
+			if msg.Step == yjs.SyncUpdate {
+				room.SendToClient(client, yjs.PermissionDeniedMessage("viewers can not edit"))
+			}
+			return
+		}
+
+		if err := room.ApplyYjsUpdate(rm, client, msg.Payload); err != nil {
+			// the client still has its changes and sends them again once it reconnects
+			log.Printf("could not apply update of yjs client %s: %v\n", client.ID, err)
+			room.DisconnectClient(client, nil, websocket.CloseInternalServerErr, "could not apply update")
+		}
+	}
+}
@@ -25,6 +25,10 @@ func AIHandler(w http.ResponseWriter, r *http.Request) {
 	req.Prompt = html.EscapeString(req.Prompt)
 
 	// since ai response can take long we can do it async and sent accepted response
-	go ai.BroadcastAIResponse(&req)
+	if err := ai.StartAIResponse(&req); err != nil {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -2,13 +2,17 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"log"
 	"net/http"
 
+	"backend/internal/models"
 	"backend/internal/room"
 	"backend/internal/storage"
+
+	"github.com/gorilla/websocket"
 )
 
 func HandleGetDocuments(w http.ResponseWriter, r *http.Request) {
@@ -31,6 +35,16 @@ func HandleGetDocuments(w http.ResponseWriter, r *http.Request) {
 		response["documents"] = []interface{}{}
 	}
 
+	// documents nested in their folders
+	if r.URL.Query().Get("tree") == "true" {
+		folders, err := storage.GetFolders(roomCode)
+		if err != nil {
+			log.Printf("error getting folders of room %s: %v", roomCode, err)
+		}
+
+		response["tree"] = buildFolderTree(folders, docs)
+	}
+
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -58,16 +72,18 @@ func HandleCreateDocument(w http.ResponseWriter, r *http.Request) {
 	req.Title = html.EscapeString(req.Title)
 
 	docId, err := storage.CreateDocument(roomCode, req.Title, fmt.Sprintf("# %s\n\n", req.Title))
+	if errors.Is(err, storage.ErrDocumentTitleTaken) {
+		http.Error(w, "a document with this title already exists", http.StatusConflict)
+		return
+	}
+
 	if err != nil {
 		log.Printf("error creating document: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	rm := room.GetRoom(roomCode)
-	if rm != nil {
-		room.BroadcastDocumentListUpdate(rm)
-	}
+	room.BroadcastDocumentListUpdate(roomCode)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -75,3 +91,159 @@ func HandleCreateDocument(w http.ResponseWriter, r *http.Request) {
 		"title": req.Title,
 	})
 }
+
+// renames a document and/or moves it to another folder or position in the sidebar
+func HandleUpdateDocument(w http.ResponseWriter, r *http.Request) {
+	roomCode, docId, ok := parseDocumentRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Title *string `json:"title"`
+		// 0 moves the document to the top of the room
+		FolderID *int `json:"folderId"`
+		Position *int `json:"position"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Title == nil && req.FolderID == nil && req.Position == nil) {
+		http.Error(w, "body must contain a title, folderId or position", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+
+	if req.Title != nil {
+		if *req.Title == "" {
+			http.Error(w, "title must be non empty", http.StatusBadRequest)
+			return
+		}
+
+		err = storage.RenameDocument(roomCode, docId, html.EscapeString(*req.Title))
+	}
+
+	if err == nil && (req.FolderID != nil || req.Position != nil) {
+		err = storage.MoveDocument(roomCode, docId, req.FolderID, req.Position)
+	}
+
+	if errors.Is(err, storage.ErrDocumentNotFound) {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, storage.ErrFolderNotFound) {
+		http.Error(w, "folder not found", http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, storage.ErrDocumentTitleTaken) {
+		http.Error(w, "a document with this title already exists", http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error updating document %d: %v", docId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	doc, err := storage.GetDocument(roomCode, docId)
+	if err != nil {
+		log.Printf("error getting document %d: %v", docId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	room.BroadcastDocumentListUpdate(roomCode)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// deletes a document and disconnects everyone who had it open
+func HandleDeleteDocument(w http.ResponseWriter, r *http.Request) {
+	roomCode, docId, ok := parseDocumentRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := storage.DeleteDocument(roomCode, docId)
+	if errors.Is(err, storage.ErrDocumentNotFound) {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error deleting document %d: %v", docId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data, _ := json.Marshal(models.Message{
+		Type:       "documentDeleted",
+		DocumentId: docId,
+	})
+	room.CloseDocument(roomCode, docId, data, websocket.CloseNormalClosure, "document deleted")
+	room.BroadcastDocumentListUpdate(roomCode)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// copies the current content of a document into a new one, e.g. to use it as a template
+func HandleDuplicateDocument(w http.ResponseWriter, r *http.Request) {
+	roomCode, docId, ok := parseDocumentRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Title string `json:"title"`
+	}
+
+	// the body is optional
+	json.NewDecoder(r.Body).Decode(&req)
+
+	if req.Title == "" {
+		doc, err := storage.GetDocument(roomCode, docId)
+		if errors.Is(err, storage.ErrDocumentNotFound) {
+			http.Error(w, "document not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error getting document %d: %v", docId, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// titles are stored escaped already
+		req.Title = "Copy of " + doc.Title
+	} else {
+		req.Title = html.EscapeString(req.Title)
+	}
+
+	newDocId, err := storage.DuplicateDocument(roomCode, docId, req.Title)
+	if errors.Is(err, storage.ErrDocumentNotFound) {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, storage.ErrDocumentTitleTaken) {
+		http.Error(w, "a document with this title already exists", http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error duplicating document %d: %v", docId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	room.BroadcastDocumentListUpdate(roomCode)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":    newDocId,
+		"title": req.Title,
+	})
+}
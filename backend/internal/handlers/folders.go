@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+
+	"backend/internal/models"
+	"backend/internal/room"
+	"backend/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// nests folders and documents, both already ordered by position. anything whose folder is
+// missing ends up at the top of the room so that it never disappears from the sidebar
+func buildFolderTree(folders []models.Folder, docs []models.Document) *models.FolderTree {
+	root := &models.FolderTree{
+		Folders:   []*models.FolderTree{},
+		Documents: []models.Document{},
+	}
+
+	nodes := map[int]*models.FolderTree{0: root}
+	for _, folder := range folders {
+		nodes[folder.ID] = &models.FolderTree{
+			Folder:    folder,
+			Folders:   []*models.FolderTree{},
+			Documents: []models.Document{},
+		}
+	}
+
+	parentOf := func(id *int) *models.FolderTree {
+		if id == nil {
+			return root
+		}
+
+		if node, ok := nodes[*id]; ok {
+			return node
+		}
+
+		return root
+	}
+
+	for _, folder := range folders {
+		parent := parentOf(folder.ParentID)
+		parent.Folders = append(parent.Folders, nodes[folder.ID])
+	}
+
+	for _, doc := range docs {
+		parent := parentOf(doc.FolderID)
+		parent.Documents = append(parent.Documents, doc)
+	}
+
+	return root
+}
+
+func HandleCreateFolder(w http.ResponseWriter, r *http.Request) {
+	roomCode := r.URL.Query().Get("roomCode")
+
+	var req struct {
+		Name string `json:"name"`
+		// 0 or missing for the top of the room
+		ParentID int `json:"parentId"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "body must contain a name", http.StatusBadRequest)
+		return
+	}
+
+	folder, err := storage.CreateFolder(roomCode, html.EscapeString(req.Name), req.ParentID)
+	if !writeFolderError(w, err) {
+		return
+	}
+
+	room.BroadcastDocumentListUpdate(roomCode)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(folder)
+}
+
+// renames a folder and/or moves it to another parent or position
+func HandleUpdateFolder(w http.ResponseWriter, r *http.Request) {
+	roomCode := r.URL.Query().Get("roomCode")
+
+	folderId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "folder id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name *string `json:"name"`
+		// 0 moves the folder to the top of the room
+		ParentID *int `json:"parentId"`
+		Position *int `json:"position"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Name == nil && req.ParentID == nil && req.Position == nil) {
+		http.Error(w, "body must contain a name, parentId or position", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil {
+		if *req.Name == "" {
+			http.Error(w, "name must be non empty", http.StatusBadRequest)
+			return
+		}
+
+		err = storage.RenameFolder(roomCode, folderId, html.EscapeString(*req.Name))
+	}
+
+	if err == nil && (req.ParentID != nil || req.Position != nil) {
+		err = storage.MoveFolder(roomCode, folderId, req.ParentID, req.Position)
+	}
+
+	if !writeFolderError(w, err) {
+		return
+	}
+
+	room.BroadcastDocumentListUpdate(roomCode)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writes the response for errors of folder changes, returns true if there was none
+func writeFolderError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, storage.ErrFolderNotFound):
+		http.Error(w, "folder not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrFolderNameTaken):
+		http.Error(w, "a folder with this name already exists here", http.StatusConflict)
+	case errors.Is(err, storage.ErrFolderCycle):
+		http.Error(w, "a folder can not be moved into itself", http.StatusBadRequest)
+	default:
+		log.Printf("error changing folder: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+
+	return false
+}
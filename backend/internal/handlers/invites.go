@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend/internal/auth"
+	"backend/internal/models"
+	"backend/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultInviteExpiry = 7 * 24 * time.Hour
+	maxInviteExpiry     = 30 * 24 * time.Hour
+)
+
+func HandleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	username := auth.GetUsernameFromContext(r.Context())
+	roomCode := chi.URLParam(r, "id")
+
+	var req struct {
+		Role    string `json:"role"`
+		MaxUses *int   `json:"maxUses"`
+		// seconds until the invite expires
+		ExpiresIn int `json:"expiresIn"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = models.RoleEditor
+	}
+
+	if !auth.IsValidRole(req.Role) {
+		http.Error(w, "role must be owner, editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	// invites can be used once unless told otherwise, 0 means unlimited
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+
+	if maxUses < 0 {
+		http.Error(w, "maxUses can not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if req.ExpiresIn < 0 || req.ExpiresIn > int(maxInviteExpiry.Seconds()) {
+		http.Error(w, "expiresIn must be at most 30 days", http.StatusBadRequest)
+		return
+	}
+
+	expiry := defaultInviteExpiry
+	if req.ExpiresIn != 0 {
+		expiry = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	// postgres keeps microseconds, round so the token matches what is stored
+	expiresAt := time.Now().Add(expiry).Truncate(time.Second)
+
+	invite, err := storage.CreateInvite(roomCode, req.Role, maxUses, expiresAt, username)
+	if err != nil {
+		log.Printf("error creating invite to room %s: %v", roomCode, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	invite.Token = auth.SignInvite(invite.ID, invite.ExpiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+func HandleGetInvites(w http.ResponseWriter, r *http.Request) {
+	roomCode := chi.URLParam(r, "id")
+
+	invites, err := storage.GetInvites(roomCode)
+	if err != nil {
+		log.Printf("error getting invites of room %s: %v", roomCode, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range invites {
+		invites[i].Token = auth.SignInvite(invites[i].ID, invites[i].ExpiresAt)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invites": invites,
+	})
+}
+
+func HandleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	roomCode := chi.URLParam(r, "id")
+
+	inviteId, err := strconv.Atoi(chi.URLParam(r, "inviteId"))
+	if err != nil {
+		http.Error(w, "invite id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	err = storage.RevokeInvite(roomCode, inviteId)
+	if errors.Is(err, storage.ErrInviteNotFound) {
+		http.Error(w, "invite not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error revoking invite %d: %v", inviteId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adds the caller to the room of an invite
+func HandleRedeemInvite(w http.ResponseWriter, r *http.Request) {
+	username := auth.GetUsernameFromContext(r.Context())
+
+	inviteId, err := auth.VerifyInvite(chi.URLParam(r, "token"))
+	if err != nil {
+		http.Error(w, "invite is invalid or has expired", http.StatusNotFound)
+		return
+	}
+
+	roomCode, role, err := storage.RedeemInvite(inviteId, username)
+	switch {
+	case errors.Is(err, storage.ErrInviteNotFound), errors.Is(err, storage.ErrInviteExpired):
+		http.Error(w, "invite is invalid or has expired", http.StatusNotFound)
+		return
+	case errors.Is(err, storage.ErrInviteUsedUp):
+		http.Error(w, "invite has no uses left", http.StatusGone)
+		return
+	case err != nil:
+		log.Printf("error redeeming invite %d: %v", inviteId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	refreshMemberAccess(roomCode, username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"roomCode": roomCode,
+		"role":     role,
+	})
+}
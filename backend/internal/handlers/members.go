@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"backend/internal/auth"
+	"backend/internal/models"
+	"backend/internal/room"
+	"backend/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func HandleGetMembers(w http.ResponseWriter, r *http.Request) {
+	roomCode := chi.URLParam(r, "id")
+
+	members, err := storage.GetRoomMembers(roomCode)
+	if err != nil {
+		log.Printf("error getting members of room %s: %v", roomCode, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"members": members,
+	})
+}
+
+func HandleAddMember(w http.ResponseWriter, r *http.Request) {
+	roomCode := chi.URLParam(r, "id")
+
+	var req struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "body must contain a username", http.StatusBadRequest)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = models.RoleEditor
+	}
+
+	if !auth.IsValidRole(req.Role) {
+		http.Error(w, "role must be owner, editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	err := storage.AddRoomMember(roomCode, req.Username, req.Role)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, storage.ErrMemberExists) {
+		http.Error(w, "user is already a member of this room", http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error adding member to room %s: %v", roomCode, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	refreshMemberAccess(roomCode, req.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.RoomMember{
+		Username: req.Username,
+		Role:     req.Role,
+	})
+}
+
+func HandleUpdateMember(w http.ResponseWriter, r *http.Request) {
+	roomCode := chi.URLParam(r, "id")
+	username := chi.URLParam(r, "username")
+
+	var req struct {
+		Role string `json:"role"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !auth.IsValidRole(req.Role) {
+		http.Error(w, "role must be owner, editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	err := storage.UpdateRoomMemberRole(roomCode, username, req.Role)
+	if !writeMemberError(w, roomCode, err) {
+		return
+	}
+
+	refreshMemberAccess(roomCode, username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.RoomMember{
+		Username: username,
+		Role:     req.Role,
+	})
+}
+
+// removes a member from the room. owners can remove anyone, everyone else can only leave
+func HandleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	roomCode := chi.URLParam(r, "id")
+	username := chi.URLParam(r, "username")
+
+	if username != auth.GetUsernameFromContext(r.Context()) &&
+		!auth.HasRole(auth.GetRoomRoleFromContext(r.Context()), models.RoleOwner) {
+		http.Error(w, "owner role is required", http.StatusForbidden)
+		return
+	}
+
+	err := storage.RemoveRoomMember(roomCode, username)
+	if !writeMemberError(w, roomCode, err) {
+		return
+	}
+
+	refreshMemberAccess(roomCode, username)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writes the response for errors of member changes, returns true if there was none
+func writeMemberError(w http.ResponseWriter, roomCode string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, storage.ErrMemberNotFound):
+		http.Error(w, "user is not a member of this room", http.StatusNotFound)
+	case errors.Is(err, storage.ErrLastOwner):
+		http.Error(w, "room must keep at least one owner", http.StatusConflict)
+	default:
+		log.Printf("error changing member of room %s: %v", roomCode, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+
+	return false
+}
+
+// applies the current role of a user to their open connections, which are
+// closed if they can no longer see the room
+func refreshMemberAccess(roomCode string, username string) {
+	role, archived, err := storage.GetRoomRole(roomCode, username)
+	if err != nil {
+		log.Printf("error refreshing role of %s in room %s: %v", username, roomCode, err)
+		return
+	}
+
+	if archived && role != "" {
+		role = models.RoleViewer
+	}
+
+	room.SetUserRole(roomCode, username, role)
+}
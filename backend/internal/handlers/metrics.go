@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"backend/internal/room"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// reports how far behind the clients of this instance are and how many messages they missed.
+// room codes are left out since anyone can see this
+func HandleGetMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics, rooms := room.GetMetrics()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rooms int `json:"rooms"`
+		room.Metrics
+	}{rooms, metrics})
+}
+
+// same as HandleGetMetrics for a single room
+func HandleGetRoomMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room.GetRoomMetrics(chi.URLParam(r, "id")))
+}
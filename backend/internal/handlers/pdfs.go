@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -148,49 +149,48 @@ func HandleDeletePDF(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	repoUrl, err := getOrCreateUserPDFRepo(githubToken, username)
-	if err != nil {
-		log.Printf("error getting user PDF repo: %v", err)
-		http.Error(w, "failed to get GitHub repository", http.StatusInternalServerError)
+	if err := deletePDFFromGitHub(githubToken, username, roomCode, filename); err != nil {
+		log.Printf("error deleting file from GitHub: %v", err)
+		http.Error(w, "failed to delete file from GitHub", http.StatusInternalServerError)
+		return
+	}
+
+	if err := storage.DeletePDF(pdfId); err != nil {
+		log.Printf("error deleting pdf from database: %v", err)
+		http.Error(w, "failed to delete PDF from database", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "PDF deleted successfully",
+	})
+}
+
+// deletes a pdf from the repository of the user who uploaded it
+func deletePDFFromGitHub(githubToken, githubUsername, roomCode, filename string) error {
+	repoUrl, err := getOrCreateUserPDFRepo(githubToken, githubUsername)
+	if err != nil {
+		return fmt.Errorf("could not get repository: %w", err)
+	}
+
 	owner, repo, err := ghub.ParseRepoFromUrl(repoUrl)
 	if err != nil {
-		http.Error(w, "invalid repository URL", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("invalid repository url: %w", err)
 	}
 
 	filePath := roomCode + "/" + filename
 	fileInfo, err := ghub.GetFileInfo(githubToken, owner, repo, filePath)
 	if err != nil {
-		log.Printf("error getting file info from GitHub: %v", err)
-		http.Error(w, "failed to get file info from GitHub", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("could not get file info: %w", err)
 	}
 
 	sha, ok := fileInfo["sha"].(string)
 	if !ok {
-		http.Error(w, "failed to extract file SHA", http.StatusInternalServerError)
-		return
-	}
-
-	if err := ghub.DeleteFile(githubToken, owner, repo, filePath, sha); err != nil {
-		log.Printf("error deleting file from GitHub: %v", err)
-		http.Error(w, "failed to delete file from GitHub", http.StatusInternalServerError)
-		return
-	}
-
-	if err := storage.DeletePDF(pdfId); err != nil {
-		log.Printf("error deleting pdf from database: %v", err)
-		http.Error(w, "failed to delete PDF from database", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("could not get sha of %s", filePath)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "PDF deleted successfully",
-	})
+	return ghub.DeleteFile(githubToken, owner, repo, filePath, sha)
 }
 
 func getOrCreateUserPDFRepo(accessToken, githubUsername string) (string, error) {
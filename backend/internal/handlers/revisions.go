@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"backend/internal/auth"
+	"backend/internal/models"
+	"backend/internal/storage"
+	"backend/internal/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// parses the room code and document id shared by the revision endpoints
+func parseDocumentRequest(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	roomCode := r.URL.Query().Get("roomCode")
+	if roomCode == "" {
+		http.Error(w, "room code is required", http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	docId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "document id must be a number", http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	return roomCode, docId, true
+}
+
+func HandleGetRevisions(w http.ResponseWriter, r *http.Request) {
+	roomCode, docId, ok := parseDocumentRequest(w, r)
+	if !ok {
+		return
+	}
+
+	limit := r.URL.Query().Get("limit")
+	offset := r.URL.Query().Get("offset")
+
+	if limit == "" {
+		limit = "50"
+	}
+
+	if offset == "" {
+		offset = "0"
+	}
+
+	limitNum, err := strconv.Atoi(limit)
+	if err != nil {
+		http.Error(w, "limit must be a number", http.StatusBadRequest)
+		return
+	}
+
+	offsetNum, err := strconv.Atoi(offset)
+	if err != nil {
+		http.Error(w, "offset must be a number", http.StatusBadRequest)
+		return
+	}
+
+	revisions, hasMoreData, err := storage.GetRevisions(roomCode, docId, limitNum, offsetNum)
+	if err != nil {
+		log.Printf("error getting revisions of document %d: %v", docId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revisions":   revisions,
+		"hasMoreData": hasMoreData,
+	})
+}
+
+func HandleGetRevision(w http.ResponseWriter, r *http.Request) {
+	roomCode, docId, ok := parseDocumentRequest(w, r)
+	if !ok {
+		return
+	}
+
+	revision, err := strconv.Atoi(chi.URLParam(r, "revision"))
+	if err != nil {
+		http.Error(w, "revision must be a number", http.StatusBadRequest)
+		return
+	}
+
+	content, err := storage.GetContentAtRevision(roomCode, docId, revision)
+	if errors.Is(err, storage.ErrRevisionNotFound) {
+		http.Error(w, "revision not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error rebuilding revision %d of document %d: %v", revision, docId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revision": revision,
+		"content":  content,
+	})
+}
+
+// restores an old revision by committing the edits that turn the current content back into it,
+// so the restore itself becomes a new revision that connected clients receive like any other edit
+func HandleRestoreRevision(w http.ResponseWriter, r *http.Request) {
+	username := auth.GetUsernameFromContext(r.Context())
+
+	roomCode, docId, ok := parseDocumentRequest(w, r)
+	if !ok {
+		return
+	}
+
+	revision, err := strconv.Atoi(chi.URLParam(r, "revision"))
+	if err != nil {
+		http.Error(w, "revision must be a number", http.StatusBadRequest)
+		return
+	}
+
+	target, err := storage.GetContentAtRevision(roomCode, docId, revision)
+	if errors.Is(err, storage.ErrRevisionNotFound) {
+		http.Error(w, "revision not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error rebuilding revision %d of document %d: %v", revision, docId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	currentContent, currentRevision, err := storage.GetDocumentState(roomCode, docId)
+	if errors.Is(err, storage.ErrDocumentNotFound) {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error getting document %d: %v", docId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// connected clients receive the restore through the room like any other edit
+	event := models.RoomEvent{SessionId: "restore", Username: username}
+	newRevision := currentRevision
+
+	// both operations are made against the current revision. the insert lands where
+	// the delete starts, so transforming it against the delete leaves it in place
+	for _, op := range utils.DiffOperations(currentContent, target) {
+		op.Revision = currentRevision
+
+		_, rev, err := storage.CommitOperation(roomCode, docId, op, event)
+		if err != nil {
+			log.Printf("error restoring revision %d of document %d: %v", revision, docId, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		newRevision = rev
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revision": newRevision,
+	})
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"log"
@@ -9,21 +10,25 @@ import (
 	"strconv"
 	"time"
 
+	"backend/internal/auth"
 	"backend/internal/models"
 	"backend/internal/room"
 	"backend/internal/storage"
-	"backend/internal/utils"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
 )
 
 type RoomResponse struct {
-	Code   string `json:"code"`
-	Name   string `json:"name"`
-	Public bool   `json:"isPublic"`
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Public   bool   `json:"isPublic"`
+	Archived bool   `json:"isArchived"`
 }
 
 func HandleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	username := auth.GetUsernameFromContext(r.Context())
+
 	var req struct {
 		Name   string `json:"name"`
 		Public bool   `json:"isPublic"`
@@ -40,10 +45,9 @@ func HandleCreateRoom(w http.ResponseWriter, r *http.Request) {
 
 	req.Name = html.EscapeString(req.Name)
 
-	roomCode := utils.GenerateRoomCode()
-
-	err := storage.CreateRoom(roomCode, req.Name, req.Public)
+	roomCode, err := storage.CreateRoom(req.Name, req.Public, username)
 	if err != nil {
+		log.Printf("error creating room: %v", err)
 		http.Error(w, "Failed to create room", http.StatusInternalServerError)
 		return
 	}
@@ -103,10 +107,7 @@ func HandleGetRooms(w http.ResponseWriter, r *http.Request) {
 
 	roomsList := []models.RoomInfo{}
 	for _, dbRoom := range dbRooms {
-		activeUsers := 0
-		if rm := room.GetRoom(dbRoom.Code); rm != nil {
-			activeUsers = room.GetActiveUsers(rm)
-		}
+		activeUsers := room.GetActiveUsers(dbRoom.Code)
 
 		lastUpdated := "recently"
 		if time.Since(dbRoom.UpdatedAt) < time.Minute {
@@ -137,7 +138,7 @@ func HandleGetRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	roomName, isPublic, err := storage.GetRoom(roomCode)
+	dbRoom, err := storage.GetRoom(roomCode)
 	if err != nil {
 		http.Error(w, "room not found", http.StatusNotFound)
 		return
@@ -146,8 +147,133 @@ func HandleGetRoom(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	json.NewEncoder(w).Encode(RoomResponse{
-		Code:   roomCode,
-		Name:   roomName,
-		Public: isPublic,
+		Code:     roomCode,
+		Name:     dbRoom.Name,
+		Public:   dbRoom.Public,
+		Archived: dbRoom.Archived,
+	})
+}
+
+// renames a room, makes it public or private, or archives it
+func HandleUpdateRoom(w http.ResponseWriter, r *http.Request) {
+	roomCode := chi.URLParam(r, "id")
+
+	var req struct {
+		Name     *string `json:"name"`
+		Public   *bool   `json:"isPublic"`
+		Archived *bool   `json:"isArchived"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil {
+		if *req.Name == "" {
+			http.Error(w, "name must be non empty", http.StatusBadRequest)
+			return
+		}
+
+		escaped := html.EscapeString(*req.Name)
+		req.Name = &escaped
+	}
+
+	err := storage.UpdateRoom(roomCode, req.Name, req.Public, req.Archived)
+	if errors.Is(err, storage.ErrRoomNotFound) {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error updating room %s: %v", roomCode, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// who can see and edit the room may have changed
+	for _, username := range room.GetUsernames(roomCode) {
+		refreshMemberAccess(roomCode, username)
+	}
+
+	HandleGetRoom(w, r)
+}
+
+// deletes a room with all of its documents, members and pdfs
+func HandleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	roomCode := chi.URLParam(r, "id")
+
+	// pdfs are gone from the database once the room is, so get them first
+	pdfs, err := storage.GetPDFs(roomCode)
+	if err != nil {
+		log.Printf("error getting pdfs of room %s: %v", roomCode, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = storage.DeleteRoom(roomCode)
+	if errors.Is(err, storage.ErrRoomNotFound) {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error deleting room %s: %v", roomCode, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data, _ := json.Marshal(models.Message{
+		Type:     "roomDeleted",
+		RoomCode: roomCode,
 	})
+	room.CloseRoom(roomCode, data, websocket.CloseNormalClosure, "room deleted")
+
+	// the room is already gone, files that can not be deleted are only logged
+	for _, pdf := range pdfs {
+		uploadedBy, _ := pdf["uploaded_by"].(string)
+		filename, _ := pdf["filename"].(string)
+
+		_, githubToken, err := storage.GetGitHubUser(uploadedBy)
+		if err != nil || githubToken == "" {
+			log.Printf("could not delete %s of room %s from GitHub: %s has no linked account", filename, roomCode, uploadedBy)
+			continue
+		}
+
+		if err := deletePDFFromGitHub(githubToken, uploadedBy, roomCode, filename); err != nil {
+			log.Printf("could not delete %s of room %s from GitHub: %v", filename, roomCode, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// makes another member the owner of the room, the caller stays on as an editor
+func HandleTransferRoom(w http.ResponseWriter, r *http.Request) {
+	username := auth.GetUsernameFromContext(r.Context())
+	roomCode := chi.URLParam(r, "id")
+
+	var req struct {
+		Username string `json:"username"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "body must contain a username", http.StatusBadRequest)
+		return
+	}
+
+	if req.Username == username {
+		http.Error(w, "you already own this room", http.StatusBadRequest)
+		return
+	}
+
+	err := storage.TransferRoomOwnership(roomCode, username, req.Username)
+	if !writeMemberError(w, roomCode, err) {
+		return
+	}
+
+	refreshMemberAccess(roomCode, username)
+	refreshMemberAccess(roomCode, req.Username)
+
+	w.WriteHeader(http.StatusNoContent)
 }
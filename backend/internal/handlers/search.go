@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/internal/auth"
+	"backend/internal/storage"
+)
+
+// searches documents and pdfs in every room the caller can see, or in one room if roomCode is given
+func HandleSearch(w http.ResponseWriter, r *http.Request) {
+	username := auth.GetUsernameFromContext(r.Context())
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "search query is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := r.URL.Query().Get("limit")
+	offset := r.URL.Query().Get("offset")
+
+	if limit == "" {
+		limit = "20"
+	}
+
+	if offset == "" {
+		offset = "0"
+	}
+
+	limitNum, err := strconv.Atoi(limit)
+	if err != nil || limitNum < 1 || limitNum > 100 {
+		http.Error(w, "limit must be a number between 1 and 100", http.StatusBadRequest)
+		return
+	}
+
+	offsetNum, err := strconv.Atoi(offset)
+	if err != nil || offsetNum < 0 {
+		http.Error(w, "offset must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	results, hasMoreData, err := storage.Search(username, query, r.URL.Query().Get("roomCode"), limitNum, offsetNum)
+	if err != nil {
+		log.Printf("error searching for %q: %v", query, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":     results,
+		"hasMoreData": hasMoreData,
+	})
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"backend/internal/storage"
+)
+
+// reports how many documents have edits that are not in postgres yet, and how old the oldest one is
+func HandleGetSyncStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := storage.GetSyncStats()
+	if err != nil {
+		log.Printf("error getting sync stats: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -1,13 +1,17 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"backend/internal/auth"
 	"backend/internal/client"
+	"backend/internal/models"
 	"backend/internal/room"
 	"backend/internal/storage"
 	"backend/internal/utils"
@@ -15,8 +19,15 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// how long a connection that resumes a session waits for the session's old connection to go away
+const (
+	replaceTimeout      = 5 * time.Second
+	replacePollInterval = 50 * time.Millisecond
+)
+
 var (
 	upgrader = websocket.Upgrader{
+		Subprotocols: client.Protocols,
 		CheckOrigin: func(r *http.Request) bool {
 			// allow everything in dev
 			if os.Getenv("ENV") != "production" {
@@ -30,19 +41,38 @@ var (
 	}
 )
 
+// connects a client to a room. with a document id the connection is opened for that document
+// and subscribed to it right away, otherwise the client subscribes to documents with messages
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	roomCode := r.URL.Query().Get("roomCode")
+	roomCode := strings.TrimSpace(r.URL.Query().Get("roomCode"))
 	docIdString := r.URL.Query().Get("docId")
 
-	if roomCode == "" || docIdString == "" {
-		http.Error(w, "document id and room code are required", http.StatusBadRequest)
+	if roomCode == "" {
+		http.Error(w, "room code is required", http.StatusBadRequest)
 		return
 	}
 
-	roomCode = strings.TrimSpace(roomCode)
-	docId, err := strconv.Atoi(docIdString)
-	if err != nil {
-		http.Error(w, "document id must be a number", http.StatusBadRequest)
+	docId := 0
+	if docIdString != "" {
+		var err error
+		docId, err = strconv.Atoi(docIdString)
+		if err != nil || docId <= 0 {
+			http.Error(w, "document id must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// turned away before upgrading, so the client does not get messages it can not read
+	if client.UnsupportedProtocol(websocket.Subprotocols(r)) {
+		http.Error(w, "unsupported protocol version, supported versions: "+strings.Join(client.Protocols, ", "), http.StatusBadRequest)
+		return
+	}
+
+	// the role is only set once the room was found, so a mistyped room code never
+	// creates a room in memory
+	role := auth.GetRoomRoleFromContext(r.Context())
+	if role == "" {
+		http.Error(w, "room not found", http.StatusNotFound)
 		return
 	}
 
@@ -52,28 +82,102 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rm := room.GetOrCreateRoom(roomCode)
-	userId := utils.GenerateUserID()
+	username := auth.GetUsernameFromContext(r.Context())
+	sessionId, resuming := resumeSession(r.URL.Query().Get("resumeToken"), username, roomCode)
 
-	currentContent, err := storage.GetDocumentContent(roomCode, docId)
-	if err != nil {
-		log.Printf("error getting doc %d from storage: %v", docId, err)
+	c := client.CreateClient(sessionId, username, role, roomCode, docId, conn)
+
+	// the document must belong to the room. checked before joining, so a client that is
+	// turned away never shows up in the room
+	if docId != 0 {
+		if _, err := storage.GetDocument(roomCode, docId); err != nil {
+			rejectConnection(c, err)
+			return
+		}
 	}
 
-	c := client.CreateClient(userId, roomCode, docId, conn)
+	rm := room.GetOrCreateRoom(roomCode)
 
 	// add client to the room
 	room.AddClient(rm, c)
 
-	count := room.GetClientCount(rm, docId)
-
-	if err := client.SendInitialState(c, currentContent, count); err != nil {
-		log.Printf("error sending initial state: %v", err)
+	// a client that resumes its session is caught up on each of its documents once it sends
+	// a resume message for it
+	switch {
+	case docId == 0:
+		if err := client.SendConnected(c, role); err != nil {
+			log.Printf("error sending connected message: %v", err)
+		}
+	case !resuming:
+		if err := client.SubscribeDocument(c, rm, docId); err != nil {
+			room.RemoveClient(rm, c)
+			rejectConnection(c, err)
+			return
+		}
 	}
 
 	// read and write continuously
 	go client.WriteClient(c)
 	go client.ReadClient(c, rm)
 
-	room.BroadcastClientCount(rm, docId)
+	room.BroadcastPresence(roomCode)
+}
+
+// takes over the session of a resume token if it belongs to the same user and room and
+// ended recently. otherwise the client gets a new session
+func resumeSession(token string, username string, roomCode string) (string, bool) {
+	if token == "" {
+		return utils.GenerateSessionID(), false
+	}
+
+	sessionId, err := auth.VerifyResumeToken(token, username, roomCode)
+	if err != nil {
+		return utils.GenerateSessionID(), false
+	}
+
+	claimed, err := storage.ClaimResumable(sessionId)
+	if err != nil {
+		log.Printf("error resuming session %s: %v", sessionId, err)
+	}
+
+	// the session's old connection may still be open, e.g. half-open after a network change.
+	// it is closed, and the session can be claimed once it has left the room
+	if !claimed && err == nil && room.ReplaceSession(roomCode, sessionId) {
+		claimed, err = waitForSession(sessionId)
+		if err != nil {
+			log.Printf("error resuming session %s: %v", sessionId, err)
+		}
+	}
+
+	if !claimed {
+		return utils.GenerateSessionID(), false
+	}
+
+	return sessionId, true
+}
+
+// claims a session that was replaced once its old connection is gone, see resumeSession
+func waitForSession(sessionId string) (bool, error) {
+	deadline := time.Now().Add(replaceTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(replacePollInterval)
+
+		claimed, err := storage.ClaimResumable(sessionId)
+		if claimed || err != nil {
+			return claimed, err
+		}
+	}
+
+	return false, nil
+}
+
+// tells a client why it can not connect and closes its connection
+func rejectConnection(c *models.Client, err error) {
+	if errors.Is(err, storage.ErrDocumentNotFound) {
+		client.RejectClient(c, models.ErrorDocumentNotFound, "document not found", websocket.CloseNormalClosure)
+		return
+	}
+
+	log.Printf("error getting doc %d from storage: %v", c.DocId, err)
+	client.RejectClient(c, models.ErrorInternal, "could not load document", websocket.CloseInternalServerErr)
 }
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/internal/auth"
+	"backend/internal/client"
+	"backend/internal/room"
+	"backend/internal/storage"
+	"backend/internal/utils"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// connects a yjs client to a document, speaking the y-websocket sync and awareness protocol.
+// the document id is the last part of the path, as y-websocket puts the room name there
+func HandleYjsWebSocket(w http.ResponseWriter, r *http.Request) {
+	roomCode := strings.TrimSpace(r.URL.Query().Get("roomCode"))
+
+	if roomCode == "" {
+		http.Error(w, "room code is required", http.StatusBadRequest)
+		return
+	}
+
+	docId, err := strconv.Atoi(chi.URLParam(r, "docId"))
+	if err != nil || docId <= 0 {
+		http.Error(w, "document id must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	role := auth.GetRoomRoleFromContext(r.Context())
+	if role == "" {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	// yjs clients have no error messages, so a missing document is turned away before upgrading
+	if _, err := storage.GetDocument(roomCode, docId); err != nil {
+		if errors.Is(err, storage.ErrDocumentNotFound) {
+			http.Error(w, "document not found", http.StatusNotFound)
+			return
+		}
+
+		log.Printf("error getting doc %d from storage: %v", docId, err)
+		http.Error(w, "could not load document", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("error upgrading to websocket: %v", err)
+		return
+	}
+
+	username := auth.GetUsernameFromContext(r.Context())
+	c := client.CreateYjsClient(utils.GenerateSessionID(), username, role, roomCode, docId, conn)
+
+	rm := room.GetOrCreateRoom(roomCode)
+
+	if err := room.AddYjsClient(rm, c); err != nil {
+		log.Printf("error opening yjs document %d: %v", docId, err)
+		room.DisconnectClient(c, nil, websocket.CloseInternalServerErr, "could not load document")
+		return
+	}
+
+	// queued before the read loop starts, which closes the queue once the client is gone
+	if err := client.StartYjsSync(c); err != nil {
+		log.Printf("error sending sync step 1 for document %d: %v", docId, err)
+	}
+
+	// read and write continuously
+	go client.WriteClient(c)
+	go client.ReadYjsClient(c, rm)
+
+	room.BroadcastPresence(roomCode)
+}
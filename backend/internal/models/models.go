@@ -1,45 +1,245 @@
 package models
 
 import (
+	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
-	ID       string
+	// session id, unique per connection
+	ID string
+	// authenticated user, the same for all of their connections
+	Username string
+	// document the connection was opened for, 0 if it was opened for the whole room. messages
+	// that do not name a document are about it, and the connection is closed once it is deleted
 	DocId    int
 	RoomCode string
 	Conn     *websocket.Conn
 	SendChan chan []byte
 	Mu       sync.Mutex
+	// documents the client subscribed to, guarded by the room's mutex
+	Documents map[int]bool
+	// last known caret and selection on each subscribed document, guarded by the room's mutex
+	Cursors map[int]*Cursor
+	// role of the user in the room, guarded by the room's mutex
+	Role string
+	// set once a message could not be queued for the client, which is then disconnected
+	Lagging atomic.Bool
+	// speaks the y-websocket protocol and gets binary messages instead of json, see Room.YjsClients
+	Yjs bool
+	// awareness clients announced over a yjs connection and their last clock, used by its read loop only
+	Awareness map[uint64]uint64
 }
 
 type Message struct {
-	Type       string     `json:"type"`
+	Type string `json:"type"`
+	// chosen by the client for its own messages, error messages carry the id of the message they reject
+	ID         string     `json:"id,omitempty"`
 	Content    string     `json:"content,omitempty"`
 	UserID     string     `json:"userId,omitempty"`
+	Username   string     `json:"username,omitempty"`
+	Role       string     `json:"role,omitempty"`
 	Operation  *Operation `json:"operation,omitempty"`
 	Count      int        `json:"count,omitempty"`
 	RoomCode   string     `json:"roomCode,omitempty"`
 	DocumentId int        `json:"documentId,omitempty"`
 	Message    string     `json:"message,omitempty"`
+	// machine-readable reason of an error message, see the Error codes
+	Code     string  `json:"code,omitempty"`
+	Revision int     `json:"revision"`
+	Cursor   *Cursor `json:"cursor,omitempty"`
+	// cursors of everyone else on the document, by user id
+	Cursors  map[string]Cursor `json:"cursors,omitempty"`
+	Presence *Presence         `json:"presence,omitempty"`
+	// lets the client take over its session after reconnecting, sent with init
+	ResumeToken string `json:"resumeToken,omitempty"`
+	// operations the client missed, or made while it was disconnected
+	Operations []Operation `json:"operations,omitempty"`
 }
 
+// who is connected to a document and to its room
+type Presence struct {
+	Document []PresenceUser `json:"document"`
+	Room     []PresenceUser `json:"room"`
+}
+
+type PresenceUser struct {
+	Username string `json:"username"`
+	// number of open connections, e.g. browser tabs
+	Sessions int `json:"sessions"`
+}
+
+// units that operation positions and lengths can be expressed in
+const (
+	// utf-16 code units, same as javascript string indices. this is the default
+	UnitUTF16 = "utf16"
+	UnitRune  = "rune"
+	UnitByte  = "byte"
+)
+
 type Operation struct {
 	Type     string `json:"type"`
 	Position int    `json:"position"`
 	Text     string `json:"text,omitempty"`
 	Length   int    `json:"length,omitempty"`
+	// text removed by a delete, filled in by the server when it is applied so it can be undone
+	DeletedText string `json:"deletedText,omitempty"`
+	// unit of position and length, utf16 if empty
+	Unit string `json:"unit,omitempty"`
+	// revision of the document that the operation was made against
+	Revision int `json:"revision"`
+	// number the client gave the operation, increasing with every operation it sends to a
+	// document. a client that resumes its session uses it to resend operations without
+	// them being committed twice. not kept once committed
+	Seq int `json:"seq,omitempty"`
+	// parts of a compound operation, which walks over the whole document and changes several
+	// places of it at once. position and length are not used
+	Components []Component `json:"components,omitempty"`
+}
+
+// part of a compound operation: keeps, inserts or deletes text at the position the
+// components before it walked to. exactly one field is set
+type Component struct {
+	Retain int    `json:"retain,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Delete int    `json:"delete,omitempty"`
+}
+
+// caret and selection of a client, positions are in utf-16 code units
+type Cursor struct {
+	Position       int    `json:"position"`
+	SelectionStart int    `json:"selectionStart"`
+	SelectionEnd   int    `json:"selectionEnd"`
+	Name           string `json:"name,omitempty"`
+	Color          string `json:"color,omitempty"`
+	// revision of the document the positions refer to
+	Revision int `json:"revision"`
+}
+
+// codes of error messages sent to websocket clients
+const (
+	// the document does not exist or belongs to another room
+	ErrorDocumentNotFound = "documentNotFound"
+	// something went wrong on the server, connecting again may help
+	ErrorInternal = "internalError"
+	// the message is not json, or misses or has invalid fields for its type
+	ErrorInvalidMessage = "invalidMessage"
+	// the server does not know the type of the message
+	ErrorUnknownType = "unknownType"
+	// the user's role does not allow the message, e.g. a viewer sending an operation
+	ErrorForbidden = "forbidden"
+	// the operation could not be applied to the document, e.g. because it splits a character
+	ErrorInvalidOperation = "invalidOperation"
+	// the revision the message was made against is unknown or too old, the client gets a fresh init
+	ErrorStaleRevision = "staleRevision"
+	// the message is about a document the client is not subscribed to
+	ErrorNotSubscribed = "notSubscribed"
+	// the client is already subscribed to the document
+	ErrorAlreadySubscribed = "alreadySubscribed"
+)
+
+// roles a user can have in a room, each can do everything the ones after it can
+const (
+	// manages the room and its members
+	RoleOwner = "owner"
+	// edits documents, uploads pdfs and asks the ai
+	RoleEditor = "editor"
+	// only reads
+	RoleViewer = "viewer"
+)
+
+type RoomMember struct {
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// a link that lets whoever redeems it join a room
+type RoomInvite struct {
+	ID       int    `json:"id"`
+	RoomCode string `json:"roomCode"`
+	Role     string `json:"role"`
+	// how many times the invite can be redeemed, 0 if unlimited
+	MaxUses   int       `json:"maxUses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	Token     string    `json:"token,omitempty"`
+}
+
+// something that happened in a room. events are published through redis so that every
+// backend instance can pass them on to its own clients in the room
+type RoomEvent struct {
+	// message, operations, presence, role, close, replace, yjs or awareness
+	Type string `json:"type"`
+	// document whose clients get the event, 0 for everyone in the room
+	DocumentId int `json:"documentId,omitempty"`
+	// session that gets nothing, usually the one that caused the event
+	Except string `json:"except,omitempty"`
+	// sent to clients as is
+	Message json.RawMessage `json:"message,omitempty"`
+
+	// committed operations and the revision after the last of them
+	Operations []Operation `json:"operations,omitempty"`
+	Revision   int         `json:"revision"`
+	// session that committed the operations, or a label such as "ai" for edits made outside of one.
+	// for replace, the session whose connection is closed
+	SessionId string `json:"sessionId,omitempty"`
+	Username  string `json:"username,omitempty"`
+	// the session gets an ack instead of its own operations
+	Ack bool `json:"ack,omitempty"`
+	// send the operations to clients in one message, so they never show half of them
+	Atomic bool `json:"atomic,omitempty"`
+
+	// new role of Username, empty if they lost access to the room
+	Role string `json:"role,omitempty"`
+
+	// close code and reason for close events
+	CloseCode   int    `json:"closeCode,omitempty"`
+	CloseReason string `json:"closeReason,omitempty"`
+
+	// yjs update or awareness update for the yjs clients of the document
+	Update []byte `json:"update,omitempty"`
+}
+
+// a websocket connection to a room on any backend instance
+type Session struct {
+	Username string `json:"username"`
+	// documents the connection is subscribed to
+	Documents []int `json:"documents,omitempty"`
 }
 
 // represents room internally
 type Room struct {
-	Code         string
-	Clients      map[string]*Client
+	Code    string
+	Clients map[string]*Client
+	// clients of the yjs endpoint, each on one document. they are kept apart since they can
+	// not read the json messages everyone else gets
+	YjsClients map[string]*Client
+	// revision of the last operations delivered to clients of each document, to notice events
+	// that never arrived
+	Revisions    map[int]int
 	LastActivity time.Time
 	Mu           sync.RWMutex
+	// counts changes to the sessions of the room, so that they are saved to redis in order
+	// without holding Mu. PresenceMu is held while saving them
+	PresenceVersion int64
+	SavedPresence   int64
+	PresenceMu      sync.Mutex
+	// whether presence changed since it was last delivered, and whether it is being delivered,
+	// see schedulePresence. both are guarded by DeliveryMu
+	PresenceChanged    bool
+	DeliveringPresence bool
+	DeliveryMu         sync.Mutex
+	// messages that could not be queued because a client's queue was full
+	DroppedMessages atomic.Int64
+	// clients that were disconnected because they could not keep up
+	SlowClients atomic.Int64
 }
 
 type RoomInfo struct {
@@ -52,6 +252,49 @@ type RoomInfo struct {
 type Document struct {
 	ID    int    `json:"id"`
 	Title string `json:"title"`
+	// folder the document is in, nil if it is at the top of the room
+	FolderID *int `json:"folderId"`
+	// index of the document among the others in its folder
+	Position int `json:"position"`
+}
+
+type Folder struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// folder this one is in, nil if it is at the top of the room
+	ParentID *int `json:"parentId"`
+	// index of the folder among the others in its parent
+	Position int `json:"position"`
+}
+
+// a folder along with everything inside it. the top of a room is a folder with id 0
+type FolderTree struct {
+	Folder
+	Folders   []*FolderTree `json:"folders"`
+	Documents []Document    `json:"documents"`
+}
+
+// a document or pdf that matched a search
+type SearchResult struct {
+	// document or pdf
+	Type       string `json:"type"`
+	DocumentID int    `json:"documentId,omitempty"`
+	PdfID      int    `json:"pdfId,omitempty"`
+	// title of the document or filename of the pdf
+	Title    string `json:"title"`
+	RoomCode string `json:"roomCode"`
+	RoomName string `json:"roomName"`
+	// html-escaped excerpt with matches wrapped in <mark> tags
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+// a committed operation in the revision history of a document
+type DocumentRevision struct {
+	Revision  int       `json:"revision"`
+	Author    string    `json:"author"`
+	Operation Operation `json:"operation"`
+	CreatedAt time.Time `json:"createdAt"`
 }
 
 type AIRequest struct {
@@ -59,4 +302,5 @@ type AIRequest struct {
 	DocId          int    `json:"documentId"`
 	RoomCode       string `json:"roomCode"`
 	CursorPosition int    `json:"cursorPosition"`
+	Revision       int    `json:"revision"`
 }
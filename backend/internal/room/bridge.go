@@ -0,0 +1,477 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/storage"
+	"backend/internal/utils"
+	"backend/internal/yjs"
+
+	"github.com/gorilla/websocket"
+)
+
+// documents opened by yjs clients have two representations: the yjs update log and the content,
+// which everything else reads and edits with operations. the server keeps them the same text:
+// updates of yjs clients are committed as operations, and operations committed by anyone else
+// are made as the server's own yjs edits. both happen while holding the document's yjs lock,
+// and the log records which revision of the content its text matches. while another instance
+// holds the lock, updates and syncs wait in a queue of the document
+
+// name of the root text type that yjs clients edit, ydoc.getText("content")
+const YjsText = "content"
+
+// the server's copy of a yjs document, shared by the yjs clients of this instance that are on it
+type yjsDocument struct {
+	mu  sync.Mutex
+	doc *yjs.Doc
+	// log the copy was built from and how much of it was applied
+	logId   string
+	applied int
+	// yjs clients of this instance using it
+	clients int
+
+	// work waiting for the lock: updates of yjs clients in the order they arrived, and whether
+	// the log has to catch up with the content. guarded by queueMu
+	queueMu    sync.Mutex
+	queue      []queuedYjsUpdate
+	syncQueued bool
+	// a goroutine is working through the queue
+	working bool
+}
+
+type queuedYjsUpdate struct {
+	client *models.Client
+	update []byte
+}
+
+// how long to wait before trying to lock a document again when redis can not be reached
+const yjsLockRetryDelay = time.Second
+
+type yjsDocumentKey struct {
+	roomCode string
+	docId    int
+}
+
+var (
+	yjsDocuments   = make(map[yjsDocumentKey]*yjsDocument)
+	yjsDocumentsMu sync.Mutex
+)
+
+func acquireYjsDocument(roomCode string, docId int) *yjsDocument {
+	yjsDocumentsMu.Lock()
+	defer yjsDocumentsMu.Unlock()
+
+	key := yjsDocumentKey{roomCode, docId}
+	d, ok := yjsDocuments[key]
+	if !ok {
+		d = &yjsDocument{doc: yjs.NewDoc(newYjsClientID())}
+		yjsDocuments[key] = d
+	}
+
+	d.clients++
+	return d
+}
+
+// forgets the copy of a document once none of its yjs clients are left
+func releaseYjsDocument(roomCode string, docId int) {
+	yjsDocumentsMu.Lock()
+	defer yjsDocumentsMu.Unlock()
+
+	key := yjsDocumentKey{roomCode, docId}
+	d, ok := yjsDocuments[key]
+	if !ok {
+		return
+	}
+
+	d.clients--
+	if d.clients == 0 {
+		delete(yjsDocuments, key)
+		forgetAwareness(roomCode, docId)
+	}
+}
+
+// gets the copy of a document, nil if it has no yjs clients here
+func getYjsDocument(roomCode string, docId int) *yjsDocument {
+	yjsDocumentsMu.Lock()
+	defer yjsDocumentsMu.Unlock()
+
+	return yjsDocuments[yjsDocumentKey{roomCode, docId}]
+}
+
+// yjs picks random 32 bit client ids too. a copy that is built again gets a new one, so its
+// edits never reuse clocks of the old one
+func newYjsClientID() uint64 {
+	return uint64(rand.Uint32())
+}
+
+// reads the log of a document into the copy, and has it synced with the content once the lock
+// is free
+func (d *yjsDocument) open(roomCode string, docId int) error {
+	d.mu.Lock()
+	_, err := d.catchUp(roomCode, docId)
+	d.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	d.enqueue(roomCode, docId, nil)
+	return nil
+}
+
+// gets the state vector of the server's copy of a document, for asking a yjs client what it has
+func GetYjsStateVector(roomCode string, docId int) ([]byte, error) {
+	d := getYjsDocument(roomCode, docId)
+	if d == nil {
+		return nil, storage.ErrDocumentNotFound
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.catchUp(roomCode, docId); err != nil {
+		return nil, err
+	}
+
+	return d.doc.EncodeStateVector(), nil
+}
+
+// gets everything the server has of a document that a yjs client with given state vector misses
+func GetYjsDiff(roomCode string, docId int, stateVector []byte) ([]byte, error) {
+	sv, err := yjs.DecodeStateVector(stateVector)
+	if err != nil {
+		return nil, err
+	}
+
+	d := getYjsDocument(roomCode, docId)
+	if d == nil {
+		return nil, storage.ErrDocumentNotFound
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.catchUp(roomCode, docId); err != nil {
+		return nil, err
+	}
+
+	return d.doc.EncodeStateAsUpdate(sv), nil
+}
+
+// applies what was appended to the log since the copy last read it. a log that was loaded
+// again is read from its start into a new copy. caller must hold d.mu
+func (d *yjsDocument) catchUp(roomCode string, docId int) (storage.YjsLog, error) {
+	l, err := storage.GetYjsLog(roomCode, docId, d.logId, d.applied)
+	if err != nil {
+		return l, err
+	}
+
+	if l.ID != d.logId {
+		d.doc = yjs.NewDoc(newYjsClientID())
+		d.logId = l.ID
+	}
+
+	for _, update := range l.Updates {
+		if err := d.doc.ApplyUpdate(update); err != nil {
+			// it got into the log, so it was valid when it was appended
+			log.Printf("skipping yjs update of document %d: %v", docId, err)
+		}
+	}
+
+	d.applied = l.End()
+
+	return l, nil
+}
+
+// appends updates to the log along with the revision its text matches now, and sends them to
+// every yjs client on the document. a copy whose updates could not be appended is built again
+// from the log next time. caller must hold lock and d.mu
+func (d *yjsDocument) append(roomCode string, docId int, lock *storage.YjsLock, updates [][]byte, revision int, except string) error {
+	if err := storage.AppendYjsUpdates(roomCode, docId, lock, d.logId, updates, revision); err != nil {
+		d.logId = ""
+		return err
+	}
+
+	d.applied += len(updates)
+
+	for _, update := range updates {
+		publishYjs(roomCode, "yjs", docId, except, update)
+	}
+
+	return nil
+}
+
+// makes the server's own yjs edits that bring the text from the content at revision synced
+// (-1 if it is not known) to the current content. the operations committed since are made as
+// they are, or if they are no longer available, the difference between the texts is.
+// returns the updates and the revision the text matches now. caller must hold the lock and d.mu
+func (d *yjsDocument) followContent(roomCode string, docId int, synced int) ([][]byte, int, error) {
+	var updates [][]byte
+
+	if synced >= 0 {
+		ops, err := storage.GetOperationsSince(roomCode, docId, synced)
+		if err == nil {
+			update, err := d.doc.ApplyOperations(YjsText, ops)
+			if update != nil {
+				updates = append(updates, update)
+			}
+
+			if err == nil {
+				return updates, synced + len(ops), nil
+			}
+
+			log.Printf("could not apply operations to yjs document %d, comparing the texts instead: %v", docId, err)
+		}
+	}
+
+	content, revision, err := storage.GetDocumentState(roomCode, docId)
+	if err != nil {
+		return updates, synced, err
+	}
+
+	update, err := d.doc.ApplyOperations(YjsText, utils.DiffOperations(d.doc.Text(YjsText), content))
+	if update != nil {
+		updates = append(updates, update)
+	}
+
+	return updates, revision, err
+}
+
+// brings the log of a document up to date with its content. caller must hold lock and d.mu.
+// returns the revision the text matches
+func (d *yjsDocument) sync(roomCode string, docId int, lock *storage.YjsLock) (int, error) {
+	l, err := d.catchUp(roomCode, docId)
+	if err != nil {
+		return 0, err
+	}
+
+	updates, revision, err := d.followContent(roomCode, docId, l.Revision)
+	if err != nil {
+		d.logId = ""
+		return 0, err
+	}
+
+	if len(updates) == 0 && revision == l.Revision {
+		return revision, nil
+	}
+
+	return revision, d.append(roomCode, docId, lock, updates, revision, "")
+}
+
+// syncs a document with yjs clients here in the background once operations were committed to
+// it. operations committed while a sync waits are picked up by it
+func scheduleYjsSync(room *models.Room, docId int) {
+	if d := getYjsDocument(room.Code, docId); d != nil {
+		d.enqueue(room.Code, docId, nil)
+	}
+}
+
+// queues an update of a yjs client for its document, see applyUpdate. updates are applied in the
+// order they arrive, as soon as the document's lock is free. a client whose update can not be
+// applied is disconnected, and sends it again once it reconnects
+func ApplyYjsUpdate(room *models.Room, client *models.Client, update []byte) error {
+	d := getYjsDocument(room.Code, client.DocId)
+	if d == nil {
+		return storage.ErrDocumentNotFound
+	}
+
+	d.enqueue(room.Code, client.DocId, &queuedYjsUpdate{client, update})
+	return nil
+}
+
+// queues an update, or a sync if update is nil, and starts working through the queue unless
+// that already happens
+func (d *yjsDocument) enqueue(roomCode string, docId int, update *queuedYjsUpdate) {
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+
+	if update != nil {
+		d.queue = append(d.queue, *update)
+	} else {
+		d.syncQueued = true
+	}
+
+	if !d.working {
+		d.working = true
+		go d.work(roomCode, docId)
+	}
+}
+
+// works through the queue of a document while holding its lock, until the queue is empty.
+// a lock that was lost is taken again for the rest
+func (d *yjsDocument) work(roomCode string, docId int) {
+	for {
+		lock, err := storage.LockYjsDocument(roomCode, docId)
+		if err != nil {
+			log.Printf("could not lock yjs document %d: %v", docId, err)
+
+			if getYjsDocument(roomCode, docId) != d {
+				// its clients are gone, and with them the copy
+				d.queueMu.Lock()
+				d.queue, d.syncQueued, d.working = nil, false, false
+				d.queueMu.Unlock()
+				return
+			}
+
+			time.Sleep(yjsLockRetryDelay)
+			continue
+		}
+
+		done := d.drain(roomCode, docId, lock)
+		lock.Unlock()
+
+		if done {
+			return
+		}
+	}
+}
+
+// applies queued updates and syncs until the queue is empty, or returns false once the lock
+// was lost, with what is left queued again
+func (d *yjsDocument) drain(roomCode string, docId int, lock *storage.YjsLock) bool {
+	for {
+		d.queueMu.Lock()
+		queue, syncQueued := d.queue, d.syncQueued
+		d.queue, d.syncQueued = nil, false
+
+		if len(queue) == 0 && !syncQueued {
+			d.working = false
+			d.queueMu.Unlock()
+			return true
+		}
+		d.queueMu.Unlock()
+
+		d.mu.Lock()
+		left, err := d.process(roomCode, docId, lock, queue)
+		d.mu.Unlock()
+
+		if errors.Is(err, storage.ErrYjsLockLost) {
+			log.Printf("lost the lock of yjs document %d, taking it again", docId)
+
+			// the text may not match the content anymore
+			d.queueMu.Lock()
+			d.queue = append(left, d.queue...)
+			d.syncQueued = true
+			d.queueMu.Unlock()
+			return false
+		}
+	}
+}
+
+// applies updates, or only syncs if there are none. returns ErrYjsLockLost along with the
+// updates that still need applying if the lock was lost. caller must hold lock and d.mu
+func (d *yjsDocument) process(roomCode string, docId int, lock *storage.YjsLock, queue []queuedYjsUpdate) ([]queuedYjsUpdate, error) {
+	if len(queue) == 0 {
+		_, err := d.sync(roomCode, docId, lock)
+		if err != nil && !errors.Is(err, storage.ErrYjsLockLost) {
+			log.Printf("could not sync yjs document %d with its content: %v", docId, err)
+		}
+
+		return nil, err
+	}
+
+	for i, q := range queue {
+		appended, err := d.applyUpdate(roomCode, docId, lock, q.client, q.update)
+		if errors.Is(err, storage.ErrYjsLockLost) {
+			if appended {
+				return queue[i+1:], err
+			}
+
+			return queue[i:], err
+		}
+
+		if err != nil {
+			log.Printf("could not apply update of yjs client %s: %v\n", q.client.ID, err)
+			go DisconnectClient(q.client, nil, websocket.CloseInternalServerErr, "could not apply update")
+		}
+	}
+
+	return nil, nil
+}
+
+// applies an update of a yjs client to its document. the update goes to the log and the other
+// yjs clients, and the changes it made to the text are committed as operations against the
+// revision the text matched. anything committed in the meantime is then made as the server's
+// own yjs edits, transformed to apply on top of the update. reports whether the update got to
+// the log. caller must hold lock and d.mu
+func (d *yjsDocument) applyUpdate(roomCode string, docId int, lock *storage.YjsLock, client *models.Client, update []byte) (bool, error) {
+	// the content may have been edited since the last sync
+	synced, err := d.sync(roomCode, docId, lock)
+	if err != nil {
+		return false, err
+	}
+
+	ops, err := d.doc.ApplyTextUpdate(update, YjsText)
+	if err != nil {
+		return false, err
+	}
+
+	// until its operations are committed the text matches no revision, and if that never
+	// happens the next sync compares the texts
+	revision := synced
+	if len(ops) > 0 {
+		revision = -1
+	}
+
+	if err := d.append(roomCode, docId, lock, [][]byte{update}, revision, client.ID); err != nil {
+		return false, err
+	}
+
+	if len(ops) == 0 {
+		return true, nil
+	}
+
+	// everyone else gets the operations through the room, yjs clients already have them
+	event := models.RoomEvent{SessionId: client.ID, Username: client.Username}
+
+	// committing fills in the operations, they are needed as they are below
+	committed, revision, err := storage.CommitOperations(roomCode, docId, slices.Clone(ops), synced, event)
+	if err != nil {
+		// the content stays as it is, and the text is brought back to it
+		updates, current, syncErr := d.followContent(roomCode, docId, -1)
+		if syncErr == nil {
+			syncErr = d.append(roomCode, docId, lock, updates, current, "")
+		}
+
+		if syncErr != nil {
+			d.logId = ""
+			log.Printf("could not sync yjs document %d with its content: %v", docId, syncErr)
+		}
+
+		return true, fmt.Errorf("could not commit yjs update: %w", err)
+	}
+
+	// what was committed between the revision the text matched and the update
+	missedCount := revision - len(committed) - synced
+
+	var updates [][]byte
+	history, err := storage.GetOperationsSince(roomCode, docId, synced)
+	if err == nil && len(history) >= missedCount {
+		var correction []byte
+		correction, err = d.doc.ApplyOperations(YjsText, utils.TransformCommitted(history[:missedCount], ops))
+		if correction != nil {
+			updates = append(updates, correction)
+		}
+	}
+
+	if err != nil || len(history) < missedCount {
+		// the texts are compared instead
+		more, current, err := d.followContent(roomCode, docId, -1)
+		if err != nil {
+			d.logId = ""
+			return true, err
+		}
+
+		updates = append(updates, more...)
+		revision = current
+	}
+
+	return true, d.append(roomCode, docId, lock, updates, revision, "")
+}
@@ -2,84 +2,245 @@ package room
 
 import (
 	"encoding/json"
+	"log"
+	"maps"
 
 	"backend/internal/models"
+	"backend/internal/storage"
 )
 
-func BroadcastClientCount(room *models.Room, docId int) {
-	room.Mu.RLock()
-	defer room.Mu.RUnlock()
+// broadcasts go through redis so that clients connected to other instances get them too,
+// see handleEvent for how each instance delivers them
+func publish(roomCode string, event models.RoomEvent) {
+	if err := storage.PublishRoomEvent(roomCode, event); err != nil {
+		log.Printf("could not broadcast %s to room %s: %v", event.Type, roomCode, err)
+	}
+}
 
-	count := GetClientCount(room, docId)
+// lets everyone in the room know who is connected and how many users are on their document
+func BroadcastPresence(roomCode string) {
+	publish(roomCode, models.RoomEvent{Type: "presence"})
+}
+
+func BroadcastToOthers(roomCode string, authorId string, docId int, data []byte) {
+	// send update to everyone on the document except the author
+	publish(roomCode, models.RoomEvent{
+		Type:       "message",
+		DocumentId: docId,
+		Except:     authorId,
+		Message:    data,
+	})
+}
 
+func BroadcastToEveryone(roomCode string, docId int, data []byte) {
+	publish(roomCode, models.RoomEvent{
+		Type:       "message",
+		DocumentId: docId,
+		Message:    data,
+	})
+}
+
+func BroadcastDocumentListUpdate(roomCode string) {
 	msg := models.Message{
-		Type:  "clientCount",
-		Count: count,
+		Type: "documentListUpdate",
 	}
 
 	data, _ := json.Marshal(msg)
 
+	// document 0 reaches everyone in the room
+	BroadcastToEveryone(roomCode, 0, data)
+}
+
+// sends a message to the clients of this instance matching include
+func sendWhere(room *models.Room, include func(*models.Client) bool, data []byte) {
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
 	for _, client := range room.Clients {
-		if client.DocId == docId {
-			select {
-			case client.SendChan <- data:
-				// sent message
-			default:
-				// channel full, skip client
-			}
+		if include(client) {
+			send(room, client, data)
 		}
 	}
+}
+
+// queues a message for a client from its read loop, or before that started, see send. the read
+// loop must never block on the queue: a client that stops reading while it keeps sending would
+// leave it stuck for good, and with it the cleanup once the client is gone
+func SendToClient(client *models.Client, data []byte) {
+	room := GetRoom(client.RoomCode)
+	if room == nil {
+		return
+	}
 
+	send(room, client, data)
 }
 
-func BroadcastToOthers(room *models.Room, authorId string, docId int, data []byte) {
-	room.Mu.RLock()
-	defer room.Mu.RUnlock()
+// queues a message for a client. a client whose queue is full fell too far behind and would
+// silently miss the message, so it is disconnected and gets a fresh init once it connects again.
+// caller must hold the room's lock
+func send(room *models.Room, client *models.Client, data []byte) {
+	// it already missed a message, anything after that is of no use to it
+	if client.Lagging.Load() {
+		return
+	}
 
-	for id, client := range room.Clients {
-		// send update to everyone except the author
-		if id != authorId && client.DocId == docId {
-			select {
-			case client.SendChan <- data:
-				// message sent
-			default:
-				// channel full, skip client
-			}
+	select {
+	case client.SendChan <- data:
+		// sent
+	default:
+		room.DroppedMessages.Add(1)
+
+		if client.Lagging.CompareAndSwap(false, true) {
+			room.SlowClients.Add(1)
+			log.Printf("client %s in room %s fell behind, disconnecting it", client.ID, room.Code)
+			go closeSlowClient(client)
 		}
 	}
 }
 
-func BroadcastToEveryone(room *models.Room, docId int, data []byte) {
+// sends committed operations to the clients of this instance subscribed to their document, one
+// message per operation unless the event is atomic. the session that committed them gets an ack
+// with the new revision instead, if the event asks for one, and the session in Except gets nothing
+func deliverOperations(room *models.Room, event models.RoomEvent) {
+	if !trackRevision(room, event) {
+		log.Printf("operations of document %d in room %s were lost, resyncing its clients", event.DocumentId, room.Code)
+		go resyncDocument(room, event.DocumentId)
+		return
+	}
+
+	ShiftCursors(room, event.DocumentId, event.Operations)
+
+	messages, err := operationMessages(event)
+	if err != nil {
+		log.Printf("could not marshal operations: %v", err)
+		return
+	}
+
+	ack, _ := json.Marshal(models.Message{
+		Type:       "ack",
+		DocumentId: event.DocumentId,
+		Revision:   event.Revision,
+	})
+
 	room.Mu.RLock()
 	defer room.Mu.RUnlock()
 
 	for _, client := range room.Clients {
-		// send update to everyone
-		select {
-		case client.SendChan <- data:
-			// message sent
-		default:
-			// channel full, skip client
+		if !client.Documents[event.DocumentId] || client.ID == event.Except {
+			continue
+		}
+
+		if event.Ack && client.ID == event.SessionId {
+			send(room, client, ack)
+			continue
+		}
+
+		for _, data := range messages {
+			send(room, client, data)
 		}
 	}
 }
 
-func BroadcastDocumentListUpdate(rm *models.Room) {
-	msg := models.Message{
-		Type: "documentListUpdate",
+// notes the revision the operations of an event brought their document to. returns false if
+// operations before them were never delivered, e.g. because redis dropped their event while
+// this instance was reconnecting
+func trackRevision(room *models.Room, event models.RoomEvent) bool {
+	room.Mu.Lock()
+	defer room.Mu.Unlock()
+
+	last, known := room.Revisions[event.DocumentId]
+	room.Revisions[event.DocumentId] = max(last, event.Revision)
+
+	return !known || event.Revision-len(event.Operations) <= last
+}
+
+// remembers the revision a client got the document at, if none was delivered yet, so that
+// lost operations after it are noticed
+func TrackRevision(room *models.Room, docId int, revision int) {
+	room.Mu.Lock()
+	defer room.Mu.Unlock()
+
+	if _, known := room.Revisions[docId]; !known {
+		room.Revisions[docId] = revision
 	}
+}
 
-	data, _ := json.Marshal(msg)
+// checks whether events of documents with clients on this instance were lost while the
+// connection to redis was down, and resyncs their clients if so
+func checkRevisions() {
+	roomsMutex.RLock()
+	all := make([]*models.Room, 0, len(rooms))
+	for _, room := range rooms {
+		all = append(all, room)
+	}
+	roomsMutex.RUnlock()
+
+	for _, room := range all {
+		room.Mu.RLock()
+		revisions := maps.Clone(room.Revisions)
+		room.Mu.RUnlock()
+
+		for docId, last := range revisions {
+			_, revision, err := storage.GetDocumentState(room.Code, docId)
+			if err != nil {
+				log.Printf("could not check revision of document %d in room %s: %v", docId, room.Code, err)
+				continue
+			}
+
+			if revision == last {
+				continue
+			}
+
+			log.Printf("operations of document %d in room %s were lost, resyncing its clients", docId, room.Code)
+
+			room.Mu.Lock()
+			room.Revisions[docId] = max(room.Revisions[docId], revision)
+			room.Mu.Unlock()
+
+			go resyncDocument(room, docId)
+		}
+	}
+}
 
-	rm.Mu.RLock()
-	defer rm.Mu.RUnlock()
+// disconnects the clients on a document that missed some of its operations, like slow
+// clients. when they connect again they get the current document
+func resyncDocument(room *models.Room, docId int) {
+	disconnectWhere(room, func(client *models.Client) bool {
+		return !client.Yjs && client.Documents[docId]
+	}, nil, CloseResyncRequired, "resync required")
+}
 
-	for _, client := range rm.Clients {
-		select {
-		case client.SendChan <- data:
-			// sent
-		default:
-			// skip, channel full
+// builds the messages clients get for the operations of an event
+func operationMessages(event models.RoomEvent) ([][]byte, error) {
+	ops := event.Operations
+	if event.Atomic {
+		data, err := json.Marshal(models.Message{
+			Type:       "operations",
+			DocumentId: event.DocumentId,
+			Operations: ops,
+			UserID:     event.SessionId,
+			Username:   event.Username,
+			Revision:   event.Revision,
+		})
+		return [][]byte{data}, err
+	}
+
+	messages := make([][]byte, 0, len(ops))
+	for i := range ops {
+		data, err := json.Marshal(models.Message{
+			Type:       "operation",
+			DocumentId: event.DocumentId,
+			Operation:  &ops[i],
+			UserID:     event.SessionId,
+			Username:   event.Username,
+			Revision:   ops[i].Revision + 1,
+		})
+		if err != nil {
+			return nil, err
 		}
+
+		messages = append(messages, data)
 	}
+
+	return messages, nil
 }
@@ -0,0 +1,48 @@
+package room
+
+import (
+	"backend/internal/models"
+	"backend/internal/utils"
+)
+
+// stores the cursor of a client on a document, unless it unsubscribed from it in the meantime
+func SetCursor(room *models.Room, client *models.Client, docId int, cursor *models.Cursor) {
+	room.Mu.Lock()
+	defer room.Mu.Unlock()
+
+	if client.Documents[docId] {
+		client.Cursors[docId] = cursor
+	}
+}
+
+// gets the cursors of everyone on the document except the client with excludeId, by client id
+func GetCursors(room *models.Room, docId int, excludeId string) map[string]models.Cursor {
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
+	cursors := make(map[string]models.Cursor)
+	for id, client := range room.Clients {
+		if cursor := client.Cursors[docId]; id != excludeId && cursor != nil {
+			cursors[id] = *cursor
+		}
+	}
+
+	return cursors
+}
+
+// moves stored cursors on the document past committed operations, so they keep
+// pointing at the same text for clients that join later
+func ShiftCursors(room *models.Room, docId int, ops []models.Operation) {
+	room.Mu.Lock()
+	defer room.Mu.Unlock()
+
+	for _, client := range room.Clients {
+		cursor := client.Cursors[docId]
+		if cursor == nil {
+			continue
+		}
+
+		shifted := utils.TransformCursor(*cursor, ops)
+		client.Cursors[docId] = &shifted
+	}
+}
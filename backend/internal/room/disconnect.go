@@ -0,0 +1,170 @@
+package room
+
+import (
+	"sync"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// how long a client gets to receive its last message and close frame
+const closeWriteTimeout = time.Second
+
+// close code for clients that missed messages because they could not keep up. they should
+// connect again, which gets them the current state of the document
+const CloseResyncRequired = 4000
+
+// close code for a connection whose session was resumed by a newer connection, usually because
+// it was half-open and nobody noticed yet. the client should not reconnect with it
+const CloseSessionReplaced = 4001
+
+// sends a last message (if any) and a close frame to a client, then closes its connection.
+// its read loop notices and removes it from the room like any other disconnect. yjs clients
+// can not read the last message and only get the close frame
+func DisconnectClient(client *models.Client, final []byte, code int, reason string) {
+	client.Mu.Lock()
+	defer client.Mu.Unlock()
+
+	deadline := time.Now().Add(closeWriteTimeout)
+	client.Conn.SetWriteDeadline(deadline)
+
+	if final != nil && !client.Yjs {
+		client.Conn.WriteMessage(websocket.TextMessage, final)
+	}
+
+	client.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	client.Conn.Close()
+}
+
+// closes the connection of a client that missed messages. its writer may be stuck on
+// the connection, so the close frame is sent as a control message, which does not wait for it
+func closeSlowClient(client *models.Client) {
+	deadline := time.Now().Add(closeWriteTimeout)
+	client.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseResyncRequired, "resync required"), deadline)
+	client.Conn.Close()
+}
+
+// closes the connection of a session that is still connected on any instance, so a new
+// connection can resume it. returns false if the session is not connected
+func ReplaceSession(roomCode string, sessionId string) bool {
+	if _, ok := roomSessions(roomCode)[sessionId]; !ok {
+		return false
+	}
+
+	publish(roomCode, models.RoomEvent{Type: "replace", SessionId: sessionId})
+	return true
+}
+
+// closes the local connection of a replaced session. like closeSlowClient it does not wait
+// for the writer, which may be stuck on a half-open connection
+func closeReplacedSession(room *models.Room, sessionId string) {
+	room.Mu.RLock()
+	client := room.Clients[sessionId]
+	room.Mu.RUnlock()
+
+	if client == nil {
+		return
+	}
+
+	deadline := time.Now().Add(closeWriteTimeout)
+	client.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseSessionReplaced, "session resumed elsewhere"), deadline)
+	client.Conn.Close()
+}
+
+// closes a document on any instance, see DisconnectDocument
+func CloseDocument(roomCode string, docId int, final []byte, code int, reason string) {
+	publish(roomCode, models.RoomEvent{
+		Type:        "close",
+		DocumentId:  docId,
+		Message:     final,
+		CloseCode:   code,
+		CloseReason: reason,
+	})
+}
+
+// disconnects everyone in a room on any instance, which then forget the room. see DisconnectClient
+func CloseRoom(roomCode string, final []byte, code int, reason string) {
+	CloseDocument(roomCode, 0, final, code, reason)
+}
+
+// disconnects everyone who opened their connection for a document, see DisconnectClient. everyone
+// else subscribed to it is unsubscribed and gets the final message, if any
+func DisconnectDocument(room *models.Room, docId int, final []byte, code int, reason string) {
+	disconnectWhere(room, func(client *models.Client) bool {
+		return client.DocId == docId
+	}, final, code, reason)
+
+	room.Mu.Lock()
+	unsubscribed := false
+	for _, client := range room.Clients {
+		if client.DocId == docId || !removeSubscription(client, docId) {
+			continue
+		}
+
+		unsubscribed = true
+		if final != nil {
+			send(room, client, final)
+		}
+	}
+
+	var p presence
+	if unsubscribed {
+		p = takePresence(room)
+	}
+	room.Mu.Unlock()
+
+	if unsubscribed {
+		savePresence(room, p)
+		BroadcastPresence(room.Code)
+	}
+}
+
+// disconnects everyone in a room, see DisconnectClient
+func DisconnectRoom(room *models.Room, final []byte, code int, reason string) {
+	disconnectWhere(room, func(*models.Client) bool { return true }, final, code, reason)
+}
+
+// disconnects everyone in every room of this instance, one room at a time per goroutine so slow clients
+// in one room do not hold up the rest
+func DisconnectAll(final []byte, code int, reason string) {
+	roomsMutex.RLock()
+	all := make([]*models.Room, 0, len(rooms))
+	for _, room := range rooms {
+		all = append(all, room)
+	}
+	roomsMutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, room := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			DisconnectRoom(room, final, code, reason)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func disconnectWhere(room *models.Room, include func(*models.Client) bool, final []byte, code int, reason string) {
+	room.Mu.RLock()
+	var clients []*models.Client
+	for _, client := range room.Clients {
+		if include(client) {
+			clients = append(clients, client)
+		}
+	}
+
+	for _, client := range room.YjsClients {
+		if include(client) {
+			clients = append(clients, client)
+		}
+	}
+	room.Mu.RUnlock()
+
+	for _, client := range clients {
+		DisconnectClient(client, final, code, reason)
+	}
+}
@@ -0,0 +1,112 @@
+package room
+
+import (
+	"log"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/storage"
+)
+
+var (
+	unsubscribe   func()
+	heartbeatStop chan struct{}
+	heartbeatDone chan struct{}
+)
+
+// starts passing events of every room on to the clients of this instance, and keeps their
+// sessions known to the other instances. call StopListening on shutdown
+func StartListening() {
+	unsubscribe = storage.SubscribeRoomEvents(handleEvent, checkRevisions)
+
+	heartbeatStop = make(chan struct{})
+	heartbeatDone = make(chan struct{})
+
+	go func() {
+		defer close(heartbeatDone)
+
+		ticker := time.NewTicker(storage.PresenceRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				refreshPresence()
+			case <-heartbeatStop:
+				return
+			}
+		}
+	}()
+}
+
+func StopListening() {
+	if unsubscribe == nil {
+		return
+	}
+
+	close(heartbeatStop)
+	<-heartbeatDone
+	unsubscribe()
+	unsubscribe = nil
+}
+
+// saves the sessions of every room with clients on this instance again before they expire
+func refreshPresence() {
+	roomsMutex.RLock()
+	all := make([]*models.Room, 0, len(rooms))
+	for _, room := range rooms {
+		all = append(all, room)
+	}
+	roomsMutex.RUnlock()
+
+	for _, room := range all {
+		room.Mu.Lock()
+		active := len(room.Clients) > 0 || len(room.YjsClients) > 0
+		p := takePresence(room)
+		room.Mu.Unlock()
+
+		if active {
+			savePresence(room, p)
+		}
+	}
+}
+
+// delivers an event to the clients of this instance in the room. events are handled
+// one at a time, so anything slow such as closing connections happens in the background
+func handleEvent(roomCode string, event models.RoomEvent) {
+	room := GetRoom(roomCode)
+	if room == nil {
+		// no clients here
+		return
+	}
+
+	switch event.Type {
+	case "message":
+		sendWhere(room, func(client *models.Client) bool {
+			return client.ID != event.Except && (event.DocumentId == 0 || client.Documents[event.DocumentId])
+		}, event.Message)
+	case "operations":
+		deliverOperations(room, event)
+		scheduleYjsSync(room, event.DocumentId)
+	case "yjs", "awareness":
+		deliverYjs(room, event)
+	case "presence":
+		schedulePresence(room)
+	case "role":
+		go setLocalUserRole(room, event.Username, event.Role)
+	case "replace":
+		go closeReplacedSession(room, event.SessionId)
+	case "close":
+		go func() {
+			if event.DocumentId != 0 {
+				DisconnectDocument(room, event.DocumentId, event.Message, event.CloseCode, event.CloseReason)
+				return
+			}
+
+			DisconnectRoom(room, event.Message, event.CloseCode, event.CloseReason)
+			RemoveRoom(roomCode)
+		}()
+	default:
+		log.Printf("unknown event %q in room %s", event.Type, roomCode)
+	}
+}
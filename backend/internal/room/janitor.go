@@ -0,0 +1,85 @@
+package room
+
+import (
+	"log"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/storage"
+)
+
+var (
+	janitorStop chan struct{}
+	janitorDone chan struct{}
+)
+
+// periodically forgets rooms that had no clients for idleTimeout, after writing their
+// documents to postgres. call StopJanitor on shutdown
+func StartJanitor(idleTimeout time.Duration) {
+	janitorStop = make(chan struct{})
+	janitorDone = make(chan struct{})
+
+	go func() {
+		defer close(janitorDone)
+
+		// rooms are forgotten at most half a timeout late
+		ticker := time.NewTicker(idleTimeout / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				evictIdleRooms(idleTimeout)
+			case <-janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+func StopJanitor() {
+	if janitorStop == nil {
+		return
+	}
+
+	close(janitorStop)
+	<-janitorDone
+	janitorStop = nil
+}
+
+// caller must hold the room's lock
+func isIdle(room *models.Room, idleTimeout time.Duration) bool {
+	return len(room.Clients) == 0 && len(room.YjsClients) == 0 && time.Since(room.LastActivity) >= idleTimeout
+}
+
+func evictIdleRooms(idleTimeout time.Duration) {
+	roomsMutex.RLock()
+	var idle []*models.Room
+	for _, room := range rooms {
+		room.Mu.RLock()
+		if isIdle(room, idleTimeout) {
+			idle = append(idle, room)
+		}
+		room.Mu.RUnlock()
+	}
+	roomsMutex.RUnlock()
+
+	for _, room := range idle {
+		// a room whose documents could not be written is kept until the next round
+		if _, failed := storage.FlushRoomDocuments(room.Code); failed > 0 {
+			log.Printf("keeping idle room %s, %d documents could not be synced", room.Code, failed)
+			continue
+		}
+
+		// someone may have joined while the documents were written. joining marks the
+		// room as active while holding roomsMutex, so it can not happen in between
+		roomsMutex.Lock()
+		room.Mu.RLock()
+		if rooms[room.Code] == room && isIdle(room, idleTimeout) {
+			delete(rooms, room.Code)
+			log.Printf("Removed idle room: %s", room.Code)
+		}
+		room.Mu.RUnlock()
+		roomsMutex.Unlock()
+	}
+}
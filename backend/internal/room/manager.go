@@ -22,11 +22,18 @@ func GetOrCreateRoom(roomCode string) *models.Room {
 		room = &models.Room{
 			Code:         roomCode,
 			Clients:      make(map[string]*models.Client),
+			YjsClients:   make(map[string]*models.Client),
+			Revisions:    make(map[int]int),
 			LastActivity: time.Now(),
 		}
 
 		rooms[roomCode] = room
 		log.Printf("Created new room: %s", roomCode)
+	} else {
+		// keeps the janitor from removing the room before the caller adds its client
+		room.Mu.Lock()
+		room.LastActivity = time.Now()
+		room.Mu.Unlock()
 	}
 
 	return room
@@ -39,39 +46,41 @@ func GetRoom(roomCode string) *models.Room {
 	return rooms[roomCode]
 }
 
+// forgets a room, e.g. once it was deleted. clients still connected to it keep their
+// pointer to it until they disconnect
+func RemoveRoom(roomCode string) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	delete(rooms, roomCode)
+}
+
 func AddClient(room *models.Room, client *models.Client) {
 	room.Mu.Lock()
-	defer room.Mu.Unlock()
-
 	room.Clients[client.ID] = client
 	room.LastActivity = time.Now()
+	p := takePresence(room)
+	room.Mu.Unlock()
+
+	savePresence(room, p)
 }
 
 func RemoveClient(room *models.Room, client *models.Client) {
 	room.Mu.Lock()
-	defer room.Mu.Unlock()
-
 	delete(room.Clients, client.ID)
 	room.LastActivity = time.Now()
-}
+	p := takePresence(room)
+	room.Mu.Unlock()
 
-func GetClientCount(room *models.Room, docId int) int {
-	room.Mu.RLock()
-	defer room.Mu.RUnlock()
-
-	count := 0
-	for _, client := range room.Clients {
-		if client.DocId == docId {
-			count++
-		}
-	}
-
-	return count
+	savePresence(room, p)
 }
 
-func GetActiveUsers(room *models.Room) int {
-	room.Mu.RLock()
-	defer room.Mu.RUnlock()
+// counts the users connected to a document on any instance, someone with several tabs open counts once
+func GetClientCount(roomCode string, docId int) int {
+	return len(listUsers(roomSessions(roomCode), onDocument(docId)))
+}
 
-	return len(room.Clients)
+// counts the users connected to the room on any instance, someone with several tabs open counts once
+func GetActiveUsers(roomCode string) int {
+	return len(listUsers(roomSessions(roomCode), everyone))
 }
@@ -0,0 +1,84 @@
+package room
+
+import (
+	"encoding/json"
+
+	"backend/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// gets the role of a connected client
+func GetClientRole(room *models.Room, client *models.Client) string {
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
+	return client.Role
+}
+
+// lists the users with at least one connection to the room on any instance
+func GetUsernames(roomCode string) []string {
+	users := listUsers(roomSessions(roomCode), everyone)
+
+	usernames := make([]string, 0, len(users))
+	for _, user := range users {
+		usernames = append(usernames, user.Username)
+	}
+
+	return usernames
+}
+
+// applies a new role to every connection of a user on any instance and lets them know,
+// an empty role disconnects them
+func SetUserRole(roomCode string, username string, role string) {
+	publish(roomCode, models.RoomEvent{
+		Type:     "role",
+		Username: username,
+		Role:     role,
+	})
+}
+
+// applies a role to the connections of a user to this instance, see SetUserRole
+func setLocalUserRole(room *models.Room, username string, role string) {
+	data, _ := json.Marshal(models.Message{
+		Type: "role",
+		Role: role,
+	})
+
+	var removed []*models.Client
+
+	room.Mu.Lock()
+	for _, client := range room.Clients {
+		if client.Username != username {
+			continue
+		}
+
+		if role == "" {
+			removed = append(removed, client)
+			continue
+		}
+
+		client.Role = role
+
+		send(room, client, data)
+	}
+
+	// yjs clients are not told, viewers simply can not make changes anymore
+	for _, client := range room.YjsClients {
+		if client.Username != username {
+			continue
+		}
+
+		if role == "" {
+			removed = append(removed, client)
+			continue
+		}
+
+		client.Role = role
+	}
+	room.Mu.Unlock()
+
+	for _, client := range removed {
+		DisconnectClient(client, data, websocket.ClosePolicyViolation, "access to the room was revoked")
+	}
+}
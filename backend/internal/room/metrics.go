@@ -0,0 +1,66 @@
+package room
+
+import "backend/internal/models"
+
+// how well clients of this instance keep up with broadcasts
+type Metrics struct {
+	Clients int `json:"clients"`
+	// messages waiting to be written, over all clients and for the furthest behind one
+	QueuedMessages    int `json:"queuedMessages"`
+	MaxQueuedMessages int `json:"maxQueuedMessages"`
+	// since the room was loaded, see send
+	DroppedMessages int64 `json:"droppedMessages"`
+	SlowClients     int64 `json:"slowClients"`
+}
+
+func (m *Metrics) add(other Metrics) {
+	m.Clients += other.Clients
+	m.QueuedMessages += other.QueuedMessages
+	m.MaxQueuedMessages = max(m.MaxQueuedMessages, other.MaxQueuedMessages)
+	m.DroppedMessages += other.DroppedMessages
+	m.SlowClients += other.SlowClients
+}
+
+func roomMetrics(room *models.Room) Metrics {
+	m := Metrics{
+		DroppedMessages: room.DroppedMessages.Load(),
+		SlowClients:     room.SlowClients.Load(),
+	}
+
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
+	m.Clients = len(room.Clients) + len(room.YjsClients)
+	for _, clients := range []map[string]*models.Client{room.Clients, room.YjsClients} {
+		for _, client := range clients {
+			queued := len(client.SendChan)
+			m.QueuedMessages += queued
+			m.MaxQueuedMessages = max(m.MaxQueuedMessages, queued)
+		}
+	}
+
+	return m
+}
+
+// gets the metrics of a room on this instance, all zero if it has no clients here
+func GetRoomMetrics(roomCode string) Metrics {
+	room := GetRoom(roomCode)
+	if room == nil {
+		return Metrics{}
+	}
+
+	return roomMetrics(room)
+}
+
+// adds up the metrics of every room on this instance, returns them with the number of rooms
+func GetMetrics() (Metrics, int) {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
+	var total Metrics
+	for _, room := range rooms {
+		total.add(roomMetrics(room))
+	}
+
+	return total, len(rooms)
+}
@@ -0,0 +1,199 @@
+package room
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sort"
+
+	"backend/internal/models"
+	"backend/internal/storage"
+)
+
+// lists the users of sessions matching include along with how many connections they have,
+// sorted by username
+func listUsers(sessions map[string]models.Session, include func(models.Session) bool) []models.PresenceUser {
+	counts := make(map[string]int)
+	for _, session := range sessions {
+		if include(session) {
+			counts[session.Username]++
+		}
+	}
+
+	users := make([]models.PresenceUser, 0, len(counts))
+	for username, count := range counts {
+		users = append(users, models.PresenceUser{Username: username, Sessions: count})
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users
+}
+
+func everyone(models.Session) bool { return true }
+
+func onDocument(docId int) func(models.Session) bool {
+	return func(session models.Session) bool {
+		return slices.Contains(session.Documents, docId)
+	}
+}
+
+// sessions of the clients connected to this instance, by session id. caller must hold the room's lock
+func localSessions(room *models.Room) map[string]models.Session {
+	sessions := make(map[string]models.Session, len(room.Clients)+len(room.YjsClients))
+	for id, client := range room.Clients {
+		sessions[id] = models.Session{Username: client.Username, Documents: subscribedDocuments(client)}
+	}
+
+	for id, client := range room.YjsClients {
+		sessions[id] = models.Session{Username: client.Username, Documents: []int{client.DocId}}
+	}
+
+	return sessions
+}
+
+// sessions of a room on this instance at one point, see takePresence
+type presence struct {
+	version  int64
+	sessions map[string]models.Session
+}
+
+// takes the sessions of the room on this instance after a change to them. caller must hold the
+// room's lock for writing, and passes them to savePresence once it released it, so that the
+// room is not locked while waiting for redis
+func takePresence(room *models.Room) presence {
+	room.PresenceVersion++
+	return presence{version: room.PresenceVersion, sessions: localSessions(room)}
+}
+
+// shares the sessions of this instance with the others. sessions taken later may be saved
+// first, and then the older ones are not saved at all, so redis always ends up with the latest
+func savePresence(room *models.Room, p presence) {
+	room.PresenceMu.Lock()
+	defer room.PresenceMu.Unlock()
+
+	if p.version <= room.SavedPresence {
+		return
+	}
+
+	if err := storage.SetPresence(room.Code, p.sessions); err != nil {
+		log.Printf("could not save presence of room %s: %v", room.Code, err)
+		return
+	}
+
+	room.SavedPresence = p.version
+}
+
+// gets the sessions of the room on every instance, or only the ones of this
+// instance if redis can not be reached
+func roomSessions(roomCode string) map[string]models.Session {
+	sessions, err := storage.GetPresence(roomCode)
+	if err == nil {
+		return sessions
+	}
+
+	log.Printf("could not get presence of room %s: %v", roomCode, err)
+
+	room := GetRoom(roomCode)
+	if room == nil {
+		return nil
+	}
+
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
+	return localSessions(room)
+}
+
+// lists who is connected to the document and to the room
+func GetPresence(roomCode string, docId int) *models.Presence {
+	return getPresence(roomSessions(roomCode), docId)
+}
+
+func getPresence(sessions map[string]models.Session, docId int) *models.Presence {
+	return &models.Presence{
+		Document: listUsers(sessions, onDocument(docId)),
+		Room:     listUsers(sessions, everyone),
+	}
+}
+
+// delivers presence to the clients of the room in the background, so that events of other rooms
+// do not wait for redis. changes that come in while it is being delivered are delivered together
+// right after, so clients always end up with the latest presence
+func schedulePresence(room *models.Room) {
+	room.DeliveryMu.Lock()
+	defer room.DeliveryMu.Unlock()
+
+	room.PresenceChanged = true
+	if room.DeliveringPresence {
+		return
+	}
+
+	room.DeliveringPresence = true
+
+	go func() {
+		for {
+			room.DeliveryMu.Lock()
+			if !room.PresenceChanged {
+				room.DeliveringPresence = false
+				room.DeliveryMu.Unlock()
+				return
+			}
+
+			room.PresenceChanged = false
+			room.DeliveryMu.Unlock()
+
+			deliverPresence(room)
+		}
+	}()
+}
+
+// sends every client of this instance in the room who is on each of its documents and in the room,
+// and how many users are on each of its documents. clients without documents only get who is in the room
+func deliverPresence(room *models.Room) {
+	sessions := roomSessions(room.Code)
+
+	type update struct {
+		presence []byte
+		count    []byte
+	}
+
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
+	updates := make(map[int]update)
+
+	for _, client := range room.Clients {
+		docs := subscribedDocuments(client)
+		if len(docs) == 0 {
+			// document 0 has nobody on it
+			docs = []int{0}
+		}
+
+		for _, docId := range docs {
+			u, ok := updates[docId]
+			if !ok {
+				presence := getPresence(sessions, docId)
+
+				u.presence, _ = json.Marshal(models.Message{
+					Type:       "presence",
+					DocumentId: docId,
+					Presence:   presence,
+				})
+				u.count, _ = json.Marshal(models.Message{
+					Type:       "clientCount",
+					DocumentId: docId,
+					Count:      len(presence.Document),
+				})
+				updates[docId] = u
+			}
+
+			if docId != 0 {
+				send(room, client, u.count)
+			}
+			send(room, client, u.presence)
+		}
+	}
+}
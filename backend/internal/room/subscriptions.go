@@ -0,0 +1,81 @@
+package room
+
+import (
+	"sort"
+
+	"backend/internal/models"
+)
+
+// subscribes a client to a document, so it gets the document's operations, cursors and presence.
+// returns false if it already was
+func Subscribe(room *models.Room, client *models.Client, docId int) bool {
+	room.Mu.Lock()
+	if client.Documents[docId] {
+		room.Mu.Unlock()
+		return false
+	}
+
+	client.Documents[docId] = true
+	p := takePresence(room)
+	room.Mu.Unlock()
+
+	savePresence(room, p)
+
+	return true
+}
+
+// unsubscribes a client from a document and forgets its cursor there. returns false if it
+// was not subscribed
+func Unsubscribe(room *models.Room, client *models.Client, docId int) bool {
+	room.Mu.Lock()
+	if !removeSubscription(client, docId) {
+		room.Mu.Unlock()
+		return false
+	}
+
+	p := takePresence(room)
+	room.Mu.Unlock()
+
+	savePresence(room, p)
+
+	return true
+}
+
+// caller must hold the room's lock
+func removeSubscription(client *models.Client, docId int) bool {
+	if !client.Documents[docId] {
+		return false
+	}
+
+	delete(client.Documents, docId)
+	delete(client.Cursors, docId)
+
+	return true
+}
+
+func IsSubscribed(room *models.Room, client *models.Client, docId int) bool {
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
+	return client.Documents[docId]
+}
+
+// lists the documents a client is subscribed to
+func GetDocuments(room *models.Room, client *models.Client) []int {
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
+	return subscribedDocuments(client)
+}
+
+// documents of a client in ascending order. caller must hold the room's lock
+func subscribedDocuments(client *models.Client) []int {
+	docs := make([]int, 0, len(client.Documents))
+	for docId := range client.Documents {
+		docs = append(docs, docId)
+	}
+
+	sort.Ints(docs)
+
+	return docs
+}
@@ -0,0 +1,190 @@
+package room
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/yjs"
+)
+
+// yjs clients share updates and awareness through the room like every other broadcast. the
+// last awareness state of every yjs client on a document is kept for the ones that join later
+
+type awarenessKey struct {
+	roomCode string
+	docId    int
+}
+
+var (
+	awarenessStates   = make(map[awarenessKey]map[uint64]yjs.AwarenessState)
+	awarenessStatesMu sync.Mutex
+)
+
+// adds a client of the yjs endpoint to the room and reads the log of its document into the
+// server's copy, which is then brought up to date with the content. the client is removed again
+// if the log can not be read
+func AddYjsClient(room *models.Room, client *models.Client) error {
+	room.Mu.Lock()
+	room.YjsClients[client.ID] = client
+	room.LastActivity = time.Now()
+	p := takePresence(room)
+	room.Mu.Unlock()
+
+	savePresence(room, p)
+
+	d := acquireYjsDocument(room.Code, client.DocId)
+
+	// joined first, so that no update made in the meantime is missed
+	if err := d.open(room.Code, client.DocId); err != nil {
+		RemoveYjsClient(room, client)
+		return err
+	}
+
+	return nil
+}
+
+// removes a yjs client from the room and lets the others know its awareness states are gone
+func RemoveYjsClient(room *models.Room, client *models.Client) {
+	room.Mu.Lock()
+	delete(room.YjsClients, client.ID)
+	room.LastActivity = time.Now()
+	p := takePresence(room)
+	room.Mu.Unlock()
+
+	savePresence(room, p)
+
+	releaseYjsDocument(room.Code, client.DocId)
+
+	if len(client.Awareness) == 0 {
+		return
+	}
+
+	removed := make([]yjs.AwarenessState, 0, len(client.Awareness))
+	for id, clock := range client.Awareness {
+		removed = append(removed, yjs.AwarenessState{Client: id, Clock: clock + 1, State: "null"})
+	}
+
+	publishYjs(room.Code, "awareness", client.DocId, "", yjs.EncodeAwareness(removed))
+}
+
+// shares an awareness update of a yjs client with everyone else on its document, and remembers
+// which awareness clients it announced so they can be removed once it disconnects
+func UpdateAwareness(room *models.Room, client *models.Client, update []byte) error {
+	states, err := yjs.DecodeAwareness(update)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		if state.State == "null" {
+			delete(client.Awareness, state.Client)
+			continue
+		}
+
+		client.Awareness[state.Client] = state.Clock
+	}
+
+	publishYjs(room.Code, "awareness", client.DocId, client.ID, update)
+
+	return nil
+}
+
+// gets the awareness update with the states of everyone on a document, nil if there are none
+func GetAwareness(roomCode string, docId int) []byte {
+	awarenessStatesMu.Lock()
+	defer awarenessStatesMu.Unlock()
+
+	states := awarenessStates[awarenessKey{roomCode, docId}]
+	if len(states) == 0 {
+		return nil
+	}
+
+	all := make([]yjs.AwarenessState, 0, len(states))
+	for _, state := range states {
+		all = append(all, state)
+	}
+
+	return yjs.EncodeAwareness(all)
+}
+
+func publishYjs(roomCode string, eventType string, docId int, except string, update []byte) {
+	publish(roomCode, models.RoomEvent{
+		Type:       eventType,
+		DocumentId: docId,
+		Except:     except,
+		Update:     update,
+	})
+}
+
+// sends a yjs or awareness update to the yjs clients of this instance on its document
+func deliverYjs(room *models.Room, event models.RoomEvent) {
+	var data []byte
+
+	switch event.Type {
+	case "yjs":
+		data = yjs.UpdateMessage(event.Update)
+	case "awareness":
+		if err := rememberAwareness(room.Code, event.DocumentId, event.Update); err != nil {
+			log.Printf("invalid awareness update in room %s: %v", room.Code, err)
+			return
+		}
+
+		data = yjs.AwarenessMessage(event.Update)
+	}
+
+	room.Mu.RLock()
+	defer room.Mu.RUnlock()
+
+	for _, client := range room.YjsClients {
+		if client.DocId == event.DocumentId && client.ID != event.Except {
+			send(room, client, data)
+		}
+	}
+}
+
+// keeps the latest awareness state of each client on a document, if it has yjs clients here
+func rememberAwareness(roomCode string, docId int, update []byte) error {
+	states, err := yjs.DecodeAwareness(update)
+	if err != nil {
+		return fmt.Errorf("could not decode awareness update: %w", err)
+	}
+
+	if getYjsDocument(roomCode, docId) == nil {
+		return nil
+	}
+
+	awarenessStatesMu.Lock()
+	defer awarenessStatesMu.Unlock()
+
+	key := awarenessKey{roomCode, docId}
+	known, ok := awarenessStates[key]
+	if !ok {
+		known = make(map[uint64]yjs.AwarenessState)
+		awarenessStates[key] = known
+	}
+
+	for _, state := range states {
+		if current, ok := known[state.Client]; ok && current.Clock > state.Clock {
+			continue
+		}
+
+		if state.State == "null" {
+			delete(known, state.Client)
+			continue
+		}
+
+		known[state.Client] = state
+	}
+
+	return nil
+}
+
+func forgetAwareness(roomCode string, docId int) {
+	awarenessStatesMu.Lock()
+	defer awarenessStatesMu.Unlock()
+
+	delete(awarenessStates, awarenessKey{roomCode, docId})
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrDocumentNotFound   = errors.New("document not found")
+	ErrDocumentTitleTaken = errors.New("a document with this title already exists in the room")
+)
+
+func GetDocument(roomCode string, documentId int) (models.Document, error) {
+	var doc models.Document
+	var folderId sql.NullInt64
+	err := db.QueryRow(
+		`SELECT id, title, folder_id, position FROM documents WHERE id = $1 AND room_code = $2`,
+		documentId,
+		roomCode,
+	).Scan(&doc.ID, &doc.Title, &folderId, &doc.Position)
+
+	if err == sql.ErrNoRows {
+		return models.Document{}, ErrDocumentNotFound
+	}
+
+	if err != nil {
+		return models.Document{}, err
+	}
+
+	doc.FolderID = nullableId(folderId)
+	return doc, nil
+}
+
+func RenameDocument(roomCode string, documentId int, title string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE documents SET title = $1 WHERE id = $2 AND room_code = $3`,
+		title,
+		documentId,
+		roomCode,
+	)
+
+	if isPostgresError(err, uniqueViolation) {
+		return ErrDocumentTitleTaken
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDocumentNotFound
+	}
+
+	if err := touchRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// moves a document into a folder (0 for the top of the room, nil to keep its folder) and to given
+// index among the documents there (nil for the end), shifting the others
+func MoveDocument(roomCode string, documentId int, folderId *int, position *int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// moves within a room are done one at a time so positions can not interleave
+	if err := lockRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	var currentFolder sql.NullInt64
+	err = tx.QueryRow(
+		`SELECT folder_id FROM documents WHERE id = $1 AND room_code = $2`,
+		documentId,
+		roomCode,
+	).Scan(&currentFolder)
+
+	if err == sql.ErrNoRows {
+		return ErrDocumentNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	folder := currentFolder
+	if folderId != nil {
+		folder, err = folderInRoom(tx, roomCode, *folderId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE documents SET folder_id = $1 WHERE id = $2`, folder, documentId); err != nil {
+		return fmt.Errorf("could not move document %d: %w", documentId, err)
+	}
+
+	siblings, err := queryIds(
+		tx,
+		`SELECT id FROM documents WHERE room_code = $1 AND folder_id IS NOT DISTINCT FROM $2 AND id <> $3
+		 ORDER BY position ASC, created_at ASC`,
+		roomCode,
+		folder,
+		documentId,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := placeAt(tx, "documents", siblings, documentId, position); err != nil {
+		return err
+	}
+
+	if err := touchRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deletes a document along with its history and everything cached about it
+func DeleteDocument(roomCode string, documentId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM documents WHERE id = $1 AND room_code = $2`, documentId, roomCode)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDocumentNotFound
+	}
+
+	if err := touchRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return clearDocumentCache(roomCode, documentId)
+}
+
+// copies the current content of a document into a new one at the end of the room
+func DuplicateDocument(roomCode string, documentId int, title string) (int, error) {
+	content, err := GetDocumentContent(roomCode, documentId)
+	if err != nil {
+		return -1, err
+	}
+
+	return CreateDocument(roomCode, title, content)
+}
+
+// removes the content, revision, history and undo stacks of a document from redis
+func clearDocumentCache(roomCode string, documentId int) error {
+	iter := redisClient.Scan(ctx, 0, documentKey(roomCode, documentId, "*"), 100).Iterator()
+
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("could not find cached keys of document %d: %w", documentId, err)
+	}
+
+	pipe := redisClient.TxPipeline()
+	if len(keys) > 0 {
+		pipe.Del(ctx, keys...)
+	}
+	pipe.ZRem(ctx, dirtyDocumentsKey, dirtyDocumentMember(roomCode, documentId))
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("could not clear cache of document %d: %w", documentId, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"backend/internal/utils"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// every room has a channel, e.g. room:{roomCode}
+	roomChannelPrefix = "room:"
+
+	// how often instances should set their sessions again, see SetPresence
+	PresenceRefreshInterval = 10 * time.Second
+	// sessions of an instance are forgotten if it stops refreshing them, e.g. because it crashed
+	presenceTTL = 3 * PresenceRefreshInterval
+)
+
+// identifies this backend instance among the others sharing redis
+var instanceId = utils.GenerateSessionID()
+
+// removes instances from the presence set of a room unless they set their sessions again
+// in the meantime. arguments alternate between instance ids and their presence keys
+var forgetInstancesScript = redis.NewScript(`
+for i = 1, #ARGV, 2 do
+	if redis.call('EXISTS', ARGV[i + 1]) == 0 then
+		redis.call('SREM', KEYS[1], ARGV[i])
+	end
+end
+return 1
+`)
+
+func roomChannel(roomCode string) string {
+	return roomChannelPrefix + roomCode
+}
+
+// sends an event to every instance with clients in the room, this one included
+func PublishRoomEvent(roomCode string, event models.RoomEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal room event: %w", err)
+	}
+
+	if err := redisClient.Publish(ctx, roomChannel(roomCode), data).Err(); err != nil {
+		return fmt.Errorf("could not publish room event: %w", err)
+	}
+
+	return nil
+}
+
+// calls handle with every event published to any room, one at a time and in the order
+// redis received them, until the returned function is called. events published while the
+// connection to redis was down are lost, so resubscribed is called (in between events) after
+// it came back
+func SubscribeRoomEvents(handle func(roomCode string, event models.RoomEvent), resubscribed func()) func() {
+	pubsub := redisClient.PSubscribe(ctx, roomChannelPrefix+"*")
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		subscribed := false
+		for received := range pubsub.ChannelWithSubscriptions() {
+			msg, ok := received.(*redis.Message)
+			if !ok {
+				// the first subscription is the one made above, any later one a reconnect
+				if subscribed {
+					resubscribed()
+				}
+
+				subscribed = true
+				continue
+			}
+
+			var event models.RoomEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("could not read event of %s: %v", msg.Channel, err)
+				continue
+			}
+
+			handle(strings.TrimPrefix(msg.Channel, roomChannelPrefix), event)
+		}
+	}()
+
+	return func() {
+		pubsub.Close()
+		<-done
+	}
+}
+
+// every instance keeps the sessions it has in a room in a hash, e.g. presence:{roomCode}:{instanceId},
+// and adds itself to the set presence:{roomCode} so others can find it
+func presenceKey(roomCode string) string {
+	return "presence:" + roomCode
+}
+
+func instancePresenceKey(roomCode string, instance string) string {
+	return presenceKey(roomCode) + ":" + instance
+}
+
+// replaces the sessions this instance has in a room, by session id. they expire unless
+// they are set again within presenceTTL
+func SetPresence(roomCode string, sessions map[string]models.Session) error {
+	key := instancePresenceKey(roomCode, instanceId)
+
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, key)
+
+	if len(sessions) == 0 {
+		pipe.SRem(ctx, presenceKey(roomCode), instanceId)
+	} else {
+		fields := make([]interface{}, 0, 2*len(sessions))
+		for id, session := range sessions {
+			entry, err := json.Marshal(session)
+			if err != nil {
+				return fmt.Errorf("could not marshal session: %w", err)
+			}
+
+			fields = append(fields, id, entry)
+		}
+
+		pipe.HSet(ctx, key, fields...)
+		pipe.Expire(ctx, key, presenceTTL)
+		pipe.SAdd(ctx, presenceKey(roomCode), instanceId)
+		pipe.Expire(ctx, presenceKey(roomCode), presenceTTL)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("could not set presence: %w", err)
+	}
+
+	return nil
+}
+
+// gets the sessions every instance has in a room, by session id
+func GetPresence(roomCode string) (map[string]models.Session, error) {
+	instances, err := redisClient.SMembers(ctx, presenceKey(roomCode)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not get instances: %w", err)
+	}
+
+	pipe := redisClient.Pipeline()
+	results := make([]*redis.MapStringStringCmd, len(instances))
+	for i, instance := range instances {
+		results[i] = pipe.HGetAll(ctx, instancePresenceKey(roomCode, instance))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("could not get presence: %w", err)
+	}
+
+	sessions := make(map[string]models.Session)
+	var gone []interface{}
+
+	for i, result := range results {
+		entries := result.Val()
+
+		// the instance stopped refreshing its sessions
+		if len(entries) == 0 {
+			gone = append(gone, instances[i], instancePresenceKey(roomCode, instances[i]))
+			continue
+		}
+
+		for id, entry := range entries {
+			var session models.Session
+			if err := json.Unmarshal([]byte(entry), &session); err != nil {
+				log.Printf("could not read session %s: %v", id, err)
+				continue
+			}
+
+			sessions[id] = session
+		}
+	}
+
+	if len(gone) > 0 {
+		if err := forgetInstancesScript.Run(ctx, redisClient, []string{presenceKey(roomCode)}, gone...).Err(); err != nil {
+			log.Printf("could not forget instances of room %s: %v", roomCode, err)
+		}
+	}
+
+	return sessions, nil
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var (
+	ErrFolderNotFound  = errors.New("folder not found")
+	ErrFolderNameTaken = errors.New("a folder with this name already exists here")
+	ErrFolderCycle     = errors.New("a folder can not be moved into itself")
+)
+
+func nullableId(id sql.NullInt64) *int {
+	if !id.Valid {
+		return nil
+	}
+
+	value := int(id.Int64)
+	return &value
+}
+
+// checks that a folder belongs to a room. folder 0 is the top of the room and gives a null id
+func folderInRoom(tx *sql.Tx, roomCode string, folderId int) (sql.NullInt64, error) {
+	if folderId == 0 {
+		return sql.NullInt64{}, nil
+	}
+
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM folders WHERE id = $1 AND room_code = $2`, folderId, roomCode).Scan(&id)
+	if err == sql.ErrNoRows {
+		return sql.NullInt64{}, ErrFolderNotFound
+	}
+
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+
+	return sql.NullInt64{Int64: id, Valid: true}, nil
+}
+
+func queryIds(tx *sql.Tx, query string, args ...any) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// puts id at given index among its siblings (at the end if position is nil) and renumbers them all.
+// table is either documents or folders
+func placeAt(tx *sql.Tx, table string, siblings []int, id int, position *int) error {
+	index := len(siblings)
+	if position != nil {
+		index = max(0, min(*position, len(siblings)))
+	}
+
+	ids := append(siblings[:index:index], append([]int{id}, siblings[index:]...)...)
+
+	for i, id := range ids {
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET position = $1 WHERE id = $2`, table), i, id); err != nil {
+			return fmt.Errorf("could not move %d in %s: %w", id, table, err)
+		}
+	}
+
+	return nil
+}
+
+// gets all folders of a room, ordered by position within their parent
+func GetFolders(roomCode string) ([]models.Folder, error) {
+	rows, err := db.Query(
+		`SELECT id, name, parent_id, position FROM folders WHERE room_code = $1 ORDER BY position ASC, created_at ASC`,
+		roomCode,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	folders := []models.Folder{}
+
+	for rows.Next() {
+		var folder models.Folder
+		var parentId sql.NullInt64
+
+		if err := rows.Scan(&folder.ID, &folder.Name, &parentId, &folder.Position); err != nil {
+			log.Println("error reading folder")
+			continue
+		}
+
+		folder.ParentID = nullableId(parentId)
+		folders = append(folders, folder)
+	}
+
+	return folders, rows.Err()
+}
+
+// creates a folder at the end of its parent, 0 for the top of the room
+func CreateFolder(roomCode string, name string, parentId int) (models.Folder, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return models.Folder{}, fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockRoom(tx, roomCode); err != nil {
+		return models.Folder{}, err
+	}
+
+	parent, err := folderInRoom(tx, roomCode, parentId)
+	if err != nil {
+		return models.Folder{}, err
+	}
+
+	folder := models.Folder{
+		Name:     name,
+		ParentID: nullableId(parent),
+	}
+
+	err = tx.QueryRow(
+		`INSERT INTO folders (room_code, parent_id, name, position)
+		 VALUES ($1, $2, $3, (SELECT COALESCE(MAX(position) + 1, 0) FROM folders WHERE room_code = $1 AND parent_id IS NOT DISTINCT FROM $2))
+		 RETURNING id, position`,
+		roomCode,
+		parent,
+		name,
+	).Scan(&folder.ID, &folder.Position)
+
+	if isPostgresError(err, uniqueViolation) {
+		return models.Folder{}, ErrFolderNameTaken
+	}
+
+	if err != nil {
+		return models.Folder{}, fmt.Errorf("error inserting folder: %w", err)
+	}
+
+	if err := touchRoom(tx, roomCode); err != nil {
+		return models.Folder{}, err
+	}
+
+	return folder, tx.Commit()
+}
+
+func RenameFolder(roomCode string, folderId int, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE folders SET name = $1 WHERE id = $2 AND room_code = $3`,
+		name,
+		folderId,
+		roomCode,
+	)
+
+	if isPostgresError(err, uniqueViolation) {
+		return ErrFolderNameTaken
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrFolderNotFound
+	}
+
+	if err := touchRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// moves a folder with everything inside it into another folder (0 for the top of the room, nil to keep
+// its parent) and to given index among the folders there (nil for the end), shifting the others
+func MoveFolder(roomCode string, folderId int, parentId *int, position *int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	var currentParent sql.NullInt64
+	err = tx.QueryRow(
+		`SELECT parent_id FROM folders WHERE id = $1 AND room_code = $2`,
+		folderId,
+		roomCode,
+	).Scan(&currentParent)
+
+	if err == sql.ErrNoRows {
+		return ErrFolderNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	parent := currentParent
+	if parentId != nil {
+		parent, err = folderInRoom(tx, roomCode, *parentId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if parent.Valid {
+		// the new parent can not be the folder itself or anything inside it
+		var isCycle bool
+		err = tx.QueryRow(
+			`WITH RECURSIVE ancestors AS (
+			   SELECT id, parent_id FROM folders WHERE id = $1
+			   UNION ALL
+			   SELECT f.id, f.parent_id FROM folders f JOIN ancestors a ON f.id = a.parent_id
+			 )
+			 SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2)`,
+			parent,
+			folderId,
+		).Scan(&isCycle)
+
+		if err != nil {
+			return err
+		}
+
+		if isCycle {
+			return ErrFolderCycle
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE folders SET parent_id = $1 WHERE id = $2`, parent, folderId)
+	if isPostgresError(err, uniqueViolation) {
+		return ErrFolderNameTaken
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not move folder %d: %w", folderId, err)
+	}
+
+	siblings, err := queryIds(
+		tx,
+		`SELECT id FROM folders WHERE room_code = $1 AND parent_id IS NOT DISTINCT FROM $2 AND id <> $3
+		 ORDER BY position ASC, created_at ASC`,
+		roomCode,
+		parent,
+		folderId,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := placeAt(tx, "folders", siblings, folderId, position); err != nil {
+		return err
+	}
+
+	if err := touchRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrInviteExpired  = errors.New("invite has expired")
+	ErrInviteUsedUp   = errors.New("invite has no uses left")
+)
+
+func CreateInvite(roomCode string, role string, maxUses int, expiresAt time.Time, createdBy string) (models.RoomInvite, error) {
+	invite := models.RoomInvite{
+		RoomCode:  roomCode,
+		Role:      role,
+		MaxUses:   maxUses,
+		ExpiresAt: expiresAt,
+		CreatedBy: createdBy,
+	}
+
+	err := db.QueryRow(
+		`INSERT INTO room_invites (room_code, role, max_uses, expires_at, created_by)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id, created_at`,
+		roomCode,
+		role,
+		maxUses,
+		expiresAt,
+		createdBy,
+	).Scan(&invite.ID, &invite.CreatedAt)
+
+	if err != nil {
+		return models.RoomInvite{}, fmt.Errorf("error inserting invite: %w", err)
+	}
+
+	return invite, nil
+}
+
+// gets the invites of a room that can still be redeemed, newest first
+func GetInvites(roomCode string) ([]models.RoomInvite, error) {
+	rows, err := db.Query(
+		`SELECT id, room_code, role, max_uses, uses, expires_at, created_by, created_at
+		 FROM room_invites
+		 WHERE room_code = $1 AND expires_at > NOW() AND (max_uses = 0 OR uses < max_uses)
+		 ORDER BY created_at DESC`,
+		roomCode,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	invites := []models.RoomInvite{}
+
+	for rows.Next() {
+		var invite models.RoomInvite
+		err := rows.Scan(
+			&invite.ID,
+			&invite.RoomCode,
+			&invite.Role,
+			&invite.MaxUses,
+			&invite.Uses,
+			&invite.ExpiresAt,
+			&invite.CreatedBy,
+			&invite.CreatedAt,
+		)
+		if err != nil {
+			log.Println("error reading invite")
+			continue
+		}
+
+		invites = append(invites, invite)
+	}
+
+	return invites, rows.Err()
+}
+
+func RevokeInvite(roomCode string, inviteId int) error {
+	result, err := db.Exec(`DELETE FROM room_invites WHERE id = $1 AND room_code = $2`, inviteId, roomCode)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInviteNotFound
+	}
+
+	return nil
+}
+
+// adds a user to the room of an invite and uses it up once. users who are already members keep
+// their role and do not use the invite. returns the room and the role the user has in it
+func RedeemInvite(inviteId int, username string) (string, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var roomCode, role string
+	var maxUses, uses int
+	var expiresAt time.Time
+
+	// lock the invite so that concurrent redeems cannot go over its uses
+	err = tx.QueryRow(
+		`SELECT room_code, role, max_uses, uses, expires_at FROM room_invites WHERE id = $1 FOR UPDATE`,
+		inviteId,
+	).Scan(&roomCode, &role, &maxUses, &uses, &expiresAt)
+
+	if err == sql.ErrNoRows {
+		return "", "", ErrInviteNotFound
+	}
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if !time.Now().Before(expiresAt) {
+		return "", "", ErrInviteExpired
+	}
+
+	var currentRole string
+	err = tx.QueryRow(
+		`SELECT role FROM room_members WHERE room_code = $1 AND username = $2`,
+		roomCode,
+		username,
+	).Scan(&currentRole)
+
+	if err == nil {
+		return roomCode, currentRole, nil
+	}
+
+	if err != sql.ErrNoRows {
+		return "", "", err
+	}
+
+	if maxUses > 0 && uses >= maxUses {
+		return "", "", ErrInviteUsedUp
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO room_members (room_code, username, role) VALUES ($1, $2, $3)`,
+		roomCode,
+		username,
+		role,
+	)
+	if isPostgresError(err, foreignKeyViolation) {
+		return "", "", ErrUserNotFound
+	}
+
+	if err != nil {
+		return "", "", fmt.Errorf("error adding member: %w", err)
+	}
+
+	if _, err := tx.Exec(`UPDATE room_invites SET uses = uses + 1 WHERE id = $1`, inviteId); err != nil {
+		return "", "", fmt.Errorf("error using invite: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+
+	return roomCode, role, nil
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrRoomNotFound   = errors.New("room not found")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrMemberExists   = errors.New("user is already a member of the room")
+	ErrMemberNotFound = errors.New("user is not a member of the room")
+	ErrLastOwner      = errors.New("room must keep at least one owner")
+)
+
+// postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	foreignKeyViolation = "23503"
+	uniqueViolation     = "23505"
+)
+
+func isPostgresError(err error, code string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && string(pqErr.Code) == code
+}
+
+// gets the role a user has in a room and whether the room is archived. members have the role
+// they were given, everyone else can edit public rooms and has no role at all in private ones
+func GetRoomRole(roomCode string, username string) (string, bool, error) {
+	var isPublic sql.NullBool
+	var archived bool
+	var role sql.NullString
+
+	err := db.QueryRow(
+		`SELECT r.public, r.archived, m.role
+		 FROM rooms r LEFT JOIN room_members m ON m.room_code = r.code AND m.username = $2
+		 WHERE r.code = $1`,
+		roomCode,
+		username,
+	).Scan(&isPublic, &archived, &role)
+
+	if err == sql.ErrNoRows {
+		return "", false, ErrRoomNotFound
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if role.Valid {
+		return role.String, archived, nil
+	}
+
+	if isPublic.Bool {
+		return models.RoleEditor, archived, nil
+	}
+
+	return "", archived, nil
+}
+
+func GetRoomMembers(roomCode string) ([]models.RoomMember, error) {
+	rows, err := db.Query(
+		`SELECT username, role, created_at FROM room_members WHERE room_code = $1 ORDER BY created_at ASC`,
+		roomCode,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	members := []models.RoomMember{}
+
+	for rows.Next() {
+		var member models.RoomMember
+		if err := rows.Scan(&member.Username, &member.Role, &member.CreatedAt); err != nil {
+			log.Println("error reading room member")
+			continue
+		}
+
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func AddRoomMember(roomCode string, username string, role string) error {
+	_, err := db.Exec(
+		`INSERT INTO room_members (room_code, username, role) VALUES ($1, $2, $3)`,
+		roomCode,
+		username,
+		role,
+	)
+
+	if isPostgresError(err, uniqueViolation) {
+		return ErrMemberExists
+	}
+
+	if isPostgresError(err, foreignKeyViolation) {
+		return ErrUserNotFound
+	}
+
+	return err
+}
+
+func UpdateRoomMemberRole(roomCode string, username string, role string) error {
+	return changeRoomMember(roomCode, username, role, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec(
+			`UPDATE room_members SET role = $3 WHERE room_code = $1 AND username = $2`,
+			roomCode,
+			username,
+			role,
+		)
+	})
+}
+
+func RemoveRoomMember(roomCode string, username string) error {
+	return changeRoomMember(roomCode, username, "", func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec(
+			`DELETE FROM room_members WHERE room_code = $1 AND username = $2`,
+			roomCode,
+			username,
+		)
+	})
+}
+
+// runs a change to a member, refusing to leave the room without an owner. the room row is
+// locked so that two owners cannot demote each other at the same time
+func changeRoomMember(roomCode string, username string, newRole string, change func(tx *sql.Tx) (sql.Result, error)) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	var role string
+	var owners int
+	err = tx.QueryRow(
+		`SELECT role, (SELECT COUNT(*) FROM room_members WHERE room_code = $1 AND role = $3)
+		 FROM room_members WHERE room_code = $1 AND username = $2`,
+		roomCode,
+		username,
+		models.RoleOwner,
+	).Scan(&role, &owners)
+
+	if err == sql.ErrNoRows {
+		return ErrMemberNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if role == models.RoleOwner && newRole != models.RoleOwner && owners <= 1 {
+		return ErrLastOwner
+	}
+
+	if _, err := change(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// postgres only runs db/init.sql when its volume is first created, so databases created by an
+// older version of it are brought up to date here on every start. every statement must be safe
+// to run again, and every change to init.sql needs one here too
+var migrations = []string{
+	// revision history
+	`ALTER TABLE documents ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS document_revisions (
+		document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+		revision INTEGER NOT NULL,
+		operation JSONB NOT NULL,
+		author VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (document_id, revision)
+	)`,
+	`CREATE TABLE IF NOT EXISTS document_snapshots (
+		document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+		revision INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (document_id, revision)
+	)`,
+
+	// room memberships
+	`CREATE TABLE IF NOT EXISTS room_members (
+		room_code VARCHAR(10) NOT NULL REFERENCES rooms(code) ON DELETE CASCADE,
+		username VARCHAR(255) NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+		role VARCHAR(10) NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (room_code, username)
+	)`,
+	// private rooms without members (e.g. created before memberships) get as owner whoever first
+	// uploaded a pdf to them or edited one of their documents. rooms with neither stay closed to
+	// everyone until an owner is added by hand
+	`INSERT INTO room_members (room_code, username, role)
+	 SELECT DISTINCT ON (c.room_code) c.room_code, c.username, 'owner'
+	 FROM (
+	   SELECT p.room_code, p.uploaded_by AS username, p.created_at FROM pdfs p
+	   UNION ALL
+	   SELECT d.room_code, v.author, v.created_at
+	   FROM document_revisions v JOIN documents d ON d.id = v.document_id
+	 ) c
+	 JOIN rooms r ON r.code = c.room_code JOIN users u ON u.username = c.username
+	 WHERE NOT COALESCE(r.public, FALSE) AND NOT EXISTS (SELECT 1 FROM room_members m WHERE m.room_code = c.room_code)
+	 ORDER BY c.room_code, c.created_at ASC
+	 ON CONFLICT DO NOTHING`,
+
+	// room invites
+	`CREATE TABLE IF NOT EXISTS room_invites (
+		id SERIAL PRIMARY KEY,
+		room_code VARCHAR(10) NOT NULL REFERENCES rooms(code) ON DELETE CASCADE,
+		role VARCHAR(10) NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+		max_uses INTEGER NOT NULL DEFAULT 1,
+		uses INTEGER NOT NULL DEFAULT 0,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		created_by VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// order of documents in a room
+	`ALTER TABLE documents ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0`,
+
+	// archived rooms
+	`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS archived BOOLEAN NOT NULL DEFAULT FALSE`,
+
+	// folders, before the documents that reference them
+	`CREATE TABLE IF NOT EXISTS folders (
+		id SERIAL PRIMARY KEY,
+		room_code VARCHAR(10) NOT NULL REFERENCES rooms(code) ON DELETE CASCADE,
+		parent_id INTEGER REFERENCES folders(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE NULLS NOT DISTINCT (room_code, parent_id, name)
+	)`,
+	`ALTER TABLE documents ADD COLUMN IF NOT EXISTS folder_id INTEGER REFERENCES folders(id) ON DELETE SET NULL`,
+
+	// search. the search vector of documents used to cover all of their content, which fails to
+	// save documents whose vector is over 1MB, so it is made again if it does not use left
+	`DO $$
+	BEGIN
+		IF EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_name = 'documents' AND column_name = 'search_vector'
+			  AND generation_expression NOT LIKE '%left%'
+		) THEN
+			ALTER TABLE documents DROP COLUMN search_vector;
+		END IF;
+	END $$`,
+	`ALTER TABLE documents ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+		setweight(to_tsvector('english', left(COALESCE(content, ''), 50000)), 'B')
+	) STORED`,
+	`CREATE INDEX IF NOT EXISTS documents_search_idx ON documents USING GIN (search_vector)`,
+	`ALTER TABLE pdfs ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (
+		to_tsvector('simple', regexp_replace(filename, '[_.-]+', ' ', 'g'))
+	) STORED`,
+	`CREATE INDEX IF NOT EXISTS pdfs_search_idx ON pdfs USING GIN (search_vector)`,
+
+	// yjs state of documents
+	`ALTER TABLE documents ADD COLUMN IF NOT EXISTS yjs_state BYTEA`,
+}
+
+// arbitrary key of the advisory lock that keeps instances starting together from migrating at once
+const migrationLockKey = 7310
+
+// brings the schema of the database up to date, see migrations. runs in one transaction, so a
+// failed migration leaves the database as it was
+func MigratePostgres() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("could not lock migrations: %w", err)
+	}
+
+	for i, migration := range migrations {
+		if _, err := tx.Exec(migration); err != nil {
+			return fmt.Errorf("migration %d failed: %w", i, err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,515 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"backend/internal/utils"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// number of committed operations kept per document for transforming late operations
+	operationHistorySize = 1000
+	// how many times a commit is retried when other writers keep getting in first
+	maxCommitAttempts = 50
+	documentTTL       = 1 * time.Hour
+)
+
+var (
+	ErrInvalidRevision     = errors.New("operation revision is ahead of the document")
+	ErrRevisionUnavailable = errors.New("operation revision is no longer in the history")
+	ErrCommitConflict      = errors.New("could not commit operation, document is too busy")
+	ErrInvalidOperation    = errors.New("invalid operation")
+)
+
+// caches a document loaded from postgres, unless another writer already did.
+// a late load can therefore never roll back operations committed in the meantime
+var loadDocumentScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'EX', ARGV[2]) then
+	redis.call('SET', KEYS[2], ARGV[3], 'EX', ARGV[2])
+	redis.call('DEL', KEYS[3])
+end
+return 1
+`)
+
+// reads content, revision and the operations committed since revision ARGV[1]
+// in one step, returns the history start index so the caller can tell if the
+// requested revision is still available
+var readDocumentScript = redis.NewScript(`
+local content = redis.call('GET', KEYS[1])
+if not content then
+	return false
+end
+
+local revision = tonumber(redis.call('GET', KEYS[2]) or '0')
+local since = tonumber(ARGV[1])
+if since < 0 or since >= revision then
+	return {content, revision, 0, {}}
+end
+
+local start = since - (revision - redis.call('LLEN', KEYS[3]))
+if start < 0 then
+	return {content, revision, start, {}}
+end
+
+return {content, revision, start, redis.call('LRANGE', KEYS[3], start, -1)}
+`)
+
+// writes the new content and appends the applied operations, but only if the
+// document is still at the revision they were transformed against. also marks the
+// document as dirty, keeping the time of its oldest edit that was not synced yet,
+// and publishes the operations to the room. since redis runs one script at a time,
+// every instance receives the operations of a document in the order they were committed.
+// operations a client numbered (ARGV[10] is not 0) are remembered in KEYS[5] along with where
+// they ended up. a commit that reverts an undo or redo step (ARGV[11] is not empty) pops it
+// from KEYS[6], and returns -1 without committing if it is no longer the last step there.
+// the revisions are queued in KEYS[7] as ARGV[12], to be written to postgres in the background
+var commitOperationScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 or tonumber(redis.call('GET', KEYS[2]) or '0') ~= tonumber(ARGV[1]) then
+	return 0
+end
+
+if ARGV[11] ~= '' and redis.call('LINDEX', KEYS[6], -1) ~= ARGV[11] then
+	return -1
+end
+
+redis.call('SET', KEYS[1], ARGV[2], 'EX', ARGV[4])
+redis.call('SET', KEYS[2], ARGV[3], 'EX', ARGV[4])
+redis.call('RPUSH', KEYS[3], unpack(ARGV, 13))
+redis.call('LTRIM', KEYS[3], -tonumber(ARGV[5]), -1)
+redis.call('EXPIRE', KEYS[3], ARGV[4])
+redis.call('ZADD', KEYS[4], 'NX', ARGV[6], ARGV[7])
+if ARGV[10] ~= '0' then
+	redis.call('LPUSH', KEYS[5], ARGV[10] .. ':' .. ARGV[1] .. ':' .. (#ARGV - 12))
+	redis.call('LTRIM', KEYS[5], 0, tonumber(ARGV[5]) - 1)
+	redis.call('EXPIRE', KEYS[5], ARGV[4])
+end
+if ARGV[11] ~= '' then
+	redis.call('RPOP', KEYS[6])
+end
+redis.call('RPUSH', KEYS[7], ARGV[12])
+redis.call('PUBLISH', ARGV[8], ARGV[9])
+return 1
+`)
+
+// a step of an undo or redo stack that a commit reverts, see commitOperationScript
+type stackStep struct {
+	key   string
+	entry string
+}
+
+// operations of a session that were committed, as seq:revision:count entries, newest first.
+// revision is the one the first of count committed operations was made against
+func sequenceKey(roomCode string, documentId int, sessionId string) string {
+	return documentKey(roomCode, documentId, "seq:"+sessionId)
+}
+
+// where operations a client numbered ended up in the history of a document
+type CommittedSeq struct {
+	Seq int
+	// revision the first operation was committed against, and how many it became
+	Revision int
+	Count    int
+}
+
+// gets the latest operations of a session that were committed to a document, oldest first
+func GetCommittedSeqs(roomCode string, documentId int, sessionId string) ([]CommittedSeq, error) {
+	entries, err := redisClient.LRange(ctx, sequenceKey(roomCode, documentId, sessionId), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not get committed operations: %w", err)
+	}
+
+	seqs := make([]CommittedSeq, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		parts := strings.Split(entries[i], ":")
+		if len(parts) != 3 {
+			continue
+		}
+
+		var c CommittedSeq
+		c.Seq, _ = strconv.Atoi(parts[0])
+		c.Revision, _ = strconv.Atoi(parts[1])
+		c.Count, _ = strconv.Atoi(parts[2])
+		seqs = append(seqs, c)
+	}
+
+	return seqs, nil
+}
+
+// builds the redis key for given document field, e.g. doc:{roomCode}:{docId}:content
+func documentKey(roomCode string, documentId int, field string) string {
+	return fmt.Sprintf("doc:%s:%d:%s", roomCode, documentId, field)
+}
+
+// keys of the content, revision and operation history of a document, in the order the scripts expect them
+func documentStateKeys(roomCode string, documentId int) []string {
+	return []string{
+		documentKey(roomCode, documentId, "content"),
+		documentKey(roomCode, documentId, "rev"),
+		documentKey(roomCode, documentId, "ops"),
+	}
+}
+
+// fetches contents of a document from postgres and caches them in redis,
+// returns ErrDocumentNotFound if the room has no such document
+func loadDocument(roomCode string, documentId int) error {
+	var content sql.NullString
+	var revision int
+	err := db.QueryRow(
+		`SELECT content, revision FROM documents WHERE id = $1 AND room_code = $2`,
+		documentId,
+		roomCode,
+	).Scan(&content, &revision)
+
+	// documents are only ever created through postgres, so one that is not there
+	// does not exist or belongs to another room
+	if err == sql.ErrNoRows {
+		return ErrDocumentNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get document from postgres: %w", err)
+	}
+
+	text, revision, err := catchUpWithRevisions(roomCode, documentId, content.String, revision)
+	if err != nil {
+		return err
+	}
+
+	err = loadDocumentScript.Run(
+		ctx,
+		redisClient,
+		documentStateKeys(roomCode, documentId),
+		text,
+		int(documentTTL.Seconds()),
+		revision,
+	).Err()
+
+	if err != nil {
+		return fmt.Errorf("could not cache document: %w", err)
+	}
+
+	return nil
+}
+
+// reads content and revision of a document along with the operations committed
+// since given revision (none if since is negative), loading the document if it is not cached
+func readDocument(roomCode string, documentId int, since int) (string, int, []models.Operation, error) {
+	keys := documentStateKeys(roomCode, documentId)
+
+	result, err := readDocumentScript.Run(ctx, redisClient, keys, since).Slice()
+	if err == redis.Nil {
+		if err := loadDocument(roomCode, documentId); err != nil {
+			return "", 0, nil, err
+		}
+
+		result, err = readDocumentScript.Run(ctx, redisClient, keys, since).Slice()
+	}
+
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("could not read document: %w", err)
+	}
+
+	content, _ := result[0].(string)
+	revision, _ := result[1].(int64)
+	start, _ := result[2].(int64)
+	entries, _ := result[3].([]interface{})
+
+	if since > int(revision) {
+		return "", 0, nil, ErrInvalidRevision
+	}
+
+	if start < 0 {
+		return "", 0, nil, ErrRevisionUnavailable
+	}
+
+	ops := make([]models.Operation, 0, len(entries))
+	for _, entry := range entries {
+		var op models.Operation
+		if err := json.Unmarshal([]byte(entry.(string)), &op); err != nil {
+			return "", 0, nil, fmt.Errorf("could not read operation history: %w", err)
+		}
+
+		ops = append(ops, op)
+	}
+
+	return content, int(revision), ops, nil
+}
+
+// tries to get contents of a document from redis
+// if not present in redis, contents are fetched from postgres and added to redis.
+// returns ErrDocumentNotFound if the room has no such document
+func GetDocumentContent(roomCode string, documentId int) (string, error) {
+	content, _, _, err := readDocument(roomCode, documentId, -1)
+	return content, err
+}
+
+// gets contents of a document along with its current revision
+func GetDocumentState(roomCode string, documentId int) (string, int, error) {
+	content, revision, _, err := readDocument(roomCode, documentId, -1)
+	return content, revision, err
+}
+
+// gets all committed operations made against given revision or later, oldest first
+func GetOperationsSince(roomCode string, documentId int, revision int) ([]models.Operation, error) {
+	if revision < 0 {
+		return nil, ErrInvalidRevision
+	}
+
+	_, _, ops, err := readDocument(roomCode, documentId, revision)
+	return ops, err
+}
+
+// transforms operation against everything committed since its revision, applies it
+// and appends it to the document's history. this is the only way document content
+// changes, and it is atomic: if another writer commits first, the operation is
+// transformed again against that commit and retried.
+// committed operations are appended to the revision history under event.Username and
+// published to the room as event, filled in with the operations and the new revision.
+// returns the operations that were actually applied and the new document revision
+func CommitOperation(roomCode string, documentId int, op models.Operation, event models.RoomEvent) ([]models.Operation, int, error) {
+	return commitOperations(roomCode, documentId, []models.Operation{op}, op.Revision, event, nil)
+}
+
+// commits a sequence of operations made against given revision, each on top of the one
+// before it, see CommitOperation
+func CommitOperations(roomCode string, documentId int, ops []models.Operation, baseRevision int, event models.RoomEvent) ([]models.Operation, int, error) {
+	return commitOperations(roomCode, documentId, ops, baseRevision, event, nil)
+}
+
+// commits operations, see CommitOperations. if step is not nil, it is popped from its stack
+// along with the commit, and errStepChanged is returned if it is no longer the last step there
+func commitOperations(roomCode string, documentId int, ops []models.Operation, baseRevision int, event models.RoomEvent, step *stackStep) ([]models.Operation, int, error) {
+	if baseRevision < 0 {
+		return nil, 0, ErrInvalidRevision
+	}
+
+	stepKey, stepEntry := "", ""
+	if step != nil {
+		stepKey, stepEntry = step.key, step.entry
+	}
+
+	keys := append(
+		documentStateKeys(roomCode, documentId),
+		dirtyDocumentsKey,
+		sequenceKey(roomCode, documentId, event.SessionId),
+		stepKey,
+		pendingRevisionsKey,
+	)
+
+	// the numbers clients gave their operations are only remembered, not committed
+	seq := 0
+	if hasSeqs(ops) {
+		ops = slices.Clone(ops)
+		for i := range ops {
+			if event.SessionId != "" {
+				seq = max(seq, ops[i].Seq)
+			}
+			ops[i].Seq = 0
+		}
+	}
+
+	for attempt := 0; attempt < maxCommitAttempts; attempt++ {
+		content, revision, committed, err := readDocument(roomCode, documentId, baseRevision)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if hasCompounds(ops) {
+			// compound operations must cover the document as the client saw it
+			base, err := revertOperations(content, committed)
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not rebuild revision %d: %w", baseRevision, err)
+			}
+
+			ops, err = expandCompounds(base, ops)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: %w", ErrInvalidOperation, err)
+			}
+
+			// they are never shown half applied
+			event.Atomic = true
+		}
+
+		if hasForeignUnits(ops) {
+			// committed operations are in utf-16 code units, and positions in other units
+			// can only be converted using the content the operations were made against
+			if len(committed) > 0 {
+				return nil, 0, fmt.Errorf("%w: positions in other units than utf16 must be made against the latest revision", ErrInvalidOperation)
+			}
+
+			ops, err = convertOperations(content, ops)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: %w", ErrInvalidOperation, err)
+			}
+		}
+
+		transformed := utils.TransformOperations(ops, committed)
+		if len(transformed) == 0 {
+			return nil, revision, nil
+		}
+
+		args := []interface{}{
+			revision,
+			"", // new content, filled in below
+			revision + len(transformed),
+			int(documentTTL.Seconds()),
+			operationHistorySize,
+			time.Now().UnixMilli(),
+			dirtyDocumentMember(roomCode, documentId),
+			roomChannel(roomCode),
+			"", // event, filled in below
+			seq,
+			stepEntry,
+			"", // revisions, filled in below
+		}
+
+		newRevision := revision
+		for i := range transformed {
+			transformed[i].Revision = newRevision
+			content, err = utils.ApplyOperation(content, &transformed[i])
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: %w", ErrInvalidOperation, err)
+			}
+
+			newRevision++
+
+			entry, err := json.Marshal(transformed[i])
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not marshal operation: %w", err)
+			}
+
+			args = append(args, entry)
+		}
+
+		args[1] = content
+
+		args[11], err = pendingRevisionsEntry(roomCode, documentId, event.Username, transformed, content)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		event.Type = "operations"
+		event.DocumentId = documentId
+		event.Operations = transformed
+		event.Revision = newRevision
+
+		args[8], err = json.Marshal(event)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not marshal operations event: %w", err)
+		}
+
+		result, err := commitOperationScript.Run(ctx, redisClient, keys, args...).Int()
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not commit operation: %w", err)
+		}
+
+		if result == -1 {
+			return nil, 0, errStepChanged
+		}
+
+		if result == 1 {
+			notifyRevisionsQueued()
+			return transformed, newRevision, nil
+		}
+
+		// another writer committed first, transform against its operations as well
+	}
+
+	return nil, 0, ErrCommitConflict
+}
+
+func hasSeqs(ops []models.Operation) bool {
+	for _, op := range ops {
+		if op.Seq != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasCompounds(ops []models.Operation) bool {
+	for _, op := range ops {
+		if op.Type == "compound" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rebuilds the content a document had before given committed operations
+func revertOperations(content string, committed []models.Operation) (string, error) {
+	for i := len(committed) - 1; i >= 0; i-- {
+		inverse := utils.InvertOperation(committed[i])
+
+		var err error
+		content, err = utils.ApplyOperation(content, &inverse)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return content, nil
+}
+
+// checks the compound operations of a sequence made against content and expands them
+// into inserts and deletes, see utils.ExpandOperation
+func expandCompounds(content string, ops []models.Operation) ([]models.Operation, error) {
+	expanded := make([]models.Operation, 0, len(ops))
+
+	for _, op := range ops {
+		// applied to a copy, inserts and deletes are applied for real once transformed
+		applied := op
+
+		var err error
+		content, err = utils.ApplyOperation(content, &applied)
+		if err != nil {
+			return nil, err
+		}
+
+		expanded = append(expanded, utils.ExpandOperation(op)...)
+	}
+
+	return expanded, nil
+}
+
+func hasForeignUnits(ops []models.Operation) bool {
+	for _, op := range ops {
+		if op.Unit != "" && op.Unit != models.UnitUTF16 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// converts a sequence of operations made against content to utf-16 positions
+func convertOperations(content string, ops []models.Operation) ([]models.Operation, error) {
+	converted := make([]models.Operation, 0, len(ops))
+
+	for _, op := range ops {
+		op, err := utils.ConvertOperation(content, op, models.UnitUTF16)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err = utils.ApplyOperation(content, &op)
+		if err != nil {
+			return nil, err
+		}
+
+		converted = append(converted, op)
+	}
+
+	return converted, nil
+}
@@ -0,0 +1,441 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"backend/internal/utils"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// a snapshot of the content is stored every this many revisions
+	snapshotInterval = 100
+
+	// revisions that were committed but not written to postgres yet. commits queue them here,
+	// and the revision writer takes them out once they are written. entries are json encoded
+	// pendingRevisions
+	pendingRevisionsKey = "revisions:pending"
+	// pending revisions read at once
+	pendingRevisionsBatch = 100
+	// time before writing revisions is tried again after it failed
+	revisionRetryDelay = 5 * time.Second
+)
+
+var (
+	ErrRevisionNotFound = errors.New("revision not found")
+	ErrRevisionGap      = errors.New("revision log has a gap")
+)
+
+var (
+	revisionsQueued = make(chan struct{}, 1)
+	revisionsMu     sync.Mutex
+)
+
+// committed operations waiting to be written to the revision log
+type pendingRevisions struct {
+	RoomCode   string             `json:"roomCode"`
+	DocumentId int                `json:"documentId"`
+	Author     string             `json:"author"`
+	Operations []models.Operation `json:"operations"`
+	// content after the operations, only kept if they need a snapshot
+	Content string `json:"content,omitempty"`
+}
+
+// appends committed operations to the revision log of a document, and takes a
+// snapshot of the resulting content whenever a multiple of snapshotInterval is crossed.
+// also marks the room of the document as changed
+func recordRevisions(roomCode string, documentId int, author string, ops []models.Operation, content string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, op := range ops {
+		entry, err := json.Marshal(op)
+		if err != nil {
+			return fmt.Errorf("could not marshal operation: %w", err)
+		}
+
+		// written again if they were queued after a write that did get through
+		_, err = tx.Exec(
+			`INSERT INTO document_revisions (document_id, revision, operation, author) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT DO NOTHING`,
+			documentId,
+			op.Revision+1,
+			string(entry),
+			author,
+		)
+		if err != nil {
+			return fmt.Errorf("could not insert revision %d: %w", op.Revision+1, err)
+		}
+	}
+
+	if needsSnapshot(ops) {
+		if err := insertSnapshot(tx, documentId, ops[len(ops)-1].Revision+1, content); err != nil {
+			return err
+		}
+	}
+
+	if err := touchRoom(tx, roomCode); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// reports whether committed operations cross a multiple of snapshotInterval
+func needsSnapshot(ops []models.Operation) bool {
+	firstRevision := ops[0].Revision
+	lastRevision := ops[len(ops)-1].Revision + 1
+
+	return firstRevision/snapshotInterval != lastRevision/snapshotInterval
+}
+
+// encodes committed operations for the queue of revisions, see commitOperationScript.
+// content is only kept if the operations need a snapshot
+func pendingRevisionsEntry(roomCode string, documentId int, author string, ops []models.Operation, content string) ([]byte, error) {
+	entry := pendingRevisions{
+		RoomCode:   roomCode,
+		DocumentId: documentId,
+		Author:     author,
+		Operations: ops,
+	}
+
+	if needsSnapshot(ops) {
+		entry.Content = content
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal revisions: %w", err)
+	}
+
+	return data, nil
+}
+
+// wakes up the revision writer after a commit, without waiting for it
+func notifyRevisionsQueued() {
+	select {
+	case revisionsQueued <- struct{}{}:
+	default:
+	}
+}
+
+// writes queued revisions to postgres whenever something was committed, until stop is closed.
+// after a failure it tries again a bit later, and the background sync tries too
+func writeRevisions(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	var retry <-chan time.Time
+
+	for {
+		select {
+		case <-revisionsQueued:
+		case <-retry:
+		case <-stop:
+			return
+		}
+
+		retry = nil
+		if err := flushPendingRevisions(); err != nil {
+			log.Printf("could not write revisions: %v", err)
+			retry = time.After(revisionRetryDelay)
+		}
+	}
+}
+
+// writes queued revisions to postgres, oldest first. an entry is only removed once it was
+// written, and writing it twice changes nothing, so instances may do this at the same time.
+// stops at the first failure, the rest is tried again later
+func flushPendingRevisions() error {
+	revisionsMu.Lock()
+	defer revisionsMu.Unlock()
+
+	for {
+		entries, err := redisClient.LRange(ctx, pendingRevisionsKey, 0, pendingRevisionsBatch-1).Result()
+		if err != nil {
+			return fmt.Errorf("could not get pending revisions: %w", err)
+		}
+
+		for _, data := range entries {
+			var entry pendingRevisions
+			if err := json.Unmarshal([]byte(data), &entry); err != nil {
+				log.Printf("dropping invalid pending revisions: %v", err)
+				redisClient.LRem(ctx, pendingRevisionsKey, 1, data)
+				continue
+			}
+
+			err := recordRevisions(entry.RoomCode, entry.DocumentId, entry.Author, entry.Operations, entry.Content)
+
+			// the document was deleted along with its history
+			if isPostgresError(err, foreignKeyViolation) {
+				err = nil
+			}
+
+			if err != nil {
+				return fmt.Errorf("could not write pending revisions of document %d: %w", entry.DocumentId, err)
+			}
+
+			if err := redisClient.LRem(ctx, pendingRevisionsKey, 1, data).Err(); err != nil {
+				return fmt.Errorf("could not remove pending revisions: %w", err)
+			}
+		}
+
+		if len(entries) < pendingRevisionsBatch {
+			return nil
+		}
+	}
+}
+
+// gets the operations of a document that are queued but not written yet, by the revision they produced
+func getQueuedRevisions(roomCode string, documentId int) (map[int]models.Operation, error) {
+	entries, err := redisClient.LRange(ctx, pendingRevisionsKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not get pending revisions: %w", err)
+	}
+
+	queued := map[int]models.Operation{}
+
+	for _, data := range entries {
+		var entry pendingRevisions
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			continue
+		}
+
+		if entry.RoomCode != roomCode || entry.DocumentId != documentId {
+			continue
+		}
+
+		for _, op := range entry.Operations {
+			queued[op.Revision+1] = op
+		}
+	}
+
+	return queued, nil
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertSnapshot(e execer, documentId int, revision int, content string) error {
+	_, err := e.Exec(
+		`INSERT INTO document_snapshots (document_id, revision, content) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		documentId,
+		revision,
+		content,
+	)
+	if err != nil {
+		return fmt.Errorf("could not insert snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// gets the operations that produced revisions after the given one, up to and including upTo.
+// revisions that are not in the log yet are taken from queued if they are there.
+// returns ErrRevisionGap if a revision in between is missing
+func getRevisionOperations(documentId int, after int, upTo int, queued map[int]models.Operation) ([]models.Operation, error) {
+	rows, err := db.Query(
+		`SELECT revision, operation FROM document_revisions WHERE document_id = $1 AND revision > $2 AND revision <= $3 ORDER BY revision ASC`,
+		documentId,
+		after,
+		upTo,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var ops []models.Operation
+
+	// appends the queued revisions that come next, up to and not including given one
+	fill := func(until int) {
+		for revision := after + len(ops) + 1; revision < until; revision++ {
+			op, ok := queued[revision]
+			if !ok {
+				return
+			}
+
+			ops = append(ops, op)
+		}
+	}
+
+	for rows.Next() {
+		var revision int
+		var entry []byte
+		if err := rows.Scan(&revision, &entry); err != nil {
+			return nil, err
+		}
+
+		fill(revision)
+
+		if want := after + len(ops) + 1; revision != want {
+			return nil, fmt.Errorf("%w: revision %d of document %d is missing", ErrRevisionGap, want, documentId)
+		}
+
+		var op models.Operation
+		if err := json.Unmarshal(entry, &op); err != nil {
+			return nil, fmt.Errorf("could not read revision: %w", err)
+		}
+
+		ops = append(ops, op)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fill(upTo + 1)
+
+	return ops, nil
+}
+
+func replayOperations(content string, ops []models.Operation) (string, error) {
+	for i := range ops {
+		var err error
+		content, err = utils.ApplyOperation(content, &ops[i])
+		if err != nil {
+			return "", fmt.Errorf("could not replay revision %d: %w", ops[i].Revision+1, err)
+		}
+	}
+
+	return content, nil
+}
+
+// brings content loaded from the documents table up to date with the revision log,
+// since the log is written on every commit but content is only synced periodically.
+// revisions that were committed but not written yet are taken from the queue. also makes sure
+// there is a snapshot to rebuild later revisions from. a log with a gap that the queue does not
+// fill can not be replayed, and loading the document fails rather than losing what came after it
+func catchUpWithRevisions(roomCode string, documentId int, content string, revision int) (string, int, error) {
+	queued, err := getQueuedRevisions(roomCode, documentId)
+	if err != nil {
+		return "", 0, err
+	}
+
+	ops, err := getRevisionOperations(documentId, revision, math.MaxInt32, queued)
+	if errors.Is(err, ErrRevisionGap) {
+		log.Printf("can not load document %d, its revision log has a gap: %v", documentId, err)
+	}
+
+	if err != nil {
+		return "", 0, fmt.Errorf("could not get revisions: %w", err)
+	}
+
+	content, err = replayOperations(content, ops)
+	if err != nil {
+		return "", 0, err
+	}
+
+	revision += len(ops)
+
+	_, err = db.Exec(
+		`INSERT INTO document_snapshots (document_id, revision, content)
+		 SELECT $1, $2, $3
+		 WHERE NOT EXISTS (SELECT 1 FROM document_snapshots WHERE document_id = $1 AND revision <= $2)`,
+		documentId,
+		revision,
+		content,
+	)
+	if err != nil {
+		log.Printf("could not snapshot document %d: %v", documentId, err)
+	}
+
+	return content, revision, nil
+}
+
+// gets a page of the revision history of a document, newest first
+func GetRevisions(roomCode string, documentId int, limit, offset int) ([]models.DocumentRevision, bool, error) {
+	// get one more than the limit
+	rows, err := db.Query(
+		`SELECT r.revision, r.author, r.operation, r.created_at
+		 FROM document_revisions r JOIN documents d ON d.id = r.document_id
+		 WHERE d.id = $1 AND d.room_code = $2
+		 ORDER BY r.revision DESC LIMIT $3 OFFSET $4`,
+		documentId,
+		roomCode,
+		limit+1,
+		offset,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer rows.Close()
+
+	revisions := []models.DocumentRevision{}
+
+	for rows.Next() {
+		var rev models.DocumentRevision
+		var entry []byte
+
+		if err := rows.Scan(&rev.Revision, &rev.Author, &entry, &rev.CreatedAt); err != nil {
+			log.Println("error reading revision")
+			continue
+		}
+
+		if err := json.Unmarshal(entry, &rev.Operation); err != nil {
+			log.Println("error reading revision operation")
+			continue
+		}
+
+		revisions = append(revisions, rev)
+	}
+
+	hasMoreData := len(revisions) > limit
+	if hasMoreData {
+		revisions = revisions[:limit]
+	}
+
+	return revisions, hasMoreData, nil
+}
+
+// rebuilds the content of a document at given revision from its closest snapshot
+func GetContentAtRevision(roomCode string, documentId int, revision int) (string, error) {
+	var snapshotRevision int
+	var content string
+
+	err := db.QueryRow(
+		`SELECT s.revision, s.content
+		 FROM document_snapshots s JOIN documents d ON d.id = s.document_id
+		 WHERE d.id = $1 AND d.room_code = $2 AND s.revision <= $3
+		 ORDER BY s.revision DESC LIMIT 1`,
+		documentId,
+		roomCode,
+		revision,
+	).Scan(&snapshotRevision, &content)
+
+	if err == sql.ErrNoRows {
+		return "", ErrRevisionNotFound
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	queued, err := getQueuedRevisions(roomCode, documentId)
+	if err != nil {
+		return "", err
+	}
+
+	ops, err := getRevisionOperations(documentId, snapshotRevision, revision, queued)
+	if err != nil {
+		return "", err
+	}
+
+	// the revision was not committed yet, or part of its history is missing
+	if snapshotRevision+len(ops) != revision {
+		return "", ErrRevisionNotFound
+	}
+
+	return replayOperations(content, ops)
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"backend/internal/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// longest room code that fits in the rooms table
+	maxRoomCodeLength = 10
+	// a fresh code is generated this many times when it is already taken
+	maxRoomCodeAttempts = 10
+
+	// users who look up this many rooms that do not exist (or that they can not see)
+	// within the window are blocked from looking up rooms until it ends
+	failedRoomLookupLimit  = 20
+	failedRoomLookupWindow = 10 * time.Minute
+)
+
+var (
+	ErrRoomCodesExhausted = errors.New("could not find a free room code")
+
+	roomCodeLength   = utils.DefaultRoomCodeLength
+	roomCodeAlphabet = utils.DefaultRoomCodeAlphabet
+)
+
+// sets the length and characters of generated room codes. longer codes and larger
+// alphabets make private rooms harder to find by guessing
+func ConfigureRoomCodes(length int, alphabet string) error {
+	if length < 4 || length > maxRoomCodeLength {
+		return fmt.Errorf("room code length must be between 4 and %d", maxRoomCodeLength)
+	}
+
+	if len(alphabet) < 2 {
+		return errors.New("room code alphabet needs at least 2 characters")
+	}
+
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		// codes end up in urls and redis keys, and are matched with redis patterns
+		if c > 127 || c <= ' ' || strings.IndexByte(":/?#%*[]\\", c) >= 0 {
+			return fmt.Errorf("room code alphabet can not contain %q", c)
+		}
+
+		if strings.IndexByte(alphabet[i+1:], c) >= 0 {
+			return fmt.Errorf("room code alphabet contains %q more than once", c)
+		}
+	}
+
+	roomCodeLength = length
+	roomCodeAlphabet = alphabet
+	return nil
+}
+
+// creates a room with a fresh code along with its owner, and returns the code
+func CreateRoom(name string, isPublic bool, owner string) (string, error) {
+	for range maxRoomCodeAttempts {
+		code, err := utils.GenerateRoomCode(roomCodeLength, roomCodeAlphabet)
+		if err != nil {
+			return "", err
+		}
+
+		err = createRoom(code, name, isPublic, owner)
+		if isPostgresError(err, uniqueViolation) {
+			// code is taken, try another one
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		return code, nil
+	}
+
+	return "", ErrRoomCodesExhausted
+}
+
+func createRoom(code, name string, isPublic bool, owner string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO rooms (code, name, public) VALUES ($1, $2, $3)", code, name, isPublic); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO room_members (room_code, username, role) VALUES ($1, $2, $3)",
+		code,
+		owner,
+		models.RoleOwner,
+	)
+	if err != nil {
+		return fmt.Errorf("error adding room owner: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// failed room lookups of a user are counted in redis, e.g. ratelimit:rooms:{username}
+func failedRoomLookupsKey(username string) string {
+	return "ratelimit:rooms:" + username
+}
+
+// checks whether a user may look up rooms by code, and if not, how long until they can again
+func CanLookUpRooms(username string) (bool, time.Duration, error) {
+	key := failedRoomLookupsKey(username)
+
+	failures, err := redisClient.Get(ctx, key).Int()
+	if err != nil && err != redis.Nil {
+		return false, 0, fmt.Errorf("could not get failed room lookups: %w", err)
+	}
+
+	if failures < failedRoomLookupLimit {
+		return true, 0, nil
+	}
+
+	ttl, err := redisClient.TTL(ctx, key).Result()
+	if err != nil {
+		return false, 0, fmt.Errorf("could not get failed room lookups: %w", err)
+	}
+
+	return false, ttl, nil
+}
+
+// counts a lookup of a room the user could not find. the window starts at the first failure
+func RecordFailedRoomLookup(username string) error {
+	key := failedRoomLookupsKey(username)
+
+	pipe := redisClient.TxPipeline()
+	pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, failedRoomLookupWindow)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("could not record failed room lookup: %w", err)
+	}
+
+	return nil
+}
+
+// locks the row of a room until the end of the transaction, so that changes to its
+// members, documents or folders that depend on each other happen one at a time
+func lockRoom(tx *sql.Tx, roomCode string) error {
+	var code string
+	err := tx.QueryRow(`SELECT code FROM rooms WHERE code = $1 FOR UPDATE`, roomCode).Scan(&code)
+	if err == sql.ErrNoRows {
+		return ErrRoomNotFound
+	}
+
+	return err
+}
+
+// marks a room as changed so it moves up in the list of rooms. rooms changed within
+// the last few seconds are left alone, so a burst of edits only updates them once
+func touchRoom(e execer, roomCode string) error {
+	_, err := e.Exec(
+		`UPDATE rooms SET updated_at = NOW() WHERE code = $1 AND updated_at < NOW() - INTERVAL '10 seconds'`,
+		roomCode,
+	)
+	if err != nil {
+		return fmt.Errorf("could not update room %s: %w", roomCode, err)
+	}
+
+	return nil
+}
+
+// changes the name, visibility or archived state of a room, nil values are left as they are
+func UpdateRoom(roomCode string, name *string, isPublic *bool, archived *bool) error {
+	result, err := db.Exec(
+		`UPDATE rooms SET
+		   name = COALESCE($2, name),
+		   public = COALESCE($3, public),
+		   archived = COALESCE($4, archived),
+		   updated_at = NOW()
+		 WHERE code = $1`,
+		roomCode,
+		name,
+		isPublic,
+		archived,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrRoomNotFound
+	}
+
+	return nil
+}
+
+// deletes a room along with everything in it, and clears its documents from redis.
+// pdfs hosted on github are left to the caller since they need their uploaders' tokens
+func DeleteRoom(roomCode string) error {
+	result, err := db.Exec(`DELETE FROM rooms WHERE code = $1`, roomCode)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrRoomNotFound
+	}
+
+	iter := redisClient.Scan(ctx, 0, fmt.Sprintf("doc:%s:*", roomCode), 100).Iterator()
+
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("could not find cached documents of room %s: %w", roomCode, err)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if err := redisClient.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("could not clear cached documents of room %s: %w", roomCode, err)
+	}
+
+	return nil
+}
+
+// makes another member the owner of a room, and the current owner an editor
+func TransferRoomOwnership(roomCode string, from string, to string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE room_members SET role = $3 WHERE room_code = $1 AND username = $2`,
+		roomCode,
+		to,
+		models.RoleOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMemberNotFound
+	}
+
+	_, err = tx.Exec(
+		`UPDATE room_members SET role = $3 WHERE room_code = $1 AND username = $2`,
+		roomCode,
+		from,
+		models.RoleEditor,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"html"
+	"log"
+	"strings"
+)
+
+// ts_headline wraps matches in these, they are turned into <mark> tags once the rest of the snippet is escaped
+const (
+	highlightStart = "{{hl}}"
+	highlightStop  = "{{/hl}}"
+)
+
+// searches the titles and content of documents and the filenames of pdfs in every room the user can
+// see (public rooms and rooms they are a member of, unless they are archived), or only in roomCode if it is not empty.
+// best matches come first, content is searched as it was last synced from redis. only the first
+// 50000 characters of each document are searched, see search_vector in db/init.sql
+func Search(username string, query string, roomCode string, limit, offset int) ([]models.SearchResult, bool, error) {
+	headlineOptions := `MaxFragments=2, MaxWords=20, MinWords=5, FragmentDelimiter=" … ", ` +
+		`StartSel="` + highlightStart + `", StopSel="` + highlightStop + `"`
+
+	// get one more than the limit. snippets are only made for the page of results, since
+	// ts_headline has to parse the whole content of each document
+	rows, err := db.Query(
+		`WITH visible AS (
+		   SELECT r.code, r.name FROM rooms r
+		   LEFT JOIN room_members m ON m.room_code = r.code AND m.username = $1
+		   WHERE (r.public = TRUE OR m.username IS NOT NULL) AND NOT r.archived AND ($3 = '' OR r.code = $3)
+		 ),
+		 results AS (
+		   SELECT 'document' AS type, d.id, d.title, v.code, v.name,
+		          ts_rank(d.search_vector, websearch_to_tsquery('english', $2)) AS rank
+		   FROM documents d JOIN visible v ON v.code = d.room_code
+		   WHERE d.search_vector @@ websearch_to_tsquery('english', $2)
+		   UNION ALL
+		   SELECT 'pdf' AS type, p.id, p.filename, v.code, v.name,
+		          ts_rank(p.search_vector, websearch_to_tsquery('simple', $2)) AS rank
+		   FROM pdfs p JOIN visible v ON v.code = p.room_code
+		   WHERE p.search_vector @@ websearch_to_tsquery('simple', $2)
+		 ),
+		 page AS (
+		   SELECT * FROM results ORDER BY rank DESC, id DESC LIMIT $5 OFFSET $6
+		 )
+		 SELECT page.type, page.id, page.title, page.code, page.name,
+		        CASE WHEN page.type = 'document'
+		             THEN ts_headline('english', left(COALESCE(d.content, ''), 50000), websearch_to_tsquery('english', $2), $4)
+		             ELSE ts_headline('simple', p.filename, websearch_to_tsquery('simple', $2), $4)
+		        END AS snippet,
+		        page.rank
+		 FROM page
+		 LEFT JOIN documents d ON page.type = 'document' AND d.id = page.id
+		 LEFT JOIN pdfs p ON page.type = 'pdf' AND p.id = page.id
+		 ORDER BY page.rank DESC, page.id DESC`,
+		username,
+		query,
+		roomCode,
+		headlineOptions,
+		limit+1,
+		offset,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer rows.Close()
+
+	results := []models.SearchResult{}
+
+	for rows.Next() {
+		var result models.SearchResult
+		var id int
+		var snippet string
+
+		err := rows.Scan(&result.Type, &id, &result.Title, &result.RoomCode, &result.RoomName, &snippet, &result.Rank)
+		if err != nil {
+			log.Println("error reading search result")
+			continue
+		}
+
+		if result.Type == "pdf" {
+			result.PdfID = id
+		} else {
+			result.DocumentID = id
+		}
+
+		result.Snippet = highlightSnippet(snippet)
+		results = append(results, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMoreData := len(results) > limit
+	if hasMoreData {
+		results = results[:limit]
+	}
+
+	return results, hasMoreData, nil
+}
+
+// escapes a snippet, which is raw document content, and marks its matches with <mark> tags
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, html.EscapeString(highlightStart), "<mark>")
+	return strings.ReplaceAll(snippet, html.EscapeString(highlightStop), "</mark>")
+}
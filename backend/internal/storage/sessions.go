@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// how long after disconnecting a client can resume its session
+const resumeWindow = 5 * time.Minute
+
+// sessions that ended recently and can be resumed, e.g. resume:{sessionId}
+func resumeKey(sessionId string) string {
+	return "resume:" + sessionId
+}
+
+// lets a client that lost its connection take over its session again within resumeWindow
+func MarkResumable(sessionId string) error {
+	if err := redisClient.Set(ctx, resumeKey(sessionId), 1, resumeWindow).Err(); err != nil {
+		return fmt.Errorf("could not mark session as resumable: %w", err)
+	}
+
+	return nil
+}
+
+// takes over a session that ended within resumeWindow. returns false if it can not be resumed,
+// because it ended too long ago, is still connected or was already taken over
+func ClaimResumable(sessionId string) (bool, error) {
+	claimed, err := redisClient.Del(ctx, resumeKey(sessionId)).Result()
+	if err != nil {
+		return false, fmt.Errorf("could not resume session: %w", err)
+	}
+
+	return claimed == 1, nil
+}
@@ -6,8 +6,6 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -22,6 +20,8 @@ var (
 type RoomData struct {
 	Code      string
 	Name      string
+	Public    bool
+	Archived  bool
 	UpdatedAt time.Time
 }
 
@@ -69,23 +69,49 @@ func InitializePostgres(host, port, user, password, dbname string) error {
 }
 
 func CreateDocument(roomCode, title, content string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// new documents go to the end of the top of the room
 	var docId int
-	err := db.QueryRow(
-		`INSERT INTO documents (title, content, room_code) VALUES ($1, $2, $3) RETURNING id`,
+	err = tx.QueryRow(
+		`INSERT INTO documents (title, content, room_code, position)
+		 VALUES ($1, $2, $3, (SELECT COALESCE(MAX(position) + 1, 0) FROM documents WHERE room_code = $3 AND folder_id IS NULL))
+		 RETURNING id`,
 		title,
 		content,
 		roomCode,
 	).Scan(&docId)
 
+	if isPostgresError(err, uniqueViolation) {
+		return -1, ErrDocumentTitleTaken
+	}
+
 	if err != nil {
 		return -1, fmt.Errorf("error inserting document: %w", err)
 	}
 
+	// the initial content is the first snapshot of the revision history
+	if err := insertSnapshot(tx, docId, 0, content); err != nil {
+		return -1, err
+	}
+
+	if err := touchRoom(tx, roomCode); err != nil {
+		return -1, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return -1, fmt.Errorf("error inserting document: %w", err)
+	}
+
 	return docId, nil
 }
 
 func GetDocuments(roomCode string) ([]models.Document, error) {
-	rows, err := db.Query("SELECT id, title FROM documents WHERE room_code = $1 ORDER BY created_at ASC", roomCode)
+	rows, err := db.Query("SELECT id, title, folder_id, position FROM documents WHERE room_code = $1 ORDER BY position ASC, created_at ASC", roomCode)
 	if err != nil {
 		return nil, err
 	}
@@ -97,66 +123,24 @@ func GetDocuments(roomCode string) ([]models.Document, error) {
 	for rows.Next() {
 		var doc models.Document
 
-		if err := rows.Scan(&doc.ID, &doc.Title); err != nil {
+		var folderId sql.NullInt64
+
+		if err := rows.Scan(&doc.ID, &doc.Title, &folderId, &doc.Position); err != nil {
 			log.Println("error reading document")
 			continue
 		}
 
+		doc.FolderID = nullableId(folderId)
+
 		docs = append(docs, doc)
 	}
 
 	return docs, nil
 }
 
-// tries to get contents of a document from redis
-// if not present in postgres, contents are fetched from postgres and added to redis
-func GetDocumentContent(roomCode string, documentId int) (string, error) {
-	docKey := fmt.Sprintf("doc:%s:%d:content", roomCode, documentId)
-	currentContent, err := redisClient.Get(ctx, docKey).Result()
-
-	if err != nil {
-		// retrieve document from postgres
-		var content string
-		err = db.QueryRow(`SELECT content FROM documents WHERE id = $1 AND room_code = $2`, documentId, roomCode).Scan(&content)
-
-		if err == nil {
-			// document found in postgres
-			currentContent = content
-			redisClient.Set(ctx, docKey, currentContent, 1*time.Hour)
-			return currentContent, nil
-		}
-
-		// document does not exist in postgres and redis, create in redis
-		// it will eventually sync with postgres
-
-		currentContent = content
-		redisClient.Set(ctx, docKey, currentContent, 1*time.Hour)
-		return currentContent, nil
-	}
-
-	// return content from redis
-	return currentContent, nil
-}
-
-func UpdateDocumentContent(roomCode string, content string, documentId int) error {
-	docKey := fmt.Sprintf("doc:%s:%d:content", roomCode, documentId)
-	err := redisClient.Set(ctx, docKey, content, 1*time.Hour).Err()
-
-	if err != nil {
-		return fmt.Errorf("could not set document content: %w", err)
-	}
-
-	return nil
-}
-
-func CreateRoom(code, name string, isPublic bool) error {
-	_, err := db.Exec("INSERT INTO rooms (code, name, public) VALUES ($1, $2, $3)", code, name, isPublic)
-	return err
-}
-
 func GetRooms(limit, offset int) ([]RoomData, bool, error) {
 	// get one more than the limit
-	rows, err := db.Query("SELECT code, name, updated_at FROM rooms WHERE public = TRUE ORDER BY updated_at DESC LIMIT $1 OFFSET $2", limit+1, offset)
+	rows, err := db.Query("SELECT code, name, updated_at FROM rooms WHERE public = TRUE AND archived = FALSE ORDER BY updated_at DESC LIMIT $1 OFFSET $2", limit+1, offset)
 	if err != nil {
 		return nil, false, err
 	}
@@ -186,15 +170,24 @@ func GetRooms(limit, offset int) ([]RoomData, bool, error) {
 	return rooms, hasMoreData, nil
 }
 
-func GetRoom(roomCode string) (string, bool, error) {
-	var roomName string
-	var isPublic bool
-	err := db.QueryRow("SELECT name, public FROM rooms WHERE code = $1", roomCode).Scan(&roomName, &isPublic)
+func GetRoom(roomCode string) (RoomData, error) {
+	var room RoomData
+	var isPublic sql.NullBool
+	err := db.QueryRow(
+		"SELECT code, name, public, archived, updated_at FROM rooms WHERE code = $1",
+		roomCode,
+	).Scan(&room.Code, &room.Name, &isPublic, &room.Archived, &room.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return RoomData{}, ErrRoomNotFound
+	}
+
 	if err != nil {
-		return "", false, err
+		return RoomData{}, err
 	}
 
-	return roomName, isPublic, nil
+	room.Public = isPublic.Bool
+	return room, nil
 }
 
 func CreateUser(username, password_hash string) error {
@@ -339,29 +332,3 @@ func GetPDFOwner(pdfId int) (string, error) {
 
 	return uploadedBy, nil
 }
-
-func StartBackgroundSync(interval time.Duration) {
-	go func() {
-		ticker := time.NewTicker(interval)
-
-		for range ticker.C {
-			keys, _ := redisClient.Keys(ctx, "doc:*:*:content").Result()
-			for _, key := range keys {
-				// decompose the key of form doc:{roomCode}:{docId}:content
-				parts := strings.Split(key, ":")
-				if len(parts) == 4 {
-					roomCode := parts[1]
-					docId, err := strconv.Atoi(parts[2])
-					if err != nil {
-						// ignore invalid doc ids
-						continue
-					}
-					content, _ := redisClient.Get(ctx, key).Result()
-
-					db.Exec(`UPDATE documents SET content = $1 WHERE id = $2 AND room_code = $3`, content, docId, roomCode)
-				}
-			}
-			log.Println("synced all documents with postgres")
-		}
-	}()
-}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// documents with edits that were not written to postgres yet, scored by the unix
+	// milliseconds of their oldest such edit. members are of form {roomCode}:{docId}
+	dirtyDocumentsKey = "docs:dirty"
+
+	// times a failed write is tried within one flush before waiting for the next one
+	maxFlushAttempts = 3
+	flushRetryDelay  = 200 * time.Millisecond
+)
+
+// forgets that a document is dirty, but only if it was not edited since it was read for
+// flushing. otherwise its score is moved up to when it was read, so it is flushed next time
+var clearDirtyScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '') == ARGV[2] then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	return 1
+end
+
+redis.call('ZADD', KEYS[1], 'XX', ARGV[3], ARGV[1])
+return 0
+`)
+
+type SyncStats struct {
+	// documents with edits that are not in postgres yet
+	Pending int `json:"pending"`
+	// seconds since the oldest edit that is not in postgres yet, 0 if there is none
+	OldestEditAge float64   `json:"oldestEditAgeSeconds"`
+	LastFlush     time.Time `json:"lastFlush"`
+	// writes that failed even after retrying, since the server started
+	FailedWrites int64 `json:"failedWrites"`
+	// commits whose revisions are not written to postgres yet
+	PendingRevisions int `json:"pendingRevisions"`
+}
+
+var (
+	syncStop      chan struct{}
+	syncDone      chan struct{}
+	revisionsDone chan struct{}
+	flushMu       sync.Mutex
+	lastFlush     atomic.Int64
+	failedWrites  atomic.Int64
+)
+
+func dirtyDocumentMember(roomCode string, documentId int) string {
+	return fmt.Sprintf("%s:%d", roomCode, documentId)
+}
+
+func parseDirtyDocumentMember(member string) (string, int, error) {
+	i := strings.LastIndexByte(member, ':')
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid dirty document %q", member)
+	}
+
+	documentId, err := strconv.Atoi(member[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid dirty document %q", member)
+	}
+
+	return member[:i], documentId, nil
+}
+
+// periodically writes documents that changed in redis to postgres, and writes revisions as
+// they are committed. call StopBackgroundSync on shutdown to write whatever is left
+func StartBackgroundSync(interval time.Duration) {
+	syncStop = make(chan struct{})
+	syncDone = make(chan struct{})
+	revisionsDone = make(chan struct{})
+
+	go writeRevisions(syncStop, revisionsDone)
+
+	// documents cached before edits were tracked may have edits that postgres does not
+	if err := markCachedDocumentsDirty(); err != nil {
+		log.Printf("could not mark cached documents for syncing: %v", err)
+	}
+
+	go func() {
+		defer close(syncDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				FlushDirtyDocuments()
+			case <-syncStop:
+				return
+			}
+		}
+	}()
+}
+
+// stops the background sync and does a final flush
+func StopBackgroundSync() error {
+	if syncStop == nil {
+		return nil
+	}
+
+	close(syncStop)
+	<-syncDone
+	<-revisionsDone
+	syncStop = nil
+
+	if _, failed := FlushDirtyDocuments(); failed > 0 {
+		return fmt.Errorf("%d documents could not be synced", failed)
+	}
+
+	return nil
+}
+
+// writes every dirty document to postgres, returns how many were written and how many failed.
+// failed documents stay dirty and are tried again on the next flush
+func FlushDirtyDocuments() (int, int) {
+	return flushDirtyDocuments("")
+}
+
+// writes the dirty documents of a room to postgres, see FlushDirtyDocuments
+func FlushRoomDocuments(roomCode string) (int, int) {
+	// room codes can not contain glob characters or colons, so this only matches the room
+	return flushDirtyDocuments(roomCode + ":*")
+}
+
+// flushes the dirty documents whose member matches the glob pattern, or all of them if it is empty.
+// failed documents are tried again a few times, without holding flushMu while waiting, so other
+// flushes (e.g. of a room that is being closed) are not held up by a slow postgres
+func flushDirtyDocuments(match string) (int, int) {
+	var members []string
+
+	// results alternate between members and scores
+	iter := redisClient.ZScan(ctx, dirtyDocumentsKey, 0, match, 100).Iterator()
+	for i := 0; iter.Next(ctx); i++ {
+		if i%2 == 0 {
+			members = append(members, iter.Val())
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		log.Printf("could not get dirty documents: %v", err)
+		return 0, 0
+	}
+
+	total := len(members)
+	remaining := members
+	errs := map[string]error{}
+
+	for attempt := 0; attempt < maxFlushAttempts && (attempt == 0 || len(remaining) > 0); attempt++ {
+		if attempt > 0 {
+			time.Sleep(flushRetryDelay << (attempt - 1))
+		}
+
+		remaining = flushDocuments(remaining, attempt == 0, errs)
+	}
+
+	for _, member := range remaining {
+		log.Printf("could not sync document %s after %d attempts: %v", member, maxFlushAttempts, errs[member])
+		failedWrites.Add(1)
+	}
+
+	if match == "" {
+		lastFlush.Store(time.Now().UnixMilli())
+	}
+
+	failed := len(remaining)
+	flushed := total - failed
+
+	if total > 0 {
+		log.Printf("synced %d documents with postgres, %d failed", flushed, failed)
+	}
+
+	return flushed, failed
+}
+
+// does one attempt at flushing the members, returns those that failed and records why in errs.
+// revisions are flushed first if withRevisions is set
+func flushDocuments(members []string, withRevisions bool, errs map[string]error) []string {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	// revisions go first, content loaded later is caught up from them
+	if withRevisions {
+		if err := flushPendingRevisions(); err != nil {
+			log.Printf("could not sync revisions: %v", err)
+			failedWrites.Add(1)
+		}
+	}
+
+	var failed []string
+
+	for _, member := range members {
+		if err := flushDocument(member); err != nil {
+			errs[member] = err
+			failed = append(failed, member)
+		}
+	}
+
+	return failed
+}
+
+func flushDocument(member string) error {
+	roomCode, documentId, err := parseDirtyDocumentMember(member)
+	if err != nil {
+		// nothing can be done about it
+		redisClient.ZRem(ctx, dirtyDocumentsKey, member)
+		return err
+	}
+
+	revisionKey := documentKey(roomCode, documentId, "rev")
+	readAt := time.Now().UnixMilli()
+
+	// content and revision are read together so they always match
+	values, err := redisClient.MGet(ctx, documentKey(roomCode, documentId, "content"), revisionKey).Result()
+	if err != nil {
+		return fmt.Errorf("could not read document: %w", err)
+	}
+
+	revisionValue, _ := values[1].(string)
+
+	// the document expired or was deleted, its edits are in the revision log either way
+	if content, ok := values[0].(string); ok {
+		revision, _ := strconv.Atoi(revisionValue)
+
+		// read after the content, so it is never behind it
+		yjsState, err := compactYjsLog(roomCode, documentId)
+		if err != nil {
+			return err
+		}
+
+		err = writeDocument(roomCode, documentId, content, revision, yjsState)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = clearDirtyScript.Run(ctx, redisClient, []string{dirtyDocumentsKey, revisionKey}, member, revisionValue, readAt).Err()
+	if err != nil {
+		return fmt.Errorf("could not clear dirty document: %w", err)
+	}
+
+	return nil
+}
+
+// writes content to postgres unless it already has a later revision. the yjs state is only
+// written if the document has one
+func writeDocument(roomCode string, documentId int, content string, revision int, yjsState []byte) error {
+	// a document that was deleted updates nothing, which is fine
+	_, err := db.Exec(
+		`UPDATE documents SET content = $1, revision = $2, yjs_state = COALESCE($5, yjs_state)
+		WHERE id = $3 AND room_code = $4 AND revision <= $2`,
+		content,
+		revision,
+		documentId,
+		roomCode,
+		yjsState,
+	)
+	if err != nil {
+		return fmt.Errorf("could not write document: %w", err)
+	}
+
+	return nil
+}
+
+// marks every document in redis as dirty, finding them with SCAN so redis is never blocked
+func markCachedDocumentsDirty() error {
+	now := time.Now().UnixMilli()
+
+	iter := redisClient.Scan(ctx, 0, "doc:*:*:content", 100).Iterator()
+	for iter.Next(ctx) {
+		// keys are of form doc:{roomCode}:{docId}:content
+		parts := strings.Split(iter.Val(), ":")
+		if len(parts) != 4 {
+			continue
+		}
+
+		documentId, err := strconv.Atoi(parts[2])
+		if err != nil {
+			continue
+		}
+
+		member := dirtyDocumentMember(parts[1], documentId)
+		if err := redisClient.ZAddNX(ctx, dirtyDocumentsKey, redis.Z{Score: float64(now), Member: member}).Err(); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
+// gets how far postgres is behind redis
+func GetSyncStats() (SyncStats, error) {
+	stats := SyncStats{
+		FailedWrites: failedWrites.Load(),
+	}
+
+	if ms := lastFlush.Load(); ms > 0 {
+		stats.LastFlush = time.UnixMilli(ms)
+	}
+
+	pending, err := redisClient.ZCard(ctx, dirtyDocumentsKey).Result()
+	if err != nil {
+		return SyncStats{}, fmt.Errorf("could not count dirty documents: %w", err)
+	}
+
+	stats.Pending = int(pending)
+
+	pendingRevisions, err := redisClient.LLen(ctx, pendingRevisionsKey).Result()
+	if err != nil {
+		return SyncStats{}, fmt.Errorf("could not count pending revisions: %w", err)
+	}
+
+	stats.PendingRevisions = int(pendingRevisions)
+
+	oldest, err := redisClient.ZRangeWithScores(ctx, dirtyDocumentsKey, 0, 0).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return SyncStats{}, fmt.Errorf("could not get oldest dirty document: %w", err)
+	}
+
+	if len(oldest) > 0 {
+		stats.OldestEditAge = time.Since(time.UnixMilli(int64(oldest[0].Score))).Seconds()
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"backend/internal/models"
+	"backend/internal/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// number of steps each user can undo on a document
+const undoStackSize = 100
+
+var (
+	ErrNothingToUndo = errors.New("nothing to undo")
+	errInvalidStep   = errors.New("invalid undo step")
+	// the step being reverted is no longer the last one on its stack
+	errStepChanged = errors.New("undo step changed")
+)
+
+// pops a step that can never be reverted, unless it is no longer the last one on its stack
+var dropStepScript = redis.NewScript(`
+if redis.call('LINDEX', KEYS[1], -1) == ARGV[1] then
+	redis.call('RPOP', KEYS[1])
+end
+return 1
+`)
+
+// undo and redo stacks are kept per document and user, e.g. doc:{roomCode}:{docId}:undo:{username},
+// so a user can undo their edits from any of their tabs, and after reloading. each entry is a step:
+// the revisions of the operations that were committed together
+func undoStackKey(roomCode string, documentId int, stack string, username string) string {
+	return documentKey(roomCode, documentId, stack+":"+username)
+}
+
+func pushUndoStep(pipe redis.Pipeliner, key string, ops []models.Operation) error {
+	revisions := make([]int, 0, len(ops))
+	for _, op := range ops {
+		revisions = append(revisions, op.Revision)
+	}
+
+	entry, err := json.Marshal(revisions)
+	if err != nil {
+		return fmt.Errorf("could not marshal undo step: %w", err)
+	}
+
+	pipe.RPush(ctx, key, entry)
+	pipe.LTrim(ctx, key, -undoStackSize, -1)
+	pipe.Expire(ctx, key, documentTTL)
+	return nil
+}
+
+// remembers operations that a user committed together as one step they can undo,
+// and forgets everything they could redo
+func RecordUndoStep(roomCode string, documentId int, username string, ops []models.Operation) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	pipe := redisClient.TxPipeline()
+	if err := pushUndoStep(pipe, undoStackKey(roomCode, documentId, "undo", username), ops); err != nil {
+		return err
+	}
+	pipe.Del(ctx, undoStackKey(roomCode, documentId, "redo", username))
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("could not record undo step: %w", err)
+	}
+
+	return nil
+}
+
+// reverts the last step of a user, see revertStep
+func Undo(roomCode string, documentId int, sessionId string, author string) ([]models.Operation, int, error) {
+	return revertStep(roomCode, documentId, sessionId, author, "undo", "redo")
+}
+
+// reverts the last undo of a user, see revertStep
+func Redo(roomCode string, documentId int, sessionId string, author string) ([]models.Operation, int, error) {
+	return revertStep(roomCode, documentId, sessionId, author, "redo", "undo")
+}
+
+// commits the inverse of the author's last step on one stack, transformed against everything
+// committed after it, so that only the author's own edits are reverted and collaborators' text
+// is left alone. the step is popped along with the commit, so steps are never lost to errors
+// that can pass, nor reverted twice from two tabs. steps that can never be reverted are dropped.
+// the committed inverse is pushed onto the other stack so it can be reverted too.
+// it is published to everyone on the document, the session that asked included since it does not
+// know how the step was transformed
+func revertStep(roomCode string, documentId int, sessionId string, author string, from string, to string) ([]models.Operation, int, error) {
+	fromKey := undoStackKey(roomCode, documentId, from, author)
+
+	for attempt := 0; attempt < maxCommitAttempts; attempt++ {
+		entry, err := redisClient.LIndex(ctx, fromKey, -1).Result()
+		if err == redis.Nil {
+			return nil, 0, ErrNothingToUndo
+		}
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not get %s step: %w", from, err)
+		}
+
+		step := &stackStep{key: fromKey, entry: entry}
+		event := models.RoomEvent{SessionId: sessionId, Username: author}
+
+		committed, revision, err := commitStep(roomCode, documentId, step, event)
+		if errors.Is(err, errStepChanged) {
+			// another tab of the author reverted it or recorded a new step first
+			continue
+		}
+
+		if errors.Is(err, errInvalidStep) || errors.Is(err, ErrRevisionUnavailable) ||
+			errors.Is(err, ErrInvalidRevision) || errors.Is(err, ErrInvalidOperation) {
+			if err := dropStepScript.Run(ctx, redisClient, []string{fromKey}, entry).Err(); err != nil {
+				log.Printf("could not drop %s step %q: %v", from, entry, err)
+			}
+
+			return nil, 0, err
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// nothing was left to revert, so nothing was committed to pop the step
+		if len(committed) == 0 {
+			if err := dropStepScript.Run(ctx, redisClient, []string{fromKey}, entry).Err(); err != nil {
+				return nil, 0, fmt.Errorf("could not drop %s step: %w", from, err)
+			}
+
+			return nil, revision, nil
+		}
+
+		pipe := redisClient.TxPipeline()
+		if err := pushUndoStep(pipe, undoStackKey(roomCode, documentId, to, author), committed); err != nil {
+			return nil, 0, err
+		}
+
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, 0, fmt.Errorf("could not record %s step: %w", to, err)
+		}
+
+		return committed, revision, nil
+	}
+
+	return nil, 0, ErrCommitConflict
+}
+
+// builds the inverse of a step and commits it, popping the step along with it
+func commitStep(roomCode string, documentId int, step *stackStep, event models.RoomEvent) ([]models.Operation, int, error) {
+	var revisions []int
+	if err := json.Unmarshal([]byte(step.entry), &revisions); err != nil || len(revisions) == 0 {
+		return nil, 0, fmt.Errorf("%w: %q", errInvalidStep, step.entry)
+	}
+
+	history, err := GetOperationsSince(roomCode, documentId, revisions[0])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// operations of a step are committed together, so they have consecutive revisions
+	// and their inverses in reverse order apply right after the last of them
+	var inverse []models.Operation
+	for i := len(revisions) - 1; i >= 0; i-- {
+		index := revisions[i] - revisions[0]
+		if index >= len(history) {
+			return nil, 0, ErrRevisionUnavailable
+		}
+
+		op := utils.InvertOperation(history[index])
+		if (op.Type == "insert" && op.Text == "") || (op.Type == "delete" && op.Length == 0) {
+			continue
+		}
+
+		inverse = append(inverse, op)
+	}
+
+	return commitOperations(roomCode, documentId, inverse, revisions[len(revisions)-1]+1, event, step)
+}
@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"backend/internal/utils"
+	"backend/internal/yjs"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// documents opened by yjs clients also have a log of yjs updates, e.g. doc:{roomCode}:{docId}:yjs,
+// and a hash describing it in doc:{roomCode}:{docId}:yjs:meta: the id of the log, which changes
+// whenever it is loaded from postgres again, the index of its first update, and the revision of
+// the content that the log's text matches. the log is merged into one update when it is synced
+// to postgres
+
+const (
+	// how long the lock of a document's yjs log is kept if its holder stops renewing it, e.g.
+	// because it crashed. holders renew it every third of that
+	yjsLockTTL = 10 * time.Second
+	// how often a writer checks whether the lock was released
+	yjsLockRetry = 20 * time.Millisecond
+)
+
+var (
+	ErrYjsLogChanged = errors.New("yjs log was loaded again")
+	ErrYjsLockLost   = errors.New("lock of yjs log was lost")
+)
+
+var unlockYjsScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+var renewYjsLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// caches the yjs log of a document loaded from postgres, unless it is already cached
+var loadYjsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+
+redis.call('DEL', KEYS[1])
+if ARGV[3] ~= '' then
+	redis.call('RPUSH', KEYS[1], ARGV[3])
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+redis.call('HSET', KEYS[2], 'id', ARGV[1], 'base', 0, 'rev', -1)
+redis.call('EXPIRE', KEYS[2], ARGV[2])
+return 1
+`)
+
+// reads the log from index ARGV[2] on. a caller that knows another log, or is behind its first
+// update, gets all of it
+var readYjsScript = redis.NewScript(`
+local meta = redis.call('HMGET', KEYS[2], 'id', 'base', 'rev')
+if not meta[1] then
+	return false
+end
+
+local base = tonumber(meta[2])
+local start = tonumber(ARGV[2]) - base
+if meta[1] ~= ARGV[1] or start < 0 then
+	start = 0
+end
+
+return {meta[1], base + start, tonumber(meta[3]), redis.call('LRANGE', KEYS[1], start, -1)}
+`)
+
+// appends updates to the log and sets the revision its text matches, if the lock is still held
+// with token ARGV[6]. the document is marked as dirty so the log gets to postgres
+var appendYjsScript = redis.NewScript(`
+if redis.call('GET', KEYS[4]) ~= ARGV[6] then
+	return -1
+end
+
+if redis.call('HGET', KEYS[2], 'id') ~= ARGV[1] then
+	return 0
+end
+
+if #ARGV > 6 then
+	redis.call('RPUSH', KEYS[1], unpack(ARGV, 7))
+end
+redis.call('HSET', KEYS[2], 'rev', ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call('EXPIRE', KEYS[2], ARGV[3])
+redis.call('ZADD', KEYS[3], 'NX', ARGV[4], ARGV[5])
+return 1
+`)
+
+// replaces the first ARGV[3] updates of the log with their merge, unless it changed otherwise
+var compactYjsScript = redis.NewScript(`
+local meta = redis.call('HMGET', KEYS[2], 'id', 'base')
+if meta[1] ~= ARGV[1] or meta[2] ~= ARGV[2] then
+	return 0
+end
+
+redis.call('LTRIM', KEYS[1], ARGV[3], -1)
+redis.call('LPUSH', KEYS[1], ARGV[4])
+redis.call('HINCRBY', KEYS[2], 'base', tonumber(ARGV[3]) - 1)
+return 1
+`)
+
+// keys of the yjs log of a document and its meta hash, in the order the scripts expect them
+func yjsKeys(roomCode string, documentId int) []string {
+	return []string{
+		documentKey(roomCode, documentId, "yjs"),
+		documentKey(roomCode, documentId, "yjs:meta"),
+	}
+}
+
+// updates of a document's yjs log
+type YjsLog struct {
+	// changes whenever the log is loaded from postgres, indexes of different logs do not compare
+	ID string
+	// index of the first update
+	Start   int
+	Updates [][]byte
+	// revision of the document content that the log's text matches, -1 if it is not known
+	Revision int
+}
+
+// index after the last update
+func (l YjsLog) End() int {
+	return l.Start + len(l.Updates)
+}
+
+// a held lock of a document's yjs log. it is renewed until it is unlocked, and appending to the
+// log checks that it is still held, so a holder that lost it (e.g. because it could not reach
+// redis to renew it) never writes over the next one
+type YjsLock struct {
+	key   string
+	token string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// locks the yjs log of a document, so that its text and the document content are changed
+// together. waits for as long as someone else holds it, which is at most yjsLockTTL after
+// they stopped renewing it
+func LockYjsDocument(roomCode string, documentId int) (*YjsLock, error) {
+	lock := &YjsLock{
+		key:   documentKey(roomCode, documentId, "yjs:lock"),
+		token: utils.GenerateSessionID(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	for {
+		ok, err := redisClient.SetNX(ctx, lock.key, lock.token, yjsLockTTL).Result()
+		if err != nil {
+			return nil, fmt.Errorf("could not lock yjs document: %w", err)
+		}
+
+		if ok {
+			break
+		}
+
+		time.Sleep(yjsLockRetry)
+	}
+
+	go lock.renew()
+
+	return lock, nil
+}
+
+func (l *YjsLock) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(yjsLockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			renewed, err := renewYjsLockScript.Run(ctx, redisClient, []string{l.key}, l.token, yjsLockTTL.Milliseconds()).Int()
+			if err != nil {
+				log.Printf("could not renew lock %s: %v", l.key, err)
+				continue
+			}
+
+			if renewed == 0 {
+				// appending fails from now on
+				log.Printf("lock %s was lost", l.key)
+				return
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *YjsLock) Unlock() {
+	close(l.stop)
+	<-l.done
+
+	unlockYjsScript.Run(ctx, redisClient, []string{l.key}, l.token)
+}
+
+// gets the updates of a document's yjs log from index from on. a caller that knows log id and
+// read it up to from only gets what was appended since, anyone else gets all of it
+func GetYjsLog(roomCode string, documentId int, id string, from int) (YjsLog, error) {
+	keys := yjsKeys(roomCode, documentId)
+
+	result, err := readYjsScript.Run(ctx, redisClient, keys, id, from).Slice()
+	if err == redis.Nil {
+		if err := loadYjsLog(roomCode, documentId); err != nil {
+			return YjsLog{}, err
+		}
+
+		result, err = readYjsScript.Run(ctx, redisClient, keys, id, from).Slice()
+	}
+
+	if err != nil {
+		return YjsLog{}, fmt.Errorf("could not read yjs log: %w", err)
+	}
+
+	l := YjsLog{}
+	l.ID, _ = result[0].(string)
+	start, _ := result[1].(int64)
+	revision, _ := result[2].(int64)
+	entries, _ := result[3].([]interface{})
+
+	l.Start = int(start)
+	l.Revision = int(revision)
+	for _, entry := range entries {
+		l.Updates = append(l.Updates, []byte(entry.(string)))
+	}
+
+	return l, nil
+}
+
+// caches the yjs state of a document from postgres as the first update of a new log.
+// returns ErrDocumentNotFound if the room has no such document
+func loadYjsLog(roomCode string, documentId int) error {
+	var state []byte
+	err := db.QueryRow(
+		`SELECT yjs_state FROM documents WHERE id = $1 AND room_code = $2`,
+		documentId,
+		roomCode,
+	).Scan(&state)
+
+	if err == sql.ErrNoRows {
+		return ErrDocumentNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get yjs state from postgres: %w", err)
+	}
+
+	err = loadYjsScript.Run(
+		ctx,
+		redisClient,
+		yjsKeys(roomCode, documentId),
+		utils.GenerateSessionID(),
+		int(documentTTL.Seconds()),
+		state,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("could not cache yjs log: %w", err)
+	}
+
+	return nil
+}
+
+// appends updates to a document's yjs log and records the revision of the content its text
+// matches now. returns ErrYjsLockLost if lock is not held anymore, and ErrYjsLogChanged if the
+// log is not the one with the given id anymore
+func AppendYjsUpdates(roomCode string, documentId int, lock *YjsLock, id string, updates [][]byte, revision int) error {
+	keys := append(yjsKeys(roomCode, documentId), dirtyDocumentsKey, lock.key)
+
+	args := []interface{}{
+		id,
+		revision,
+		int(documentTTL.Seconds()),
+		time.Now().UnixMilli(),
+		dirtyDocumentMember(roomCode, documentId),
+		lock.token,
+	}
+	for _, update := range updates {
+		args = append(args, update)
+	}
+
+	result, err := appendYjsScript.Run(ctx, redisClient, keys, args...).Int()
+	if err != nil {
+		return fmt.Errorf("could not append to yjs log: %w", err)
+	}
+
+	switch result {
+	case -1:
+		return ErrYjsLockLost
+	case 0:
+		return ErrYjsLogChanged
+	}
+
+	return nil
+}
+
+// reads the yjs log of a document for syncing, nil if it has none. its updates are merged
+// into one, which also replaces them in redis so the log does not keep growing
+func compactYjsLog(roomCode string, documentId int) ([]byte, error) {
+	keys := yjsKeys(roomCode, documentId)
+
+	var meta *redis.SliceCmd
+	var updates *redis.StringSliceCmd
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		meta = pipe.HMGet(ctx, keys[1], "id", "base")
+		updates = pipe.LRange(ctx, keys[0], 0, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read yjs log: %w", err)
+	}
+
+	id, ok := meta.Val()[0].(string)
+	if !ok || len(updates.Val()) == 0 {
+		return nil, nil
+	}
+
+	entries := make([][]byte, len(updates.Val()))
+	for i, update := range updates.Val() {
+		entries[i] = []byte(update)
+	}
+
+	merged, err := yjs.MergeUpdates(entries)
+	if err != nil {
+		return nil, fmt.Errorf("could not merge yjs log: %w", err)
+	}
+
+	if len(entries) > 1 {
+		err = compactYjsScript.Run(ctx, redisClient, keys, id, meta.Val()[1], len(entries), merged).Err()
+		if err != nil {
+			return nil, fmt.Errorf("could not compact yjs log: %w", err)
+		}
+	}
+
+	return merged, nil
+}
@@ -1,24 +1,38 @@
 package utils
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"fmt"
+	"math/big"
 
 	"github.com/google/uuid"
 )
 
-// generates user id using uuid
-func GenerateUserID() string {
+const (
+	DefaultRoomCodeLength   = 6
+	DefaultRoomCodeAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
+)
+
+// generates websocket session id using uuid
+func GenerateSessionID() string {
 	id := uuid.New()
 	return id.String()
 }
 
-// generates random 6 character room code
-func GenerateRoomCode() string {
-	const characters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
-	b := make([]byte, 6)
+// generates a random room code of given length from the characters of alphabet.
+// every character is picked uniformly with crypto/rand so codes can not be predicted
+func GenerateRoomCode(length int, alphabet string) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+
+	b := make([]byte, length)
 	for i := range b {
-		b[i] = characters[rand.Intn(len(characters))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("could not generate room code: %w", err)
+		}
+
+		b[i] = alphabet[n.Int64()]
 	}
 
-	return string(b)
+	return string(b), nil
 }
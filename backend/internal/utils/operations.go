@@ -1,31 +1,415 @@
 package utils
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"strings"
 
 	"backend/internal/models"
 )
 
-// applies operation (insert/delete) to given content
-func ApplyOperation(content string, operation *models.Operation) string {
+var (
+	ErrUnsupportedOperation = errors.New("operation not supported")
+	ErrInvalidComponent     = errors.New("component must set exactly one of retain, insert and delete")
+	ErrLengthMismatch       = errors.New("compound operation does not cover the document")
+)
+
+// applies operation (insert/delete/compound) to given content.
+// positions past the end of content are clamped, and the operation is updated to
+// match what was actually applied. operations that would split a code point are rejected,
+// and so are compound operations whose components do not cover exactly the whole content
+func ApplyOperation(content string, operation *models.Operation) (string, error) {
+	if operation.Type == "compound" {
+		return applyCompound(content, operation)
+	}
+
+	if operation.Type != "insert" && operation.Type != "delete" {
+		return content, fmt.Errorf("%w: %s", ErrUnsupportedOperation, operation.Type)
+	}
+
+	if operation.Type == "delete" && operation.Length < 0 {
+		return content, ErrInvalidPosition
+	}
+
+	start, err := ByteOffset(content, operation.Position, operation.Unit)
+	if err != nil {
+		return content, err
+	}
+
+	// keep the operation in sync with a clamped position
+	operation.Position, _ = FromByteOffset(content, start, operation.Unit)
+
+	if operation.Type == "insert" {
+		return content[:start] + operation.Text + content[start:], nil
+	}
+
+	end, err := ByteOffset(content, operation.Position+operation.Length, operation.Unit)
+	if err != nil {
+		return content, err
+	}
+
+	operation.Length = TextLength(content[start:end], operation.Unit)
+	operation.DeletedText = content[start:end]
+
+	return content[:start] + content[end:], nil
+}
+
+// applies a compound operation. unlike inserts and deletes it is never clamped, its
+// components must walk over exactly the whole content
+func applyCompound(content string, operation *models.Operation) (string, error) {
+	if err := validateComponents(operation.Components); err != nil {
+		return content, err
+	}
+
+	if err := validateUnit(operation.Unit); err != nil {
+		return content, err
+	}
+
+	length := TextLength(content, operation.Unit)
+	if covered := CompoundLength(*operation); covered != length {
+		return content, fmt.Errorf("%w: it covers %d of %d", ErrLengthMismatch, covered, length)
+	}
+
+	var result strings.Builder
+	position, offset := 0, 0
+
+	for _, component := range operation.Components {
+		if component.Insert != "" {
+			result.WriteString(component.Insert)
+			continue
+		}
+
+		// retained and deleted text both move past content, only retained text is kept
+		position += component.Retain + component.Delete
+
+		end, err := ByteOffset(content, position, operation.Unit)
+		if err != nil {
+			return content, err
+		}
+
+		if component.Retain > 0 {
+			result.WriteString(content[offset:end])
+		}
+		offset = end
+	}
+
+	return result.String(), nil
+}
+
+func validateComponents(components []models.Component) error {
+	if len(components) == 0 {
+		return fmt.Errorf("%w: compound operation has no components", ErrInvalidComponent)
+	}
+
+	for _, component := range components {
+		if component.Retain < 0 || component.Delete < 0 {
+			return ErrInvalidPosition
+		}
+
+		set := 0
+		if component.Retain > 0 {
+			set++
+		}
+		if component.Insert != "" {
+			set++
+		}
+		if component.Delete > 0 {
+			set++
+		}
+
+		if set != 1 {
+			return ErrInvalidComponent
+		}
+	}
+
+	return nil
+}
+
+// length of the content a compound operation applies to, in its unit
+func CompoundLength(operation models.Operation) int {
+	length := 0
+	for _, component := range operation.Components {
+		length += component.Retain + component.Delete
+	}
+
+	return length
+}
+
+// turns a compound operation into the inserts and deletes it is made of, each applying
+// on top of the one before it. other operations are returned as they are
+func ExpandOperation(operation models.Operation) []models.Operation {
+	if operation.Type != "compound" {
+		return []models.Operation{operation}
+	}
+
+	var ops []models.Operation
+	position := 0
+
+	for _, component := range operation.Components {
+		switch {
+		case component.Retain > 0:
+			position += component.Retain
+		case component.Insert != "":
+			ops = append(ops, models.Operation{
+				Type:     "insert",
+				Position: position,
+				Text:     component.Insert,
+				Unit:     operation.Unit,
+				Revision: operation.Revision,
+			})
+			position += TextLength(component.Insert, operation.Unit)
+		case component.Delete > 0:
+			// the text after it moves back to position
+			ops = append(ops, models.Operation{
+				Type:     "delete",
+				Position: position,
+				Length:   component.Delete,
+				Unit:     operation.Unit,
+				Revision: operation.Revision,
+			})
+		}
+	}
+
+	return ops
+}
+
+// expands every compound operation in a sequence, see ExpandOperation
+func ExpandOperations(operations []models.Operation) []models.Operation {
+	expanded := make([]models.Operation, 0, len(operations))
+	for _, operation := range operations {
+		expanded = append(expanded, ExpandOperation(operation)...)
+	}
+
+	return expanded
+}
+
+// checks the parts of an operation that do not depend on the content it is applied to
+func ValidateOperation(operation models.Operation) error {
+	if operation.Type == "compound" {
+		if err := validateComponents(operation.Components); err != nil {
+			return err
+		}
+
+		return validateUnit(operation.Unit)
+	}
+
+	if operation.Type != "insert" && operation.Type != "delete" {
+		return fmt.Errorf("%w: %s", ErrUnsupportedOperation, operation.Type)
+	}
+
+	if operation.Position < 0 || operation.Length < 0 {
+		return ErrInvalidPosition
+	}
+
+	return validateUnit(operation.Unit)
+}
+
+// transforms an operation against the operations that were committed after
+// the revision it was made against, so that it can be applied on top of them.
+// the result can contain more than one operation (a delete is split when text
+// was inserted inside its range) or none at all (its range was already deleted).
+// all operations must have their positions in utf-16 code units
+func TransformOperation(operation models.Operation, committed []models.Operation) []models.Operation {
+	return TransformOperations([]models.Operation{operation}, committed)
+}
+
+// transforms a sequence of operations made against the same revision, see TransformOperation
+func TransformOperations(operations []models.Operation, committed []models.Operation) []models.Operation {
+	transformed, _ := transformLists(operations, committed, false)
+	return transformed
+}
+
+// transforms committed operations so that they apply on top of operations made against
+// the same revision. this is what TransformOperations(operations, committed) looks like
+// from the side that already applied operations, so both sides end up with the same content
+func TransformCommitted(committed []models.Operation, operations []models.Operation) []models.Operation {
+	_, transformed := transformLists(operations, committed, false)
+	return transformed
+}
+
+// builds the operation that reverts given operation right after it was applied.
+// inverting a delete relies on DeletedText, which is filled in when it is applied
+func InvertOperation(operation models.Operation) models.Operation {
+	if operation.Type == "insert" {
+		return models.Operation{
+			Type:        "delete",
+			Position:    operation.Position,
+			Length:      textLength(operation.Text),
+			DeletedText: operation.Text,
+		}
+	}
+
+	return models.Operation{
+		Type:     "insert",
+		Position: operation.Position,
+		Text:     operation.DeletedText,
+	}
+}
+
+// transforms two lists of sequential operations made against the same content.
+// returns a' (to be applied after b) and b' (to be applied after a).
+// aFirst breaks ties between inserts at the same position
+func transformLists(a, b []models.Operation, aFirst bool) ([]models.Operation, []models.Operation) {
+	if len(a) == 0 || len(b) == 0 {
+		return a, b
+	}
+
+	if len(a) == 1 && len(b) == 1 {
+		return transformOne(a[0], b[0], aFirst), transformOne(b[0], a[0], !aFirst)
+	}
+
+	if len(a) > 1 {
+		headA, restB := transformLists(a[:1], b, aFirst)
+		tailA, finalB := transformLists(a[1:], restB, aFirst)
+		return append(headA, tailA...), finalB
+	}
+
+	restA, headB := transformLists(a, b[:1], aFirst)
+	finalA, tailB := transformLists(restA, b[1:], aFirst)
+	return finalA, append(headB, tailB...)
+}
+
+// transforms a single operation a so that it applies after b
+func transformOne(a, b models.Operation, aFirst bool) []models.Operation {
+	switch {
+	case a.Type == "insert" && b.Type == "insert":
+		if b.Position < a.Position || (b.Position == a.Position && !aFirst) {
+			a.Position += textLength(b.Text)
+		}
+
+	case a.Type == "insert" && b.Type == "delete":
+		if a.Position >= b.Position+b.Length {
+			a.Position -= b.Length
+		} else if a.Position > b.Position {
+			// insert was inside the deleted range
+			a.Position = b.Position
+		}
+
+	case a.Type == "delete" && b.Type == "insert":
+		if b.Position <= a.Position {
+			a.Position += textLength(b.Text)
+		} else if b.Position < a.Position+a.Length {
+			// text was inserted inside the deleted range, delete around it
+			before := a
+			before.Length = b.Position - a.Position
+
+			after := a
+			after.Position = a.Position + textLength(b.Text)
+			after.Length = a.Length - before.Length
+
+			return []models.Operation{before, after}
+		}
+
+	case a.Type == "delete" && b.Type == "delete":
+		aEnd := a.Position + a.Length
+		bEnd := b.Position + b.Length
+
+		if aEnd <= b.Position {
+			break
+		}
+
+		if a.Position >= bEnd {
+			a.Position -= b.Length
+			break
+		}
+
+		// ranges overlap, only delete what is left
+		overlap := min(aEnd, bEnd) - max(a.Position, b.Position)
+		a.Length -= overlap
+		a.Position = min(a.Position, b.Position)
+
+		if a.Length <= 0 {
+			return nil
+		}
+	}
+
+	return []models.Operation{a}
+}
+
+// length of inserted text in utf-16 code units, which all committed operations are expressed in
+func textLength(text string) int {
+	return TextLength(text, models.UnitUTF16)
+}
+
+// computes the operations (a delete followed by an insert, both optional) that turn
+// oldContent into newContent, with positions in utf-16 code units
+func DiffOperations(oldContent, newContent string) []models.Operation {
+	prefix := 0
+	for prefix < len(oldContent) && prefix < len(newContent) && oldContent[prefix] == newContent[prefix] {
+		prefix++
+	}
+
+	// back off to the start of a character so it is not split
+	for prefix > 0 && (!isRuneBoundary(oldContent, prefix) || !isRuneBoundary(newContent, prefix)) {
+		prefix--
+	}
+
+	suffix := 0
+	for suffix < len(oldContent)-prefix && suffix < len(newContent)-prefix &&
+		oldContent[len(oldContent)-1-suffix] == newContent[len(newContent)-1-suffix] {
+		suffix++
+	}
+
+	for suffix > 0 && (!isRuneBoundary(oldContent, len(oldContent)-suffix) || !isRuneBoundary(newContent, len(newContent)-suffix)) {
+		suffix--
+	}
+
+	position := TextLength(oldContent[:prefix], models.UnitUTF16)
+	deleted := oldContent[prefix : len(oldContent)-suffix]
+	inserted := newContent[prefix : len(newContent)-suffix]
+
+	var ops []models.Operation
+
+	if deleted != "" {
+		ops = append(ops, models.Operation{
+			Type:     "delete",
+			Position: position,
+			Length:   TextLength(deleted, models.UnitUTF16),
+		})
+	}
+
+	if inserted != "" {
+		ops = append(ops, models.Operation{
+			Type:     "insert",
+			Position: position,
+			Text:     inserted,
+		})
+	}
+
+	return ops
+}
+
+// moves a position (such as a cursor) so that it points at the same text after operation was applied
+func TransformPosition(position int, operation models.Operation) int {
 	switch operation.Type {
 	case "insert":
-		if operation.Position > len(content) {
-			operation.Position = len(content)
+		if position >= operation.Position {
+			return position + textLength(operation.Text)
 		}
-
-		return content[:operation.Position] + operation.Text + content[operation.Position:]
 	case "delete":
-		if operation.Position > len(content) {
-			operation.Position = len(content)
+		if position > operation.Position+operation.Length {
+			return position - operation.Length
+		} else if position > operation.Position {
+			return operation.Position
 		}
+	}
+
+	return position
+}
 
-		end := min(operation.Position+operation.Length, len(content))
+// moves a cursor made against an operation's revision (or an earlier one) past the given operations
+func TransformCursor(cursor models.Cursor, operations []models.Operation) models.Cursor {
+	for _, op := range operations {
+		// the cursor was already set against a later revision
+		if cursor.Revision > op.Revision {
+			continue
+		}
 
-		return content[:operation.Position] + content[end:]
-	default:
-		log.Printf("operation not supported: %s\n", operation.Type)
+		cursor.Position = TransformPosition(cursor.Position, op)
+		cursor.SelectionStart = TransformPosition(cursor.SelectionStart, op)
+		cursor.SelectionEnd = TransformPosition(cursor.SelectionEnd, op)
+		cursor.Revision = op.Revision + 1
 	}
 
-	return content
+	return cursor
 }
@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"backend/internal/models"
+)
+
+// applies an operation to the utf-16 encoding of content, the way the editor does.
+// returns false if the edit would leave half of a surrogate pair behind
+func applyUTF16(content string, op models.Operation) (string, bool) {
+	encoded := utf16.Encode([]rune(content))
+
+	isLowSurrogate := func(i int) bool {
+		return i > 0 && i < len(encoded) && encoded[i] >= 0xDC00 && encoded[i] < 0xE000
+	}
+
+	start := min(op.Position, len(encoded))
+	if isLowSurrogate(start) {
+		return "", false
+	}
+
+	if op.Type == "insert" {
+		result := append([]uint16{}, encoded[:start]...)
+		result = append(result, utf16.Encode([]rune(op.Text))...)
+		result = append(result, encoded[start:]...)
+		return string(utf16.Decode(result)), true
+	}
+
+	end := min(op.Position+op.Length, len(encoded))
+	if isLowSurrogate(end) {
+		return "", false
+	}
+
+	result := append([]uint16{}, encoded[:start]...)
+	result = append(result, encoded[end:]...)
+	return string(utf16.Decode(result)), true
+}
+
+func FuzzApplyOperation(f *testing.F) {
+	f.Add("hello world", "!", 5, 0, true)
+	f.Add("José", "e", 3, 1, false)
+	f.Add("📚 notes", "", 1, 1, false)
+	f.Add("📚 notes", "x", 1, 0, true)
+	f.Add("$\\vec{v}$ → 𝑣", "≈", 11, 0, true)
+	f.Add("👩‍🎓", "", 2, 3, false)
+
+	f.Fuzz(func(t *testing.T, content string, text string, position int, length int, isInsert bool) {
+		if !utf8.ValidString(content) || !utf8.ValidString(text) {
+			return
+		}
+
+		op := models.Operation{Type: "delete", Position: position, Length: length}
+		if isInsert {
+			op = models.Operation{Type: "insert", Position: position, Text: text}
+		}
+
+		got, err := ApplyOperation(content, &op)
+
+		if position < 0 || (!isInsert && length < 0) {
+			if !errors.Is(err, ErrInvalidPosition) {
+				t.Fatalf("expected invalid position error for %+v, got %v", op, err)
+			}
+			return
+		}
+
+		want, ok := applyUTF16(content, op)
+		if !ok {
+			if !errors.Is(err, ErrSplitsCodePoint) {
+				t.Fatalf("expected %+v on %q to be rejected, got %q, %v", op, content, got, err)
+			}
+			return
+		}
+
+		if err != nil {
+			t.Fatalf("could not apply %+v to %q: %v", op, content, err)
+		}
+
+		if got != want {
+			t.Fatalf("applying %+v to %q: got %q, want %q", op, content, got, want)
+		}
+
+		if !utf8.ValidString(got) {
+			t.Fatalf("applying %+v to %q produced invalid utf-8 %q", op, content, got)
+		}
+	})
+}
+
+// builds a valid utf-16 operation on content from fuzzed values, or returns false
+func fuzzedOperation(content string, text string, position int, length int, isInsert bool) (models.Operation, bool) {
+	size := TextLength(content, models.UnitUTF16)
+	if position < 0 || length < 0 || position > size {
+		return models.Operation{}, false
+	}
+
+	op := models.Operation{Type: "insert", Position: position, Text: text}
+	if !isInsert {
+		op = models.Operation{Type: "delete", Position: position, Length: min(length, size-position)}
+	}
+
+	if _, err := ApplyOperation(content, &op); err != nil {
+		return models.Operation{}, false
+	}
+
+	return op, true
+}
+
+func applyAll(t *testing.T, content string, ops []models.Operation) string {
+	for i := range ops {
+		var err error
+		content, err = ApplyOperation(content, &ops[i])
+		if err != nil {
+			t.Fatalf("could not apply transformed %+v to %q: %v", ops[i], content, err)
+		}
+	}
+
+	return content
+}
+
+func FuzzTransformOperation(f *testing.F) {
+	f.Add("José 📚", "é", 5, 0, true, "😀", 5, 0, true)
+	f.Add("José 📚", "", 1, 4, false, "ü", 3, 0, true)
+	f.Add("𝔽𝕠𝕦𝕣𝕚𝕖𝕣", "", 2, 6, false, "", 4, 6, false)
+	f.Add("∫ f(x) dx", "∂", 0, 0, true, "", 0, 3, false)
+
+	f.Fuzz(func(t *testing.T, content string,
+		aText string, aPosition int, aLength int, aInsert bool,
+		bText string, bPosition int, bLength int, bInsert bool,
+	) {
+		if !utf8.ValidString(content) || !utf8.ValidString(aText) || !utf8.ValidString(bText) {
+			return
+		}
+
+		a, ok := fuzzedOperation(content, aText, aPosition, aLength, aInsert)
+		if !ok {
+			return
+		}
+
+		b, ok := fuzzedOperation(content, bText, bPosition, bLength, bInsert)
+		if !ok {
+			return
+		}
+
+		// b was committed first, a arrives against the same revision
+		serverSide := applyAll(t, applyAll(t, content, []models.Operation{b}), TransformOperation(a, []models.Operation{b}))
+
+		// the author of a applied it locally, then receives b transformed against it
+		_, bAfterA := transformLists([]models.Operation{a}, []models.Operation{b}, false)
+		clientSide := applyAll(t, applyAll(t, content, []models.Operation{a}), bAfterA)
+
+		if serverSide != clientSide {
+			t.Fatalf("%q with a=%+v b=%+v diverged: server %q, client %q", content, a, b, serverSide, clientSide)
+		}
+	})
+}
+
+func FuzzTransformCommitted(f *testing.F) {
+	f.Add("José 📚", "é", 5, 0, true, "", 0, 2, false, "😀", 5, 0, true, "ü", 1, 0, true)
+	f.Add("𝔽𝕠𝕦𝕣𝕚𝕖𝕣", "", 2, 6, false, "x", 3, 0, true, "", 4, 6, false, "", 0, 2, false)
+	f.Add("∫ f(x) dx", "∂", 0, 0, true, "", 1, 3, false, "", 0, 3, false, "g", 2, 0, true)
+
+	f.Fuzz(func(t *testing.T, content string,
+		a1Text string, a1Position int, a1Length int, a1Insert bool,
+		a2Text string, a2Position int, a2Length int, a2Insert bool,
+		b1Text string, b1Position int, b1Length int, b1Insert bool,
+		b2Text string, b2Position int, b2Length int, b2Insert bool,
+	) {
+		for _, text := range []string{content, a1Text, a2Text, b1Text, b2Text} {
+			if !utf8.ValidString(text) {
+				return
+			}
+		}
+
+		// pending operations of a client and the history committed meanwhile, each made on top
+		// of the one before it, starting from the same content
+		a1, ok := fuzzedOperation(content, a1Text, a1Position, a1Length, a1Insert)
+		if !ok {
+			return
+		}
+
+		a2, ok := fuzzedOperation(applyAll(t, content, []models.Operation{a1}), a2Text, a2Position, a2Length, a2Insert)
+		if !ok {
+			return
+		}
+
+		b1, ok := fuzzedOperation(content, b1Text, b1Position, b1Length, b1Insert)
+		if !ok {
+			return
+		}
+
+		b2, ok := fuzzedOperation(applyAll(t, content, []models.Operation{b1}), b2Text, b2Position, b2Length, b2Insert)
+		if !ok {
+			return
+		}
+
+		pending := []models.Operation{a1, a2}
+		history := []models.Operation{b1, b2}
+
+		// the server applies the history, then the pending operations transformed against it
+		serverSide := applyAll(t, applyAll(t, content, history), TransformOperations(pending, history))
+
+		// the client applied its pending operations, then receives the history transformed against them
+		clientSide := applyAll(t, applyAll(t, content, pending), TransformCommitted(history, pending))
+
+		if serverSide != clientSide {
+			t.Fatalf("%q with pending=%+v history=%+v diverged: server %q, client %q", content, pending, history, serverSide, clientSide)
+		}
+	})
+}
+
+func FuzzApplyCompound(f *testing.F) {
+	f.Add("hello world", 0, 5, "goodbye", 1, "!")
+	f.Add("1. one\n1. two\n1. three", 0, 1, "1", 6, "2")
+	f.Add("José 📚 notes", 3, 1, "e", 2, "📖")
+	f.Add("𝔽𝕠𝕦𝕣", 1, 2, "", 0, "x")
+
+	f.Fuzz(func(t *testing.T, content string, position int, length int, text string, gap int, other string) {
+		if !utf8.ValidString(content) || !utf8.ValidString(text) || !utf8.ValidString(other) {
+			return
+		}
+
+		size := TextLength(content, models.UnitUTF16)
+		if position < 0 || length < 0 || gap < 0 || position+length+gap > size {
+			return
+		}
+
+		// replaces a range, then inserts further on
+		var components []models.Component
+		for _, component := range []models.Component{
+			{Retain: position},
+			{Delete: length},
+			{Insert: text},
+			{Retain: gap},
+			{Insert: other},
+			{Retain: size - position - length - gap},
+		} {
+			if component != (models.Component{}) {
+				components = append(components, component)
+			}
+		}
+
+		if len(components) == 0 {
+			return
+		}
+
+		op := models.Operation{Type: "compound", Components: components}
+
+		got, err := ApplyOperation(content, &op)
+		if errors.Is(err, ErrSplitsCodePoint) {
+			return
+		}
+
+		if err != nil {
+			t.Fatalf("could not apply %+v to %q: %v", op, content, err)
+		}
+
+		if want := applyAll(t, content, ExpandOperation(op)); got != want {
+			t.Fatalf("applying %+v to %q: got %q, expanded gives %q", op, content, got, want)
+		}
+
+		op.Components = append(op.Components, models.Component{Retain: 1})
+		if _, err := ApplyOperation(content, &op); !errors.Is(err, ErrLengthMismatch) {
+			t.Fatalf("expected %+v on %q to be rejected for its length, got %v", op, content, err)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"backend/internal/models"
+)
+
+var (
+	ErrSplitsCodePoint = errors.New("position splits a code point")
+	ErrInvalidPosition = errors.New("position must not be negative")
+	ErrUnknownUnit     = errors.New("unknown position unit")
+)
+
+// width of a rune that takes size bytes in the given unit
+func unitWidth(r rune, size int, unit string) int {
+	switch unit {
+	case models.UnitByte:
+		return size
+	case models.UnitRune:
+		return 1
+	default:
+		// runes outside the basic multilingual plane are a surrogate pair in utf-16
+		if r > 0xFFFF {
+			return 2
+		}
+		return 1
+	}
+}
+
+func validateUnit(unit string) error {
+	switch unit {
+	case "", models.UnitUTF16, models.UnitRune, models.UnitByte:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnknownUnit, unit)
+}
+
+// converts a position in given unit to a byte offset in content.
+// positions past the end of content are clamped to its length
+func ByteOffset(content string, position int, unit string) (int, error) {
+	if err := validateUnit(unit); err != nil {
+		return 0, err
+	}
+
+	if position < 0 {
+		return 0, ErrInvalidPosition
+	}
+
+	units := 0
+	for offset := 0; offset < len(content); {
+		if units == position {
+			return offset, nil
+		}
+
+		r, size := utf8.DecodeRuneInString(content[offset:])
+		units += unitWidth(r, size, unit)
+		if units > position {
+			return 0, ErrSplitsCodePoint
+		}
+
+		offset += size
+	}
+
+	return len(content), nil
+}
+
+// converts a byte offset in content to a position in given unit
+func FromByteOffset(content string, offset int, unit string) (int, error) {
+	if err := validateUnit(unit); err != nil {
+		return 0, err
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidPosition
+	}
+
+	offset = min(offset, len(content))
+	if offset < len(content) && !isRuneBoundary(content, offset) {
+		return 0, ErrSplitsCodePoint
+	}
+
+	return TextLength(content[:offset], unit), nil
+}
+
+// length of text in given unit
+func TextLength(text string, unit string) int {
+	length := 0
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		length += unitWidth(r, size, unit)
+		text = text[size:]
+	}
+
+	return length
+}
+
+// checks that offset is where a rune starts when walking content rune by rune
+func isRuneBoundary(content string, offset int) bool {
+	for i := range content {
+		if i >= offset {
+			return i == offset
+		}
+	}
+
+	return offset == len(content)
+}
+
+// converts position and length of an operation made against content to given unit
+func ConvertOperation(content string, op models.Operation, unit string) (models.Operation, error) {
+	start, err := ByteOffset(content, op.Position, op.Unit)
+	if err != nil {
+		return op, err
+	}
+
+	end := start
+	if op.Type == "delete" {
+		end, err = ByteOffset(content, op.Position+op.Length, op.Unit)
+		if err != nil {
+			return op, err
+		}
+	}
+
+	converted := op
+	converted.Unit = unit
+	if unit == models.UnitUTF16 {
+		converted.Unit = ""
+	}
+
+	converted.Position, err = FromByteOffset(content, start, unit)
+	if err != nil {
+		return op, err
+	}
+
+	if op.Type == "delete" {
+		converted.Length = TextLength(content[start:end], unit)
+	}
+
+	return converted, nil
+}
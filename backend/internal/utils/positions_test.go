@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"unicode/utf8"
+
+	"backend/internal/models"
+)
+
+var units = []string{models.UnitUTF16, models.UnitRune, models.UnitByte}
+
+func addUnicodeSeeds(f *testing.F) {
+	f.Add("", 0)
+	f.Add("hello world", 5)
+	f.Add("José and Zoë", 4)
+	f.Add("$\\alpha \\in \\mathbb{R}$ → ∞", 12)
+	f.Add("notes 📚 with emoji 👩‍🎓", 7)
+	f.Add("𝔽𝕠𝕦𝕣𝕚𝕖𝕣", 3)
+	f.Add("bad \xff bytes", 5)
+}
+
+func FuzzByteOffset(f *testing.F) {
+	addUnicodeSeeds(f)
+
+	f.Fuzz(func(t *testing.T, content string, position int) {
+		for _, unit := range units {
+			offset, err := ByteOffset(content, position, unit)
+			if position < 0 {
+				if !errors.Is(err, ErrInvalidPosition) {
+					t.Fatalf("%s: expected invalid position error for %d, got %v", unit, position, err)
+				}
+				continue
+			}
+
+			if errors.Is(err, ErrSplitsCodePoint) {
+				if unit == models.UnitRune {
+					t.Fatalf("rune positions can never split a code point")
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", unit, err)
+			}
+
+			if utf8.ValidString(content) && !utf8.ValidString(content[:offset]) {
+				t.Fatalf("%s: offset %d for position %d splits %q", unit, offset, position, content)
+			}
+
+			back, err := FromByteOffset(content, offset, unit)
+			if err != nil {
+				t.Fatalf("%s: could not convert offset %d back: %v", unit, offset, err)
+			}
+
+			if want := min(position, TextLength(content, unit)); back != want {
+				t.Fatalf("%s: position %d became offset %d and back %d, want %d", unit, position, offset, back, want)
+			}
+		}
+	})
+}
+
+func FuzzConvertOperation(f *testing.F) {
+	f.Add("José 📚 $\\sum$", 2, 4, true)
+	f.Add("👩‍🎓👩‍🎓", 1, 2, false)
+	f.Add("", 0, 0, true)
+
+	f.Fuzz(func(t *testing.T, content string, position int, length int, isDelete bool) {
+		if !utf8.ValidString(content) || position < 0 || length < 0 {
+			return
+		}
+
+		op := models.Operation{Type: "insert", Position: position, Text: "ü😀", Unit: models.UnitRune}
+		if isDelete {
+			op = models.Operation{Type: "delete", Position: position, Length: length, Unit: models.UnitRune}
+		}
+
+		want, err := ApplyOperation(content, &op)
+		if err != nil {
+			t.Fatalf("rune operation %+v failed on %q: %v", op, content, err)
+		}
+
+		// the same edit expressed in every other unit must give the same result
+		for _, unit := range units {
+			converted, err := ConvertOperation(content, op, unit)
+			if err != nil {
+				t.Fatalf("could not convert %+v to %s: %v", op, unit, err)
+			}
+
+			got, err := ApplyOperation(content, &converted)
+			if err != nil {
+				t.Fatalf("converted operation %+v failed: %v", converted, err)
+			}
+
+			if got != want {
+				t.Fatalf("%s: got %q, want %q", unit, got, want)
+			}
+		}
+	})
+}
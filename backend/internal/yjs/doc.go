@@ -0,0 +1,879 @@
+package yjs
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	"backend/internal/models"
+	"backend/internal/utils"
+)
+
+// a yjs document as the server keeps it. it integrates updates the way yjs does, so that it
+// ends up with the same content as the clients, and can make edits of its own to text types.
+// it is not safe for concurrent use
+
+var ErrPositionOutOfRange = errors.New("position is outside of the text")
+
+type item struct {
+	id     ID
+	length uint64
+	// garbage collected: deleted content that is only known by its clocks
+	gc bool
+	// a gap in an update, never stored
+	skip bool
+
+	// neighbours at the time the item was inserted, which decide where it goes
+	origin      *ID
+	rightOrigin *ID
+	// neighbours now, deleted items included
+	left  *item
+	right *item
+
+	parent *ytype
+	// parent as sent, until it is looked up: name of a root type or id of the item holding the type
+	parentName *string
+	parentID   *ID
+	// key of the item in its parent map, nil for items of a sequence
+	parentSub *string
+
+	content content
+	deleted bool
+}
+
+func (it *item) lastID() ID {
+	return ID{it.id.Client, it.id.Clock + it.length - 1}
+}
+
+func (it *item) isText() bool {
+	_, ok := it.content.(*stringContent)
+	return ok
+}
+
+// a shared type, such as the text of an editor. it holds a sequence of items and a map of the
+// items set for each key, only one of which is used by a given type
+type ytype struct {
+	start   *item
+	entries map[string]*item
+	// item holding the type, nil for root types
+	item *item
+	// name of a root type
+	name string
+}
+
+type Doc struct {
+	// client id the document makes its own edits under
+	ClientID uint64
+
+	// structs of each client, ordered by clock and without gaps
+	clients map[uint64][]*item
+	share   map[string]*ytype
+
+	// structs and deletes whose dependencies are not known yet
+	pending        map[uint64][]*item
+	pendingDeletes []deleteRange
+
+	txn *transaction
+}
+
+// what changed while applying an update or making edits
+type transaction struct {
+	// clocks the document had of each client before
+	before map[uint64]uint64
+	// items that were deleted
+	deleted map[*item]bool
+	// whether a surrogate pair was cut in half, which changes text that is neither inserted nor deleted
+	splitPair bool
+}
+
+func NewDoc(clientID uint64) *Doc {
+	return &Doc{
+		ClientID: clientID,
+		clients:  make(map[uint64][]*item),
+		share:    make(map[string]*ytype),
+		pending:  make(map[uint64][]*item),
+	}
+}
+
+func (d *Doc) begin() {
+	d.txn = &transaction{before: d.StateVector(), deleted: make(map[*item]bool)}
+}
+
+// the content of deleted items is no longer needed once everyone was told what was deleted
+func (d *Doc) end() {
+	for it := range d.txn.deleted {
+		if _, ok := it.content.(*typeContent); !ok {
+			it.content = &deletedContent{it.length}
+		}
+	}
+
+	d.txn = nil
+}
+
+// integrates an update sent by a client
+func (d *Doc) ApplyUpdate(update []byte) error {
+	_, err := d.applyUpdate(update, "")
+	return err
+}
+
+// integrates an update sent by a client and returns how the root text type called name changed,
+// as inserts and deletes with utf-16 positions, each applying to the text the ones before it left
+func (d *Doc) ApplyTextUpdate(update []byte, name string) ([]models.Operation, error) {
+	return d.applyUpdate(update, name)
+}
+
+func (d *Doc) applyUpdate(data []byte, name string) ([]models.Operation, error) {
+	u, err := decodeUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var before string
+	if name != "" {
+		before = d.Text(name)
+	}
+
+	d.begin()
+	defer d.end()
+
+	// structs that were waiting may be complete now
+	for client, structs := range d.pending {
+		u.structs[client] = append(u.structs[client], structs...)
+	}
+	d.pending = make(map[uint64][]*item)
+
+	d.integrateStructs(u.structs)
+	d.pendingDeletes = d.applyDeletes(append(d.pendingDeletes, u.deletes...))
+
+	if name == "" {
+		return nil, nil
+	}
+
+	if d.txn.splitPair {
+		return utils.DiffOperations(before, d.Text(name)), nil
+	}
+
+	return d.textChanges(name), nil
+}
+
+// integrates structs once everything they depend on is known, in whatever order that takes.
+// the rest is kept for later updates
+func (d *Doc) integrateStructs(structs map[uint64][]*item) {
+	for _, queue := range structs {
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].id.Clock < queue[j].id.Clock })
+	}
+
+	resolving := make(map[uint64]bool)
+
+	// integrates structs of client until the document knows clock
+	var reach func(client, clock uint64) bool
+	reach = func(client, clock uint64) bool {
+		for d.state(client) <= clock {
+			queue := structs[client]
+			if len(queue) == 0 || resolving[client] {
+				return false
+			}
+
+			head := queue[0]
+			state := d.state(client)
+			if head.id.Clock > state {
+				// something in between is missing
+				return false
+			}
+
+			if head.id.Clock+head.length <= state {
+				// already known
+				structs[client] = queue[1:]
+				continue
+			}
+
+			resolving[client] = true
+			ok := d.dependenciesKnown(head, state, reach)
+			resolving[client] = false
+			if !ok {
+				return false
+			}
+
+			structs[client] = queue[1:]
+			d.integrate(head)
+		}
+
+		return true
+	}
+
+	clients := make([]uint64, 0, len(structs))
+	for client := range structs {
+		clients = append(clients, client)
+	}
+	slices.Sort(clients)
+
+	for _, client := range clients {
+		for len(structs[client]) > 0 {
+			last := structs[client][len(structs[client])-1]
+			if !reach(client, last.lastID().Clock) {
+				break
+			}
+
+			// structs the document already knew, e.g. of an update that was sent twice
+			state := d.state(client)
+			structs[client] = slices.DeleteFunc(structs[client], func(s *item) bool {
+				return s.id.Clock+s.length <= state
+			})
+		}
+	}
+
+	for client, queue := range structs {
+		if len(queue) > 0 {
+			d.pending[client] = queue
+		}
+	}
+}
+
+func (d *Doc) dependenciesKnown(s *item, state uint64, reach func(client, clock uint64) bool) bool {
+	if s.gc {
+		return true
+	}
+
+	for _, dep := range []*ID{s.origin, s.rightOrigin, s.parentID} {
+		if dep == nil {
+			continue
+		}
+
+		if dep.Client == s.id.Client {
+			// only what came before it
+			if dep.Clock >= state {
+				return false
+			}
+			continue
+		}
+
+		if !reach(dep.Client, dep.Clock) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// places a struct in the document. parts of it that are already known are cut off
+func (d *Doc) integrate(it *item) {
+	var offset uint64
+	if state := d.state(it.id.Client); it.id.Clock < state {
+		offset = state - it.id.Clock
+	}
+
+	if it.gc {
+		it.id.Clock += offset
+		it.length -= offset
+		d.addStruct(it)
+		return
+	}
+
+	if it.origin != nil {
+		it.left = d.cleanEnd(*it.origin)
+		origin := it.left.lastID()
+		it.origin = &origin
+	}
+
+	if it.rightOrigin != nil {
+		it.right = d.cleanStart(*it.rightOrigin)
+		rightOrigin := it.right.id
+		it.rightOrigin = &rightOrigin
+	}
+
+	switch {
+	case (it.left != nil && it.left.gc) || (it.right != nil && it.right.gc):
+		it.parent = nil
+	case it.parentName != nil:
+		it.parent = d.rootType(*it.parentName)
+	case it.parentID != nil:
+		it.parent = nil
+		if parent := d.getItem(*it.parentID); parent != nil && !parent.gc {
+			if c, ok := parent.content.(*typeContent); ok {
+				it.parent = c.t
+			}
+		}
+	case it.left != nil:
+		it.parent = it.left.parent
+		it.parentSub = it.left.parentSub
+	case it.right != nil:
+		it.parent = it.right.parent
+		it.parentSub = it.right.parentSub
+	}
+
+	if offset > 0 {
+		it.id.Clock += offset
+		it.left = d.cleanEnd(ID{it.id.Client, it.id.Clock - 1})
+		origin := it.left.lastID()
+		it.origin = &origin
+		it.content = it.content.splice(offset)
+		it.length -= offset
+	}
+
+	if it.parent == nil {
+		// its parent is gone, only its clocks are kept
+		*it = item{id: it.id, length: it.length, gc: true}
+		d.addStruct(it)
+		return
+	}
+
+	d.place(it)
+	d.addStruct(it)
+
+	if c, ok := it.content.(*typeContent); ok {
+		c.t.item = it
+	}
+
+	if _, ok := it.content.(*deletedContent); ok {
+		it.deleted = true
+	}
+
+	// the parent was deleted, or a later value was set for the key
+	if (it.parent.item != nil && it.parent.item.deleted) || (it.parentSub != nil && it.right != nil) {
+		d.deleteItem(it)
+	}
+}
+
+// finds where an item goes between its origins, resolving conflicts with items inserted at the
+// same place concurrently the way yjs does (YATA), and links it with its neighbours
+func (d *Doc) place(it *item) {
+	parent := it.parent
+
+	if (it.left == nil && (it.right == nil || it.right.left != nil)) || (it.left != nil && it.left.right != it.right) {
+		left := it.left
+
+		var o *item
+		switch {
+		case left != nil:
+			o = left.right
+		case it.parentSub != nil:
+			o = parent.entries[*it.parentSub]
+			for o != nil && o.left != nil {
+				o = o.left
+			}
+		default:
+			o = parent.start
+		}
+
+		conflicting := make(map[*item]bool)
+		beforeOrigin := make(map[*item]bool)
+
+		for o != nil && o != it.right {
+			beforeOrigin[o] = true
+			conflicting[o] = true
+
+			if sameID(it.origin, o.origin) {
+				if o.id.Client < it.id.Client {
+					left = o
+					clear(conflicting)
+				} else if sameID(it.rightOrigin, o.rightOrigin) {
+					break
+				}
+			} else if o.origin != nil && beforeOrigin[d.getItem(*o.origin)] {
+				if !conflicting[d.getItem(*o.origin)] {
+					left = o
+					clear(conflicting)
+				}
+			} else {
+				break
+			}
+
+			o = o.right
+		}
+
+		it.left = left
+	}
+
+	if it.left != nil {
+		it.right = it.left.right
+		it.left.right = it
+	} else {
+		var r *item
+		if it.parentSub != nil {
+			r = parent.entries[*it.parentSub]
+			for r != nil && r.left != nil {
+				r = r.left
+			}
+		} else {
+			r = parent.start
+			parent.start = it
+		}
+		it.right = r
+	}
+
+	if it.right != nil {
+		it.right.left = it
+	} else if it.parentSub != nil {
+		// the latest value of a key replaces the one before it
+		parent.entries[*it.parentSub] = it
+		if it.left != nil {
+			d.deleteItem(it.left)
+		}
+	}
+}
+
+func sameID(a, b *ID) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+func (d *Doc) rootType(name string) *ytype {
+	t, ok := d.share[name]
+	if !ok {
+		t = &ytype{entries: make(map[string]*item), name: name}
+		d.share[name] = t
+	}
+
+	return t
+}
+
+// the clock of the next struct the document expects from client
+func (d *Doc) state(client uint64) uint64 {
+	structs := d.clients[client]
+	if len(structs) == 0 {
+		return 0
+	}
+
+	return structs[len(structs)-1].lastID().Clock + 1
+}
+
+func (d *Doc) StateVector() map[uint64]uint64 {
+	sv := make(map[uint64]uint64, len(d.clients))
+	for client := range d.clients {
+		sv[client] = d.state(client)
+	}
+
+	return sv
+}
+
+func (d *Doc) EncodeStateVector() []byte {
+	return encodeStateVector(d.StateVector())
+}
+
+func (d *Doc) addStruct(s *item) {
+	d.clients[s.id.Client] = append(d.clients[s.id.Client], s)
+}
+
+// index of the struct of structs that holds clock, which must be known
+func findIndex(structs []*item, clock uint64) int {
+	return sort.Search(len(structs), func(i int) bool {
+		return structs[i].lastID().Clock >= clock
+	})
+}
+
+// gets the struct that holds id, nil if it is not known
+func (d *Doc) getItem(id ID) *item {
+	structs := d.clients[id.Client]
+	i := findIndex(structs, id.Clock)
+	if i == len(structs) || structs[i].id.Clock > id.Clock {
+		return nil
+	}
+
+	return structs[i]
+}
+
+// gets the item that starts at id, splitting the one that holds it if needed
+func (d *Doc) cleanStart(id ID) *item {
+	structs := d.clients[id.Client]
+	i := findIndex(structs, id.Clock)
+	s := structs[i]
+
+	if s.id.Clock < id.Clock && !s.gc {
+		return d.split(s, id.Clock-s.id.Clock)
+	}
+
+	return s
+}
+
+// gets the item that ends at id, splitting the one that holds it if needed
+func (d *Doc) cleanEnd(id ID) *item {
+	structs := d.clients[id.Client]
+	i := findIndex(structs, id.Clock)
+	s := structs[i]
+
+	if s.lastID().Clock != id.Clock && !s.gc {
+		d.split(s, id.Clock-s.id.Clock+1)
+	}
+
+	return s
+}
+
+// cuts an item in two at diff and returns the second part
+func (d *Doc) split(left *item, diff uint64) *item {
+	if c, ok := left.content.(*stringContent); ok && d.txn != nil && isHighSurrogate(c.units[diff-1]) {
+		d.txn.splitPair = true
+	}
+
+	right := &item{
+		id:          ID{left.id.Client, left.id.Clock + diff},
+		length:      left.length - diff,
+		origin:      &ID{left.id.Client, left.id.Clock + diff - 1},
+		rightOrigin: left.rightOrigin,
+		left:        left,
+		right:       left.right,
+		parent:      left.parent,
+		parentSub:   left.parentSub,
+		content:     left.content.splice(diff),
+		deleted:     left.deleted,
+	}
+
+	left.length = diff
+	left.right = right
+	if right.right != nil {
+		right.right.left = right
+	} else if right.parentSub != nil {
+		right.parent.entries[*right.parentSub] = right
+	}
+
+	if d.txn != nil && d.txn.deleted[left] {
+		d.txn.deleted[right] = true
+	}
+
+	structs := d.clients[left.id.Client]
+	i := findIndex(structs, left.id.Clock)
+	d.clients[left.id.Client] = slices.Insert(structs, i+1, right)
+
+	return right
+}
+
+// deletes the given clock ranges. returns the parts the document does not know yet
+func (d *Doc) applyDeletes(ranges []deleteRange) []deleteRange {
+	var unknown []deleteRange
+
+	for _, r := range ranges {
+		end := r.clock + r.length
+		state := d.state(r.client)
+
+		if end > state {
+			start := max(r.clock, state)
+			unknown = append(unknown, deleteRange{r.client, start, end - start})
+			end = state
+		}
+
+		if r.clock >= end {
+			continue
+		}
+
+		i := findIndex(d.clients[r.client], r.clock)
+		if s := d.clients[r.client][i]; !s.gc && !s.deleted && s.id.Clock < r.clock {
+			d.split(s, r.clock-s.id.Clock)
+			i++
+		}
+
+		for ; i < len(d.clients[r.client]); i++ {
+			s := d.clients[r.client][i]
+			if s.id.Clock >= end {
+				break
+			}
+
+			if s.gc || s.deleted {
+				continue
+			}
+
+			if end < s.id.Clock+s.length {
+				d.split(s, end-s.id.Clock)
+			}
+
+			d.deleteItem(s)
+		}
+	}
+
+	return unknown
+}
+
+// deletes an item, and everything in it if it holds a type
+func (d *Doc) deleteItem(it *item) {
+	if it.deleted {
+		return
+	}
+
+	it.deleted = true
+	if d.txn != nil {
+		d.txn.deleted[it] = true
+	}
+
+	if c, ok := it.content.(*typeContent); ok {
+		for child := c.t.start; child != nil; child = child.right {
+			d.deleteItem(child)
+		}
+
+		for _, child := range c.t.entries {
+			d.deleteItem(child)
+		}
+	}
+}
+
+// how the text of a root type changed in the current transaction. items that were there before
+// have clocks the document already knew, and items deleted in it were visible before
+func (d *Doc) textChanges(name string) []models.Operation {
+	t, ok := d.share[name]
+	if !ok {
+		return nil
+	}
+
+	var ops []models.Operation
+	position := 0
+
+	for it := t.start; it != nil; it = it.right {
+		if !it.isText() {
+			continue
+		}
+
+		existed := it.id.Clock < d.txn.before[it.id.Client]
+		visibleBefore := existed && (!it.deleted || d.txn.deleted[it])
+		length := int(it.length)
+
+		switch {
+		case visibleBefore && !it.deleted:
+			position += length
+		case visibleBefore:
+			ops = appendDelete(ops, position, length)
+		case !it.deleted:
+			ops = appendInsert(ops, position, fromUTF16(it.content.(*stringContent).units))
+			position += length
+		}
+	}
+
+	return ops
+}
+
+// adds a delete, joining it with the one before if they are at the same place
+func appendDelete(ops []models.Operation, position int, length int) []models.Operation {
+	if n := len(ops); n > 0 && ops[n-1].Type == "delete" && ops[n-1].Position == position {
+		ops[n-1].Length += length
+		return ops
+	}
+
+	return append(ops, models.Operation{Type: "delete", Position: position, Length: length})
+}
+
+// adds an insert, joining it with the one before if it continues it
+func appendInsert(ops []models.Operation, position int, text string) []models.Operation {
+	if n := len(ops); n > 0 && ops[n-1].Type == "insert" && ops[n-1].Position+len(toUTF16(ops[n-1].Text)) == position {
+		ops[n-1].Text += text
+		return ops
+	}
+
+	return append(ops, models.Operation{Type: "insert", Position: position, Text: text})
+}
+
+// gets the text of a root text type, embeds and formatting left out
+func (d *Doc) Text(name string) string {
+	t, ok := d.share[name]
+	if !ok {
+		return ""
+	}
+
+	var units []uint16
+	for it := t.start; it != nil; it = it.right {
+		if !it.deleted && it.isText() {
+			units = append(units, it.content.(*stringContent).units...)
+		}
+	}
+
+	return fromUTF16(units)
+}
+
+// makes the server's own edits to the root text type called name: inserts and deletes with
+// utf-16 positions, each applying to the text the ones before it left. returns the update
+// for the other copies of the document, nil if nothing changed
+func (d *Doc) ApplyOperations(name string, ops []models.Operation) ([]byte, error) {
+	d.begin()
+	defer d.end()
+
+	t := d.rootType(name)
+
+	for _, op := range ops {
+		if op.Position < 0 {
+			return nil, ErrPositionOutOfRange
+		}
+
+		var err error
+		switch op.Type {
+		case "insert":
+			err = d.insertText(t, uint64(op.Position), toUTF16(op.Text))
+		case "delete":
+			err = d.deleteText(t, uint64(op.Position), uint64(max(op.Length, 0)))
+		default:
+			err = fmt.Errorf("operation type %q can not be applied to yjs text", op.Type)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return d.encodeTransaction(), nil
+}
+
+func (d *Doc) insertText(t *ytype, index uint64, units []uint16) error {
+	if len(units) == 0 {
+		return nil
+	}
+
+	var left *item
+	right := t.start
+
+	for right != nil && index > 0 {
+		if !right.deleted && right.isText() {
+			if index < right.length {
+				d.split(right, index)
+			}
+			index -= right.length
+		}
+
+		left, right = right, right.right
+	}
+
+	if index > 0 {
+		return ErrPositionOutOfRange
+	}
+
+	// like yjs, text goes after deleted items rather than before them
+	for right != nil && right.deleted {
+		left, right = right, right.right
+	}
+
+	it := &item{
+		id:      ID{d.ClientID, d.state(d.ClientID)},
+		length:  uint64(len(units)),
+		parent:  t,
+		content: &stringContent{units},
+	}
+
+	if left != nil {
+		origin := left.lastID()
+		it.origin = &origin
+	}
+
+	if right != nil {
+		rightOrigin := right.id
+		it.rightOrigin = &rightOrigin
+	}
+
+	it.left, it.right = left, right
+	d.place(it)
+	d.addStruct(it)
+
+	return nil
+}
+
+func (d *Doc) deleteText(t *ytype, index uint64, length uint64) error {
+	for it := t.start; it != nil && length > 0; it = it.right {
+		if it.deleted || !it.isText() {
+			continue
+		}
+
+		if index >= it.length {
+			index -= it.length
+			continue
+		}
+
+		if index > 0 {
+			// the rest of it comes next
+			d.split(it, index)
+			index = 0
+			continue
+		}
+
+		if length < it.length {
+			d.split(it, length)
+		}
+
+		length -= it.length
+		d.deleteItem(it)
+	}
+
+	if index > 0 || length > 0 {
+		return ErrPositionOutOfRange
+	}
+
+	return nil
+}
+
+// encodes the structs and deletes of the current transaction
+func (d *Doc) encodeTransaction() []byte {
+	var deletes []deleteRange
+	for it := range d.txn.deleted {
+		deletes = append(deletes, deleteRange{it.id.Client, it.id.Clock, it.length})
+	}
+
+	if len(deletes) == 0 && d.state(d.ClientID) == d.txn.before[d.ClientID] {
+		return nil
+	}
+
+	e := &encoder{}
+	d.writeStructs(e, d.txn.before, []uint64{d.ClientID})
+	writeDeleteSet(e, deletes)
+
+	return e.data
+}
+
+// encodes everything the document has that a copy with state vector sv misses. without a state
+// vector that is the whole document
+func (d *Doc) EncodeStateAsUpdate(sv map[uint64]uint64) []byte {
+	clients := make([]uint64, 0, len(d.clients))
+	for client := range d.clients {
+		clients = append(clients, client)
+	}
+	slices.Sort(clients)
+	slices.Reverse(clients)
+
+	e := &encoder{}
+	d.writeStructs(e, sv, clients)
+	writeDeleteSet(e, d.deleteSet())
+
+	return e.data
+}
+
+// writes the structs of clients that a copy with state vector sv misses
+func (d *Doc) writeStructs(e *encoder, sv map[uint64]uint64, clients []uint64) {
+	var missing []uint64
+	for _, client := range clients {
+		if d.state(client) > sv[client] {
+			missing = append(missing, client)
+		}
+	}
+
+	e.writeVarUint(uint64(len(missing)))
+	for _, client := range missing {
+		structs := d.clients[client]
+		clock := sv[client]
+		i := findIndex(structs, clock)
+
+		e.writeVarUint(uint64(len(structs) - i))
+		e.writeVarUint(client)
+		e.writeVarUint(clock)
+
+		writeStruct(e, structs[i], clock-structs[i].id.Clock)
+		for _, s := range structs[i+1:] {
+			writeStruct(e, s, 0)
+		}
+	}
+}
+
+// clock ranges of everything deleted
+func (d *Doc) deleteSet() []deleteRange {
+	var ranges []deleteRange
+	for client, structs := range d.clients {
+		for _, s := range structs {
+			if s.gc || s.deleted {
+				ranges = append(ranges, deleteRange{client, s.id.Clock, s.length})
+			}
+		}
+	}
+
+	return ranges
+}
+
+// merges updates into one with the same effect
+func MergeUpdates(updates [][]byte) ([]byte, error) {
+	d := NewDoc(0)
+	for _, update := range updates {
+		if err := d.ApplyUpdate(update); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.EncodeStateAsUpdate(nil), nil
+}
@@ -0,0 +1,661 @@
+package yjs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+	"unicode/utf16"
+
+	"backend/internal/models"
+)
+
+// what yjs' encodeStateAsUpdate gives for a document of client 1 with "abc" in getText("content")
+var abcUpdate = []byte{1, 1, 1, 0, 4, 1, 7, 'c', 'o', 'n', 't', 'e', 'n', 't', 3, 'a', 'b', 'c', 0}
+
+func TestEncodeLikeYjs(t *testing.T) {
+	doc := NewDoc(1)
+	update, err := doc.ApplyOperations("content", []models.Operation{{Type: "insert", Text: "abc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(update, abcUpdate) {
+		t.Fatalf("update is %v, yjs writes %v", update, abcUpdate)
+	}
+
+	if state := doc.EncodeStateAsUpdate(nil); !bytes.Equal(state, abcUpdate) {
+		t.Fatalf("state is %v, yjs writes %v", state, abcUpdate)
+	}
+
+	other := NewDoc(2)
+	ops, err := other.ApplyTextUpdate(abcUpdate, "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops) != 1 || ops[0].Type != "insert" || ops[0].Text != "abc" || other.Text("content") != "abc" {
+		t.Fatalf("got %+v and text %q", ops, other.Text("content"))
+	}
+}
+
+// the fixtures below were encoded by hand after yjs' and y-protocols' encoders, so that each
+// test shows the bytes it is about: lib0 varuints and strings, structs of each client in
+// descending client order, each with an info byte (content ref, 0x80 origin, 0x40 right origin)
+// and a delete set of clock ranges per client. the bytes yjs itself writes are in
+// testdata/fixtures.json, see TestDocumentsFromYjs
+
+// client 1 deletes "b" from "abc": no structs, and clock 1 of client 1 in the delete set
+var deleteBUpdate = []byte{0, 1, 1, 1, 1, 1}
+
+// the state of client 1's document after that. "abc" was split into "a", "b" and "c", and the
+// content of "b" replaced with its length (ContentDeleted)
+var acState = []byte{
+	1, 3, 1, 0,
+	4, 1, 7, 'c', 'o', 'n', 't', 'e', 'n', 't', 1, 'a',
+	0x81, 1, 0, 1,
+	0x84, 1, 1, 1, 'c',
+	1, 1, 1, 1, 1,
+}
+
+func TestDeleteLikeYjs(t *testing.T) {
+	doc := NewDoc(1)
+	if _, err := doc.ApplyOperations("content", []models.Operation{{Type: "insert", Text: "abc"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	update, err := doc.ApplyOperations("content", []models.Operation{{Type: "delete", Position: 1, Length: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(update, deleteBUpdate) {
+		t.Fatalf("update is %v, yjs writes %v", update, deleteBUpdate)
+	}
+
+	if state := doc.EncodeStateAsUpdate(nil); !bytes.Equal(state, acState) {
+		t.Fatalf("state is %v, yjs writes %v", state, acState)
+	}
+
+	other := NewDoc(2)
+	if err := other.ApplyUpdate(abcUpdate); err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := other.ApplyTextUpdate(deleteBUpdate, "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops) != 1 || ops[0].Type != "delete" || ops[0].Position != 1 || ops[0].Length != 1 || other.Text("content") != "ac" {
+		t.Fatalf("got %+v and text %q", ops, other.Text("content"))
+	}
+
+	fresh := NewDoc(3)
+	if err := fresh.ApplyUpdate(acState); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fresh.Text("content"); got != "ac" {
+		t.Fatalf("copy from state has %q", got)
+	}
+}
+
+// client 2 inserts "X" between "a" and "bc" of client 1's "abc", which splits that item
+var splitUpdate = []byte{1, 1, 2, 0, 0xc4, 1, 0, 1, 1, 1, 'X', 0}
+
+// the state of client 2's document after that, client 2 first
+var splitState = []byte{
+	2,
+	1, 2, 0, 0xc4, 1, 0, 1, 1, 1, 'X',
+	2, 1, 0,
+	4, 1, 7, 'c', 'o', 'n', 't', 'e', 'n', 't', 1, 'a',
+	0x84, 1, 0, 2, 'b', 'c',
+	0,
+}
+
+func TestSplitLikeYjs(t *testing.T) {
+	doc := NewDoc(2)
+	if err := doc.ApplyUpdate(abcUpdate); err != nil {
+		t.Fatal(err)
+	}
+
+	update, err := doc.ApplyOperations("content", []models.Operation{{Type: "insert", Position: 1, Text: "X"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(update, splitUpdate) {
+		t.Fatalf("update is %v, yjs writes %v", update, splitUpdate)
+	}
+
+	if state := doc.EncodeStateAsUpdate(nil); !bytes.Equal(state, splitState) {
+		t.Fatalf("state is %v, yjs writes %v", state, splitState)
+	}
+
+	other := NewDoc(1)
+	if err := other.ApplyUpdate(abcUpdate); err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := other.ApplyTextUpdate(splitUpdate, "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops) != 1 || ops[0].Type != "insert" || ops[0].Position != 1 || ops[0].Text != "X" || other.Text("content") != "aXbc" {
+		t.Fatalf("got %+v and text %q", ops, other.Text("content"))
+	}
+
+	fresh := NewDoc(3)
+	if err := fresh.ApplyUpdate(splitState); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fresh.Text("content"); got != "aXbc" {
+		t.Fatalf("copy from state has %q", got)
+	}
+}
+
+// clients 1 and 3541870513 (a client id as yjs picks them, five bytes as a varuint) insert at
+// the start of an empty text concurrently, client 1 "é😀" (three utf-16 units, six utf-8 bytes)
+var (
+	bigClient = []byte{177, 207, 242, 152, 13}
+
+	emojiUpdate = []byte{1, 1, 1, 0, 4, 1, 7, 'c', 'o', 'n', 't', 'e', 'n', 't', 6, 0xc3, 0xa9, 0xf0, 0x9f, 0x98, 0x80, 0}
+	bigUpdate   = slices.Concat([]byte{1, 1}, bigClient, []byte{0, 4, 1, 7, 'c', 'o', 'n', 't', 'e', 'n', 't', 1, 'B', 0})
+	// then client 2, which got both, inserts "!" after the emoji and deletes "B"
+	afterEmojiUpdate = slices.Concat([]byte{1, 1, 2, 0, 0xc4, 1, 2}, bigClient, []byte{0, 1, '!', 1}, bigClient, []byte{1, 0, 1})
+)
+
+func TestConcurrentClientsLikeYjs(t *testing.T) {
+	for _, order := range [][][]byte{{emojiUpdate, bigUpdate}, {bigUpdate, emojiUpdate}} {
+		doc := NewDoc(2)
+		for _, update := range order {
+			if err := doc.ApplyUpdate(update); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the lower client id goes first
+		if got := doc.Text("content"); got != "é😀B" {
+			t.Fatalf("text is %q", got)
+		}
+
+		want := slices.Concat([]byte{2}, bigUpdate[1:len(bigUpdate)-1], emojiUpdate[1:])
+		if state := doc.EncodeStateAsUpdate(nil); !bytes.Equal(state, want) {
+			t.Fatalf("state is %v, yjs writes %v", state, want)
+		}
+
+		sv := slices.Concat([]byte{2}, bigClient, []byte{1, 1, 3})
+		if got := doc.EncodeStateVector(); !bytes.Equal(got, sv) {
+			t.Fatalf("state vector is %v, yjs writes %v", got, sv)
+		}
+
+		update, err := doc.ApplyOperations("content", []models.Operation{
+			{Type: "insert", Position: 3, Text: "!"},
+			{Type: "delete", Position: 4, Length: 1},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(update, afterEmojiUpdate) {
+			t.Fatalf("update is %v, yjs writes %v", update, afterEmojiUpdate)
+		}
+	}
+
+	doc := NewDoc(3)
+	ops, err := doc.ApplyTextUpdate(slices.Concat([]byte{2}, bigUpdate[1:len(bigUpdate)-1], emojiUpdate[1:]), "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops) != 1 || ops[0].Text != "é😀B" {
+		t.Fatalf("got %+v", ops)
+	}
+
+	ops, err = doc.ApplyTextUpdate(afterEmojiUpdate, "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []models.Operation{{Type: "insert", Position: 3, Text: "!"}, {Type: "delete", Position: 4, Length: 1}}
+	if fmt.Sprint(ops) != fmt.Sprint(want) || doc.Text("content") != "é😀!" {
+		t.Fatalf("got %+v and text %q", ops, doc.Text("content"))
+	}
+}
+
+// client 1 inserts "hi" in bold into an empty text, the way y-quill does: a format item turning
+// bold on, the text, and one turning it off again (ContentFormat, with the value as json)
+var boldUpdate = []byte{
+	1, 3, 1, 0,
+	6, 1, 7, 'c', 'o', 'n', 't', 'e', 'n', 't', 4, 'b', 'o', 'l', 'd', 4, 't', 'r', 'u', 'e',
+	0x84, 1, 0, 2, 'h', 'i',
+	0x86, 1, 2, 4, 'b', 'o', 'l', 'd', 4, 'n', 'u', 'l', 'l',
+	0,
+}
+
+// then a bold image between "h" and "i", insertEmbed(1, {image: "x"}, {bold: true}) (ContentEmbed, as
+// json). being bold like its neighbours, it needs no format items
+var embedUpdate = []byte{
+	1, 1, 1, 4, 0xc5, 1, 1, 1, 2,
+	13, '{', '"', 'i', 'm', 'a', 'g', 'e', '"', ':', '"', 'x', '"', '}',
+	0,
+}
+
+func TestFormatsAndEmbedsLikeYjs(t *testing.T) {
+	doc := NewDoc(2)
+
+	ops, err := doc.ApplyTextUpdate(boldUpdate, "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops) != 1 || ops[0].Type != "insert" || ops[0].Position != 0 || ops[0].Text != "hi" {
+		t.Fatalf("got %+v", ops)
+	}
+
+	// formats are kept as they were written
+	if state := doc.EncodeStateAsUpdate(nil); !bytes.Equal(state, boldUpdate) {
+		t.Fatalf("state is %v, yjs writes %v", state, boldUpdate)
+	}
+
+	ops, err = doc.ApplyTextUpdate(embedUpdate, "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// embeds are not part of the text
+	if len(ops) != 0 || doc.Text("content") != "hi" {
+		t.Fatalf("got %+v and text %q", ops, doc.Text("content"))
+	}
+
+	// and text goes around them
+	update, err := doc.ApplyOperations("content", []models.Operation{{Type: "insert", Position: 1, Text: "o"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewDoc(3)
+	for _, u := range [][]byte{boldUpdate, embedUpdate, update} {
+		if err := other.ApplyUpdate(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := other.Text("content"); got != "hoi" {
+		t.Fatalf("text is %q", got)
+	}
+}
+
+func TestSyncMessagesLikeYjs(t *testing.T) {
+	// y-websocket puts messageSync (0) before y-protocols' sync messages, each a step and a
+	// varuint8array. an empty document has an empty state vector
+	if got, want := SyncStep1Message(NewDoc(1).EncodeStateVector()), []byte{0, 0, 1, 0}; !bytes.Equal(got, want) {
+		t.Fatalf("sync step 1 is %v, y-protocols writes %v", got, want)
+	}
+
+	if got, want := SyncStep1Message([]byte{1, 1, 3}), []byte{0, 0, 3, 1, 1, 3}; !bytes.Equal(got, want) {
+		t.Fatalf("sync step 1 is %v, y-protocols writes %v", got, want)
+	}
+
+	step2 := append([]byte{0, 1, byte(len(abcUpdate))}, abcUpdate...)
+	if got := SyncStep2Message(abcUpdate); !bytes.Equal(got, step2) {
+		t.Fatalf("sync step 2 is %v, y-protocols writes %v", got, step2)
+	}
+
+	if got, want := UpdateMessage(deleteBUpdate), []byte{0, 2, 6, 0, 1, 1, 1, 1, 1}; !bytes.Equal(got, want) {
+		t.Fatalf("update is %v, y-protocols writes %v", got, want)
+	}
+
+	// updates of 128 bytes or more have a length of two bytes
+	long := bytes.Repeat([]byte{0}, 300)
+	if got := SyncStep2Message(long); !bytes.Equal(got[:4], []byte{0, 1, 172, 2}) || len(got) != 304 {
+		t.Fatalf("sync step 2 starts with %v", got[:4])
+	}
+
+	for _, tc := range []struct {
+		data []byte
+		want Message
+	}{
+		{[]byte{0, 0, 3, 1, 1, 3}, Message{Type: MessageSync, Step: SyncStep1, Payload: []byte{1, 1, 3}}},
+		{step2, Message{Type: MessageSync, Step: SyncStep2, Payload: abcUpdate}},
+		{[]byte{0, 2, 6, 0, 1, 1, 1, 1, 1}, Message{Type: MessageSync, Step: SyncUpdate, Payload: deleteBUpdate}},
+		{[]byte{3}, Message{Type: MessageQueryAwareness}},
+	} {
+		msg, err := ParseMessage(tc.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type != tc.want.Type || msg.Step != tc.want.Step || !bytes.Equal(msg.Payload, tc.want.Payload) {
+			t.Fatalf("%v parses as %+v, want %+v", tc.data, msg, tc.want)
+		}
+	}
+
+	if _, err := ParseMessage([]byte{0, 3, 0}); err == nil {
+		t.Fatal("unknown sync step was accepted")
+	}
+
+	// y-protocols' writePermissionDenied
+	want := []byte{2, 0, 6, 'v', 'i', 'e', 'w', 'e', 'r'}
+	if got := PermissionDeniedMessage("viewer"); !bytes.Equal(got, want) {
+		t.Fatalf("permission denied is %v, y-protocols writes %v", got, want)
+	}
+}
+
+// what y-protocols' encodeAwarenessUpdate gives for client 3541870513 after
+// setLocalStateField("user", {name: "alice"}), clock 1, and once it is removed, clock 2
+var (
+	aliceAwareness = slices.Concat([]byte{1}, bigClient, []byte{1, 25}, []byte(`{"user":{"name":"alice"}}`))
+	goneAwareness  = slices.Concat([]byte{1}, bigClient, []byte{2, 4}, []byte("null"))
+)
+
+func TestAwarenessLikeYjs(t *testing.T) {
+	for _, tc := range []struct {
+		update []byte
+		state  AwarenessState
+	}{
+		{aliceAwareness, AwarenessState{Client: 3541870513, Clock: 1, State: `{"user":{"name":"alice"}}`}},
+		{goneAwareness, AwarenessState{Client: 3541870513, Clock: 2, State: "null"}},
+	} {
+		states, err := DecodeAwareness(tc.update)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(states) != 1 || states[0] != tc.state {
+			t.Fatalf("%v decodes as %+v", tc.update, states)
+		}
+
+		if got := EncodeAwareness([]AwarenessState{tc.state}); !bytes.Equal(got, tc.update) {
+			t.Fatalf("awareness update is %v, y-protocols writes %v", got, tc.update)
+		}
+
+		// y-websocket puts messageAwareness (1) before it
+		message := slices.Concat([]byte{1, byte(len(tc.update))}, tc.update)
+		if got := AwarenessMessage(tc.update); !bytes.Equal(got, message) {
+			t.Fatalf("awareness message is %v, y-websocket writes %v", got, message)
+		}
+	}
+}
+
+// what yjs and y-protocols write, generated by testdata/generate.mjs
+type yjsFixtures struct {
+	Documents []struct {
+		Name string
+		// the client and its edits, for documents edited by a single client
+		Client uint64
+		Edits  []models.Operation
+		// every update in the order it was made, and each in an update message
+		Updates        [][]byte
+		UpdateMessages [][]byte
+		// of a document that got every update
+		Text        string
+		StateVector []byte
+		State       []byte
+		SyncStep1   []byte
+		SyncStep2   []byte
+	}
+	Awareness []struct {
+		Update  []byte
+		Message []byte
+		States  []AwarenessState
+	}
+	PermissionDenied struct {
+		Reason  string
+		Message []byte
+	}
+}
+
+func loadYjsFixtures(t *testing.T) yjsFixtures {
+	data, err := os.ReadFile("testdata/fixtures.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("testdata/fixtures.json is missing, generate it with npm install && npm run generate in testdata")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fixtures yjsFixtures
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+
+	return fixtures
+}
+
+func TestDocumentsFromYjs(t *testing.T) {
+	fixtures := loadYjsFixtures(t)
+
+	for _, f := range fixtures.Documents {
+		t.Run(f.Name, func(t *testing.T) {
+			// the same edits give the same updates
+			if len(f.Edits) > 0 {
+				doc := NewDoc(f.Client)
+				for i, edit := range f.Edits {
+					update, err := doc.ApplyOperations("content", []models.Operation{edit})
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if !bytes.Equal(update, f.Updates[i]) {
+						t.Fatalf("update of %+v is %v, yjs writes %v", edit, update, f.Updates[i])
+					}
+				}
+			}
+
+			doc := NewDoc(0)
+			text := ""
+
+			for i, update := range f.Updates {
+				ops, err := doc.ApplyTextUpdate(update, "content")
+				if err != nil {
+					t.Fatalf("update %d: %v", i, err)
+				}
+
+				if text = applyOperations(text, ops); text != doc.Text("content") {
+					t.Fatalf("changes of update %d %+v give %q instead of %q", i, ops, text, doc.Text("content"))
+				}
+
+				if got := UpdateMessage(update); !bytes.Equal(got, f.UpdateMessages[i]) {
+					t.Fatalf("update message %d is %v, y-protocols writes %v", i, got, f.UpdateMessages[i])
+				}
+
+				msg, err := ParseMessage(f.UpdateMessages[i])
+				if err != nil || msg.Type != MessageSync || msg.Step != SyncUpdate || !bytes.Equal(msg.Payload, update) {
+					t.Fatalf("update message %d parses as %+v, %v", i, msg, err)
+				}
+			}
+
+			if got := doc.Text("content"); got != f.Text {
+				t.Fatalf("text is %q, yjs has %q", got, f.Text)
+			}
+
+			if got := doc.EncodeStateVector(); !bytes.Equal(got, f.StateVector) {
+				t.Fatalf("state vector is %v, yjs writes %v", got, f.StateVector)
+			}
+
+			if got := doc.EncodeStateAsUpdate(nil); !bytes.Equal(got, f.State) {
+				t.Fatalf("state is %v, yjs writes %v", got, f.State)
+			}
+
+			if got := SyncStep1Message(doc.EncodeStateVector()); !bytes.Equal(got, f.SyncStep1) {
+				t.Fatalf("sync step 1 is %v, y-protocols writes %v", got, f.SyncStep1)
+			}
+
+			if got := SyncStep2Message(doc.EncodeStateAsUpdate(nil)); !bytes.Equal(got, f.SyncStep2) {
+				t.Fatalf("sync step 2 is %v, y-protocols writes %v", got, f.SyncStep2)
+			}
+
+			// a document loaded from the state yjs wrote is the same
+			loaded := NewDoc(0)
+			if err := loaded.ApplyUpdate(f.State); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := loaded.Text("content"); got != f.Text {
+				t.Fatalf("text loaded from the state is %q, yjs has %q", got, f.Text)
+			}
+
+			if got := loaded.EncodeStateAsUpdate(nil); !bytes.Equal(got, f.State) {
+				t.Fatalf("state loaded from the state is %v, yjs writes %v", got, f.State)
+			}
+		})
+	}
+}
+
+func TestProtocolsFromYjs(t *testing.T) {
+	fixtures := loadYjsFixtures(t)
+
+	for _, f := range fixtures.Awareness {
+		states, err := DecodeAwareness(f.Update)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(states, f.States) {
+			t.Fatalf("%v decodes as %+v, y-protocols has %+v", f.Update, states, f.States)
+		}
+
+		if got := EncodeAwareness(f.States); !bytes.Equal(got, f.Update) {
+			t.Fatalf("awareness update is %v, y-protocols writes %v", got, f.Update)
+		}
+
+		if got := AwarenessMessage(f.Update); !bytes.Equal(got, f.Message) {
+			t.Fatalf("awareness message is %v, y-websocket writes %v", got, f.Message)
+		}
+	}
+
+	denied := fixtures.PermissionDenied
+	if got := PermissionDeniedMessage(denied.Reason); !bytes.Equal(got, denied.Message) {
+		t.Fatalf("permission denied is %v, y-protocols writes %v", got, denied.Message)
+	}
+}
+
+// applies text operations with utf-16 positions
+func applyOperations(text string, ops []models.Operation) string {
+	units := utf16.Encode([]rune(text))
+	for _, op := range ops {
+		switch op.Type {
+		case "insert":
+			inserted := utf16.Encode([]rune(op.Text))
+			units = append(units[:op.Position], append(inserted, units[op.Position:]...)...)
+		case "delete":
+			units = append(units[:op.Position], units[op.Position+op.Length:]...)
+		}
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// copies of a document edit concurrently and exchange their updates in random orders. they must
+// end up with the same text, and the changes reported for each update must lead from the text
+// before it to the text after it
+func FuzzConcurrentEdits(f *testing.F) {
+	f.Add(int64(1), uint8(20))
+	f.Add(int64(7), uint8(80))
+	f.Add(int64(42), uint8(200))
+
+	f.Fuzz(func(t *testing.T, seed int64, steps uint8) {
+		rng := rand.New(rand.NewSource(seed))
+
+		docs := []*Doc{NewDoc(1), NewDoc(2), NewDoc(3)}
+		// updates each copy has not seen yet
+		inbox := make([][][]byte, len(docs))
+
+		deliver := func(i int, update []byte) {
+			before := docs[i].Text("content")
+
+			ops, err := docs[i].ApplyTextUpdate(update, "content")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := applyOperations(before, ops), docs[i].Text("content"); got != want {
+				t.Fatalf("changes %+v turn %q into %q instead of %q", ops, before, got, want)
+			}
+		}
+
+		for step := 0; step < int(steps); step++ {
+			i := rng.Intn(len(docs))
+
+			if len(inbox[i]) > 0 && rng.Intn(3) == 0 {
+				// receive some of what the others did, possibly out of order or twice
+				rng.Shuffle(len(inbox[i]), func(a, b int) { inbox[i][a], inbox[i][b] = inbox[i][b], inbox[i][a] })
+				n := rng.Intn(len(inbox[i])) + 1
+				for _, update := range inbox[i][:n] {
+					deliver(i, update)
+					if rng.Intn(4) == 0 {
+						inbox[i] = append(inbox[i], update)
+					}
+				}
+				inbox[i] = inbox[i][n:]
+				continue
+			}
+
+			length := len(utf16.Encode([]rune(docs[i].Text("content"))))
+			position := rng.Intn(length + 1)
+
+			op := models.Operation{Type: "insert", Position: position, Text: []string{"a", "bc", "é", "😀", "\n"}[rng.Intn(5)]}
+			if length > position && rng.Intn(3) == 0 {
+				op = models.Operation{Type: "delete", Position: position, Length: rng.Intn(length-position) + 1}
+			}
+
+			update, err := docs[i].ApplyOperations("content", []models.Operation{op})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for j := range docs {
+				if j != i {
+					inbox[j] = append(inbox[j], update)
+				}
+			}
+		}
+
+		for i := range docs {
+			for _, update := range inbox[i] {
+				deliver(i, update)
+			}
+		}
+
+		want := docs[0].Text("content")
+		for i, doc := range docs {
+			if got := doc.Text("content"); got != want {
+				t.Fatalf("copy %d has %q, copy 0 has %q", i, got, want)
+			}
+		}
+
+		// a fresh copy built from the state of one gets the same text
+		fresh := NewDoc(4)
+		if err := fresh.ApplyUpdate(docs[1].EncodeStateAsUpdate(nil)); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := fresh.Text("content"); got != want {
+			t.Fatalf("copy from state has %q, want %q", got, want)
+		}
+
+		// and so does one that only gets what it misses
+		partial := NewDoc(5)
+		if err := partial.ApplyUpdate(docs[2].EncodeStateAsUpdate(map[uint64]uint64{})); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := partial.ApplyUpdate(docs[0].EncodeStateAsUpdate(partial.StateVector())); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := partial.Text("content"); got != want {
+			t.Fatalf("copy from state vector has %q, want %q", got, want)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package yjs
+
+import (
+	"errors"
+	"unicode/utf16"
+)
+
+// yjs messages are written with lib0's encoding: unsigned integers take 7 bits per byte, least
+// significant first, with the high bit set on every byte but the last. strings and byte arrays
+// are prefixed with their length in bytes
+
+var (
+	ErrUnexpectedEnd = errors.New("unexpected end of yjs message")
+	ErrInvalidNumber = errors.New("number in yjs message is too large")
+)
+
+// reads lib0 encoded values. the first error sticks, every read after it returns zero values,
+// so callers only need to check err once they are done
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newDecoder(data []byte) *decoder {
+	return &decoder{data: data}
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) done() bool {
+	return d.err != nil || d.pos >= len(d.data)
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+
+	if d.pos >= len(d.data) {
+		d.fail(ErrUnexpectedEnd)
+		return 0
+	}
+
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *decoder) readBytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n > uint64(len(d.data)-d.pos) {
+		d.fail(ErrUnexpectedEnd)
+		return nil
+	}
+
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b
+}
+
+// javascript numbers are only exact up to 53 bits, which is also all lib0 writes
+func (d *decoder) readVarUint() uint64 {
+	var n uint64
+	for shift := 0; ; shift += 7 {
+		if shift > 49 {
+			d.fail(ErrInvalidNumber)
+			return 0
+		}
+
+		b := d.readByte()
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n
+		}
+	}
+}
+
+func (d *decoder) readVarBytes() []byte {
+	return d.readBytes(d.readVarUint())
+}
+
+func (d *decoder) readVarString() string {
+	return string(d.readVarBytes())
+}
+
+// skips a value written with lib0's writeAny and returns its bytes as they were written
+func (d *decoder) readAny() []byte {
+	start := d.pos
+	d.skipAny(0)
+	if d.err != nil {
+		return nil
+	}
+
+	return d.data[start:d.pos]
+}
+
+// objects and arrays nest, but not deeper than anything a client would send
+const maxAnyDepth = 64
+
+func (d *decoder) skipAny(depth int) {
+	if depth > maxAnyDepth {
+		d.fail(errors.New("value in yjs message is nested too deeply"))
+		return
+	}
+
+	switch d.readByte() {
+	case 127, 126, 121, 120:
+		// undefined, null, false and true carry nothing
+	case 125:
+		// varint, the sign is in the first byte
+		for d.readByte() >= 0x80 && d.err == nil {
+		}
+	case 124:
+		d.readBytes(4)
+	case 123, 122:
+		// float64 and bigint
+		d.readBytes(8)
+	case 119, 116:
+		// string and byte array
+		d.readVarBytes()
+	case 118:
+		for n := d.readVarUint(); n > 0 && d.err == nil; n-- {
+			d.readVarString()
+			d.skipAny(depth + 1)
+		}
+	case 117:
+		for n := d.readVarUint(); n > 0 && d.err == nil; n-- {
+			d.skipAny(depth + 1)
+		}
+	default:
+		d.fail(errors.New("unknown value type in yjs message"))
+	}
+}
+
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) writeByte(b byte) {
+	e.data = append(e.data, b)
+}
+
+func (e *encoder) writeVarUint(n uint64) {
+	for n >= 0x80 {
+		e.data = append(e.data, byte(n)|0x80)
+		n >>= 7
+	}
+
+	e.data = append(e.data, byte(n))
+}
+
+func (e *encoder) writeVarBytes(b []byte) {
+	e.writeVarUint(uint64(len(b)))
+	e.data = append(e.data, b...)
+}
+
+func (e *encoder) writeVarString(s string) {
+	e.writeVarBytes([]byte(s))
+}
+
+// text in yjs is measured in utf-16 code units like javascript strings, and sent as utf-8
+func toUTF16(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
+
+// decodes utf-16 code units, half surrogate pairs become the replacement character like
+// javascript's TextEncoder makes them
+func fromUTF16(units []uint16) string {
+	return string(utf16.Decode(units))
+}
+
+func isHighSurrogate(unit uint16) bool {
+	return unit >= 0xd800 && unit < 0xdc00
+}
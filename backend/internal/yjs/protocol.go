@@ -0,0 +1,132 @@
+package yjs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// messages of the y-websocket protocol. each starts with its type, sync messages then have a
+// sync step: the first sends a state vector, the second answers it with what the other side
+// misses, and updates carry changes as they are made
+
+const (
+	MessageSync           = 0
+	MessageAwareness      = 1
+	MessageAuth           = 2
+	MessageQueryAwareness = 3
+
+	SyncStep1  = 0
+	SyncStep2  = 1
+	SyncUpdate = 2
+
+	// the only kind of auth message, telling a client it may not make changes
+	authPermissionDenied = 0
+)
+
+var ErrInvalidMessage = errors.New("invalid y-websocket message")
+
+type Message struct {
+	Type uint64
+	// sync step of sync messages
+	Step uint64
+	// state vector, update or awareness update
+	Payload []byte
+}
+
+func ParseMessage(data []byte) (Message, error) {
+	d := newDecoder(data)
+	msg := Message{Type: d.readVarUint()}
+
+	switch msg.Type {
+	case MessageSync:
+		msg.Step = d.readVarUint()
+		if msg.Step > SyncUpdate {
+			return msg, fmt.Errorf("%w: unknown sync step %d", ErrInvalidMessage, msg.Step)
+		}
+		msg.Payload = d.readVarBytes()
+	case MessageAwareness:
+		msg.Payload = d.readVarBytes()
+	}
+
+	if d.err != nil {
+		return msg, fmt.Errorf("%w: %w", ErrInvalidMessage, d.err)
+	}
+
+	return msg, nil
+}
+
+func syncMessage(step uint64, payload []byte) []byte {
+	e := &encoder{}
+	e.writeVarUint(MessageSync)
+	e.writeVarUint(step)
+	e.writeVarBytes(payload)
+	return e.data
+}
+
+// asks the other side for what it has that the document with state vector sv misses
+func SyncStep1Message(sv []byte) []byte {
+	return syncMessage(SyncStep1, sv)
+}
+
+func SyncStep2Message(update []byte) []byte {
+	return syncMessage(SyncStep2, update)
+}
+
+func UpdateMessage(update []byte) []byte {
+	return syncMessage(SyncUpdate, update)
+}
+
+func AwarenessMessage(update []byte) []byte {
+	e := &encoder{}
+	e.writeVarUint(MessageAwareness)
+	e.writeVarBytes(update)
+	return e.data
+}
+
+func PermissionDeniedMessage(reason string) []byte {
+	e := &encoder{}
+	e.writeVarUint(MessageAuth)
+	e.writeVarUint(authPermissionDenied)
+	e.writeVarString(reason)
+	return e.data
+}
+
+// the state a client shares with everyone else, such as its name and cursor. each change
+// bumps its clock
+type AwarenessState struct {
+	Client uint64
+	Clock  uint64
+	// json, "null" once the client is gone
+	State string
+}
+
+func DecodeAwareness(update []byte) ([]AwarenessState, error) {
+	d := newDecoder(update)
+
+	var states []AwarenessState
+	for n := d.readVarUint(); n > 0 && d.err == nil; n-- {
+		states = append(states, AwarenessState{
+			Client: d.readVarUint(),
+			Clock:  d.readVarUint(),
+			State:  d.readVarString(),
+		})
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid awareness update: %w", d.err)
+	}
+
+	return states, nil
+}
+
+func EncodeAwareness(states []AwarenessState) []byte {
+	e := &encoder{}
+	e.writeVarUint(uint64(len(states)))
+	for _, s := range states {
+		e.writeVarUint(s.Client)
+		e.writeVarUint(s.Clock)
+		e.writeVarString(s.State)
+	}
+
+	return e.data
+}
@@ -0,0 +1,172 @@
+// writes fixtures.json with the bytes yjs and y-protocols write for the documents below, which
+// the tests in ../doc_test.go check the go implementation against. run it again after changing
+// anything here with: npm install && npm run generate
+import { writeFileSync } from "node:fs";
+import * as encoding from "lib0/encoding";
+import * as authProtocol from "y-protocols/auth";
+import * as awarenessProtocol from "y-protocols/awareness";
+import * as syncProtocol from "y-protocols/sync";
+import * as Y from "yjs";
+
+// message types of y-websocket
+const messageSync = 0;
+const messageAwareness = 1;
+const messageAuth = 2;
+
+// a client id that takes five bytes as a varuint
+const bigClient = 3541870513;
+
+const base64 = (bytes) => Buffer.from(bytes).toString("base64");
+
+function newDoc(client) {
+  const doc = new Y.Doc();
+  doc.clientID = client;
+  return doc;
+}
+
+function message(type, write) {
+  const encoder = encoding.createEncoder();
+  encoding.writeVarUint(encoder, type);
+  write(encoder);
+  return encoding.toUint8Array(encoder);
+}
+
+// what a document that gets every update in the order they were made ends up with
+function fixture(name, updates, extra = {}) {
+  const doc = newDoc(0);
+  for (const update of updates) {
+    Y.applyUpdate(doc, update);
+  }
+
+  return {
+    name,
+    ...extra,
+    updates: updates.map(base64),
+    updateMessages: updates.map((update) =>
+      base64(message(messageSync, (e) => syncProtocol.writeUpdate(e, update))),
+    ),
+    text: doc.getText("content").toString(),
+    stateVector: base64(Y.encodeStateVector(doc)),
+    state: base64(Y.encodeStateAsUpdate(doc)),
+    syncStep1: base64(message(messageSync, (e) => syncProtocol.writeSyncStep1(e, doc))),
+    syncStep2: base64(message(messageSync, (e) => syncProtocol.writeSyncStep2(e, doc))),
+  };
+}
+
+// edits of a single client, which the tests also make with ApplyOperations. positions are in
+// utf-16 code units, like in yjs
+function local(name, client, edits) {
+  const doc = newDoc(client);
+  const text = doc.getText("content");
+  const updates = [];
+  doc.on("update", (update) => updates.push(update));
+
+  for (const edit of edits) {
+    if (edit.type === "insert") {
+      text.insert(edit.position, edit.text);
+    } else {
+      text.delete(edit.position, edit.length);
+    }
+  }
+
+  return fixture(name, updates, { client, edits });
+}
+
+// edits of several clients, made by run on their documents. documents only get each other's
+// updates when run passes them on with sync, so edits in between are concurrent
+function remote(name, clients, run) {
+  const updates = [];
+  const docs = clients.map((client) => {
+    const doc = newDoc(client);
+    doc.on("update", (update, origin) => {
+      if (origin !== "remote") {
+        updates.push(update);
+      }
+    });
+    return doc;
+  });
+
+  const sync = (from, to) =>
+    Y.applyUpdate(to, Y.encodeStateAsUpdate(from, Y.encodeStateVector(to)), "remote");
+
+  run(docs, sync);
+  return fixture(name, updates);
+}
+
+const documents = [
+  local("insert", 1, [{ type: "insert", position: 0, text: "abc" }]),
+  local("delete", 1, [
+    { type: "insert", position: 0, text: "abc" },
+    { type: "delete", position: 1, length: 1 },
+  ]),
+  local("unicode", 1, [
+    { type: "insert", position: 0, text: "é😀" },
+    { type: "insert", position: 3, text: "x" },
+    { type: "delete", position: 1, length: 2 },
+  ]),
+  // over 127 bytes, so lengths take two bytes
+  local("long", bigClient, [{ type: "insert", position: 0, text: "a".repeat(300) }]),
+  remote("split", [1, 2], ([a, b], sync) => {
+    a.getText("content").insert(0, "abc");
+    sync(a, b);
+    b.getText("content").insert(1, "X");
+  }),
+  remote("concurrent", [1, bigClient], ([a, b], sync) => {
+    a.getText("content").insert(0, "hello");
+    sync(a, b);
+    a.getText("content").insert(5, " world");
+    b.getText("content").insert(0, "😀");
+    b.getText("content").delete(3, 2);
+    sync(a, b);
+    sync(b, a);
+    a.getText("content").insert(0, ">");
+  }),
+  remote("formats", [1], ([a]) => {
+    const text = a.getText("content");
+    text.insert(0, "hello");
+    text.format(0, 5, { bold: true });
+    text.insertEmbed(2, { image: "x.png" }, { bold: true });
+    text.insert(6, "!", { italic: true });
+    text.delete(1, 2);
+  }),
+];
+
+function awarenessFixtures() {
+  const doc = newDoc(bigClient);
+  const awareness = new awarenessProtocol.Awareness(doc);
+  const fixtures = [];
+
+  const take = () => {
+    const update = awarenessProtocol.encodeAwarenessUpdate(awareness, [doc.clientID]);
+    fixtures.push({
+      update: base64(update),
+      message: base64(message(messageAwareness, (e) => encoding.writeVarUint8Array(e, update))),
+      states: [
+        {
+          client: doc.clientID,
+          clock: awareness.meta.get(doc.clientID).clock,
+          state: JSON.stringify(awareness.getLocalState()),
+        },
+      ],
+    });
+  };
+
+  awareness.setLocalStateField("user", { name: "alice" });
+  take();
+  awareness.setLocalState(null);
+  take();
+
+  awareness.destroy();
+  return fixtures;
+}
+
+const fixtures = {
+  documents,
+  awareness: awarenessFixtures(),
+  permissionDenied: {
+    reason: "viewer",
+    message: base64(message(messageAuth, (e) => authProtocol.writePermissionDenied(e, "viewer"))),
+  },
+};
+
+writeFileSync(new URL("./fixtures.json", import.meta.url), JSON.stringify(fixtures, null, 2) + "\n");
@@ -0,0 +1,478 @@
+package yjs
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// updates are encoded the way yjs' encodeStateAsUpdate writes them (version 1): the new structs of
+// each client, then a delete set with the clock ranges that were deleted
+
+var ErrInvalidUpdate = errors.New("invalid yjs update")
+
+// content refs, written in the low 5 bits of a struct's info byte
+const (
+	refGC      = 0
+	refDeleted = 1
+	refJSON    = 2
+	refBinary  = 3
+	refString  = 4
+	refEmbed   = 5
+	refFormat  = 6
+	refType    = 7
+	refAny     = 8
+	refDoc     = 9
+	refSkip    = 10
+
+	refMask = 0x1f
+
+	flagOrigin      = 0x80
+	flagRightOrigin = 0x40
+	flagParentSub   = 0x20
+)
+
+// refs of shared types that carry a name, xml elements and hooks
+const (
+	typeXmlElement = 3
+	typeXmlHook    = 5
+)
+
+// identifies a struct by the client that created it and the number of things that client
+// created before it
+type ID struct {
+	Client uint64
+	Clock  uint64
+}
+
+// what an item holds. contents longer than one can be split, which is how items are cut
+// when something is inserted in their middle
+type content interface {
+	ref() byte
+	length() uint64
+	// whether it counts towards the length of its parent, formats and deleted content do not
+	countable() bool
+	// cuts the content at offset, keeps the first part and returns the rest
+	splice(offset uint64) content
+	// writes the content starting at offset
+	write(e *encoder, offset uint64)
+}
+
+type deletedContent struct{ n uint64 }
+
+func (c *deletedContent) ref() byte                       { return refDeleted }
+func (c *deletedContent) length() uint64                  { return c.n }
+func (c *deletedContent) countable() bool                 { return false }
+func (c *deletedContent) write(e *encoder, offset uint64) { e.writeVarUint(c.n - offset) }
+
+func (c *deletedContent) splice(offset uint64) content {
+	right := &deletedContent{c.n - offset}
+	c.n = offset
+	return right
+}
+
+// text, in utf-16 code units like javascript strings
+type stringContent struct{ units []uint16 }
+
+func (c *stringContent) ref() byte       { return refString }
+func (c *stringContent) length() uint64  { return uint64(len(c.units)) }
+func (c *stringContent) countable() bool { return true }
+
+func (c *stringContent) write(e *encoder, offset uint64) {
+	e.writeVarString(fromUTF16(c.units[offset:]))
+}
+
+// a surrogate pair that is cut in half becomes two replacement characters, like yjs does it
+func (c *stringContent) splice(offset uint64) content {
+	right := &stringContent{append([]uint16(nil), c.units[offset:]...)}
+	c.units = c.units[:offset:offset]
+
+	if isHighSurrogate(c.units[offset-1]) {
+		c.units[offset-1] = 0xfffd
+		right.units[0] = 0xfffd
+	}
+
+	return right
+}
+
+// values of a y-array, as json or in lib0's binary encoding. they are kept as written
+type jsonContent struct{ values []string }
+
+func (c *jsonContent) ref() byte       { return refJSON }
+func (c *jsonContent) length() uint64  { return uint64(len(c.values)) }
+func (c *jsonContent) countable() bool { return true }
+
+func (c *jsonContent) write(e *encoder, offset uint64) {
+	e.writeVarUint(uint64(len(c.values)) - offset)
+	for _, value := range c.values[offset:] {
+		e.writeVarString(value)
+	}
+}
+
+func (c *jsonContent) splice(offset uint64) content {
+	right := &jsonContent{c.values[offset:]}
+	c.values = c.values[:offset:offset]
+	return right
+}
+
+type anyContent struct{ values [][]byte }
+
+func (c *anyContent) ref() byte       { return refAny }
+func (c *anyContent) length() uint64  { return uint64(len(c.values)) }
+func (c *anyContent) countable() bool { return true }
+
+func (c *anyContent) write(e *encoder, offset uint64) {
+	e.writeVarUint(uint64(len(c.values)) - offset)
+	for _, value := range c.values[offset:] {
+		e.data = append(e.data, value...)
+	}
+}
+
+func (c *anyContent) splice(offset uint64) content {
+	right := &anyContent{c.values[offset:]}
+	c.values = c.values[:offset:offset]
+	return right
+}
+
+// contents of length one are never split. raw holds them as they were written
+type opaqueContent struct {
+	contentRef byte
+	raw        []byte
+}
+
+func (c *opaqueContent) ref() byte       { return c.contentRef }
+func (c *opaqueContent) length() uint64  { return 1 }
+func (c *opaqueContent) countable() bool { return c.contentRef != refFormat }
+func (c *opaqueContent) splice(uint64) content {
+	panic("yjs: content of length one can not be split")
+}
+
+func (c *opaqueContent) write(e *encoder, offset uint64) {
+	e.data = append(e.data, c.raw...)
+}
+
+// a nested shared type, such as a y-map inside a y-array
+type typeContent struct {
+	typeRef uint64
+	// node name of xml elements and hooks
+	name string
+	t    *ytype
+}
+
+func (c *typeContent) ref() byte       { return refType }
+func (c *typeContent) length() uint64  { return 1 }
+func (c *typeContent) countable() bool { return true }
+func (c *typeContent) splice(uint64) content {
+	panic("yjs: content of length one can not be split")
+}
+
+func (c *typeContent) write(e *encoder, offset uint64) {
+	e.writeVarUint(c.typeRef)
+	if c.typeRef == typeXmlElement || c.typeRef == typeXmlHook {
+		e.writeVarString(c.name)
+	}
+}
+
+// a contiguous range of clocks of one client that was deleted
+type deleteRange struct {
+	client uint64
+	clock  uint64
+	length uint64
+}
+
+type update struct {
+	// structs of each client, ordered by clock
+	structs map[uint64][]*item
+	deletes []deleteRange
+}
+
+func decodeUpdate(data []byte) (*update, error) {
+	d := newDecoder(data)
+	u := &update{structs: make(map[uint64][]*item)}
+
+	for clients := d.readVarUint(); clients > 0 && d.err == nil; clients-- {
+		count := d.readVarUint()
+		client := d.readVarUint()
+		clock := d.readVarUint()
+
+		for ; count > 0 && d.err == nil; count-- {
+			s := readStruct(d, ID{client, clock})
+			if d.err != nil {
+				break
+			}
+
+			if s.length == 0 {
+				d.fail(errors.New("struct of length 0"))
+				break
+			}
+
+			clock += s.length
+			if s.skip {
+				// a gap in the update, whatever is after it waits for what belongs there
+				continue
+			}
+
+			u.structs[client] = append(u.structs[client], s)
+		}
+	}
+
+	u.deletes = readDeleteSet(d)
+
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidUpdate, d.err)
+	}
+
+	return u, nil
+}
+
+func readStruct(d *decoder, id ID) *item {
+	info := d.readByte()
+
+	switch info & refMask {
+	case refGC:
+		return &item{id: id, length: d.readVarUint(), gc: true}
+	case refSkip:
+		return &item{id: id, length: d.readVarUint(), skip: true}
+	}
+
+	it := &item{id: id}
+
+	if info&flagOrigin != 0 {
+		it.origin = &ID{d.readVarUint(), d.readVarUint()}
+	}
+
+	if info&flagRightOrigin != 0 {
+		it.rightOrigin = &ID{d.readVarUint(), d.readVarUint()}
+	}
+
+	// items next to others take their parent from them
+	if it.origin == nil && it.rightOrigin == nil {
+		if d.readVarUint() == 1 {
+			name := d.readVarString()
+			it.parentName = &name
+		} else {
+			it.parentID = &ID{d.readVarUint(), d.readVarUint()}
+		}
+
+		if info&flagParentSub != 0 {
+			sub := d.readVarString()
+			it.parentSub = &sub
+		}
+	}
+
+	it.content = readContent(d, info&refMask)
+	if it.content != nil {
+		it.length = it.content.length()
+	}
+
+	return it
+}
+
+func readContent(d *decoder, ref byte) content {
+	start := d.pos
+
+	switch ref {
+	case refDeleted:
+		return &deletedContent{d.readVarUint()}
+	case refString:
+		return &stringContent{toUTF16(d.readVarString())}
+	case refJSON:
+		c := &jsonContent{}
+		for n := d.readVarUint(); n > 0 && d.err == nil; n-- {
+			c.values = append(c.values, d.readVarString())
+		}
+		return c
+	case refAny:
+		c := &anyContent{}
+		for n := d.readVarUint(); n > 0 && d.err == nil; n-- {
+			c.values = append(c.values, slices.Clone(d.readAny()))
+		}
+		return c
+	case refType:
+		c := &typeContent{typeRef: d.readVarUint()}
+		if c.typeRef == typeXmlElement || c.typeRef == typeXmlHook {
+			c.name = d.readVarString()
+		}
+		c.t = &ytype{entries: make(map[string]*item)}
+		return c
+	case refBinary, refEmbed:
+		d.readVarBytes()
+	case refFormat:
+		d.readVarString()
+		d.readVarString()
+	case refDoc:
+		d.readVarString()
+		d.readAny()
+	default:
+		d.fail(fmt.Errorf("unknown content ref %d", ref))
+		return nil
+	}
+
+	if d.err != nil {
+		return nil
+	}
+
+	return &opaqueContent{contentRef: ref, raw: slices.Clone(d.data[start:d.pos])}
+}
+
+func readDeleteSet(d *decoder) []deleteRange {
+	var ranges []deleteRange
+
+	for clients := d.readVarUint(); clients > 0 && d.err == nil; clients-- {
+		client := d.readVarUint()
+		for n := d.readVarUint(); n > 0 && d.err == nil; n-- {
+			r := deleteRange{client: client, clock: d.readVarUint(), length: d.readVarUint()}
+			if r.length > 0 {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+
+	return ranges
+}
+
+// writes an item, or the part of it from offset on
+func writeStruct(e *encoder, s *item, offset uint64) {
+	if s.gc {
+		e.writeByte(refGC)
+		e.writeVarUint(s.length - offset)
+		return
+	}
+
+	origin := s.origin
+	if offset > 0 {
+		origin = &ID{s.id.Client, s.id.Clock + offset - 1}
+	}
+
+	info := s.content.ref() & refMask
+	if origin != nil {
+		info |= flagOrigin
+	}
+	if s.rightOrigin != nil {
+		info |= flagRightOrigin
+	}
+	if s.parentSub != nil {
+		info |= flagParentSub
+	}
+
+	e.writeByte(info)
+
+	if origin != nil {
+		e.writeVarUint(origin.Client)
+		e.writeVarUint(origin.Clock)
+	}
+
+	if s.rightOrigin != nil {
+		e.writeVarUint(s.rightOrigin.Client)
+		e.writeVarUint(s.rightOrigin.Clock)
+	}
+
+	if origin == nil && s.rightOrigin == nil {
+		if s.parent.item == nil {
+			e.writeVarUint(1)
+			e.writeVarString(s.parent.name)
+		} else {
+			e.writeVarUint(0)
+			e.writeVarUint(s.parent.item.id.Client)
+			e.writeVarUint(s.parent.item.id.Clock)
+		}
+
+		if s.parentSub != nil {
+			e.writeVarString(*s.parentSub)
+		}
+	}
+
+	s.content.write(e, offset)
+}
+
+// writes delete ranges grouped by client, clients in descending order like yjs writes them
+func writeDeleteSet(e *encoder, ranges []deleteRange) {
+	ranges = mergeDeleteRanges(ranges)
+
+	var clients []uint64
+	byClient := make(map[uint64][]deleteRange)
+	for _, r := range ranges {
+		if _, ok := byClient[r.client]; !ok {
+			clients = append(clients, r.client)
+		}
+		byClient[r.client] = append(byClient[r.client], r)
+	}
+
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeVarUint(uint64(len(byClient[client])))
+		for _, r := range byClient[client] {
+			e.writeVarUint(r.clock)
+			e.writeVarUint(r.length)
+		}
+	}
+}
+
+// sorts ranges by client (descending) and clock, joining the ones that touch
+func mergeDeleteRanges(ranges []deleteRange) []deleteRange {
+	ranges = slices.Clone(ranges)
+	slices.SortFunc(ranges, func(a, b deleteRange) int {
+		if a.client != b.client {
+			if a.client > b.client {
+				return -1
+			}
+			return 1
+		}
+
+		if a.clock < b.clock {
+			return -1
+		}
+		if a.clock > b.clock {
+			return 1
+		}
+		return 0
+	})
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].client == r.client && merged[n-1].clock+merged[n-1].length >= r.clock {
+			merged[n-1].length = max(merged[n-1].length, r.clock+r.length-merged[n-1].clock)
+			continue
+		}
+
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// encodes which clocks of each client a document has, so another can send it what it misses
+func encodeStateVector(sv map[uint64]uint64) []byte {
+	clients := make([]uint64, 0, len(sv))
+	for client := range sv {
+		clients = append(clients, client)
+	}
+	slices.Sort(clients)
+	slices.Reverse(clients)
+
+	e := &encoder{}
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeVarUint(sv[client])
+	}
+
+	return e.data
+}
+
+func DecodeStateVector(data []byte) (map[uint64]uint64, error) {
+	d := newDecoder(data)
+	sv := make(map[uint64]uint64)
+
+	for n := d.readVarUint(); n > 0 && d.err == nil; n-- {
+		client := d.readVarUint()
+		sv[client] = d.readVarUint()
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid state vector: %w", d.err)
+	}
+
+	return sv, nil
+}
@@ -1,27 +1,41 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"backend/internal/ai"
 	"backend/internal/auth"
 	"backend/internal/handlers"
+	"backend/internal/models"
+	"backend/internal/room"
 	"backend/internal/storage"
+	"backend/internal/utils"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
 const (
 	PORT string = "3000"
+
+	// how long shutting down may take unless SHUTDOWN_TIMEOUT says otherwise
+	defaultShutdownTimeout = 30 * time.Second
+	// how long rooms without clients are kept in memory unless ROOM_IDLE_TIMEOUT says otherwise
+	defaultRoomIdleTimeout = 10 * time.Minute
 )
 
 type Response struct {
@@ -75,6 +89,70 @@ func initializeConnections() error {
 	return nil
 }
 
+// room codes can be made longer or use other characters through the environment
+func configureRoomCodes() error {
+	length := utils.DefaultRoomCodeLength
+	if value := os.Getenv("ROOM_CODE_LENGTH"); value != "" {
+		var err error
+		length, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("ROOM_CODE_LENGTH must be a number: %w", err)
+		}
+	}
+
+	alphabet := utils.DefaultRoomCodeAlphabet
+	if value := os.Getenv("ROOM_CODE_ALPHABET"); value != "" {
+		alphabet = value
+	}
+
+	return storage.ConfigureRoomCodes(length, alphabet)
+}
+
+// reads a duration like 30s or 10m from the environment, or returns fallback if it is not set
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration like 30s: %w", name, err)
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s must be positive", name)
+	}
+
+	return duration, nil
+}
+
+// stops taking requests, tells connected clients the server is restarting, stops listening to
+// other instances, waits for ai responses in flight and writes every unsynced document to
+// postgres. the final sync runs even when the deadline has passed, since skipping it would lose edits
+func shutdown(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// websocket connections are hijacked, so this only waits for plain requests
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("could not finish open requests: %v", err)
+	}
+
+	data, _ := json.Marshal(models.Message{Type: "serverRestarting"})
+	room.DisconnectAll(data, websocket.CloseServiceRestart, "server restarting")
+	room.StopJanitor()
+	room.StopListening()
+
+	if err := ai.Wait(ctx); err != nil {
+		log.Printf("stopped waiting for ai responses: %v", err)
+	}
+
+	if err := storage.StopBackgroundSync(); err != nil {
+		log.Printf("could not sync documents: %v", err)
+	}
+}
+
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -89,7 +167,28 @@ func main() {
 		return
 	}
 
+	// databases created by an older init.sql are missing tables and columns
+	if err := storage.MigratePostgres(); err != nil {
+		log.Fatalf("could not migrate postgres: %v", err)
+	}
+
+	if err := configureRoomCodes(); err != nil {
+		log.Fatalf("could not configure room codes: %v", err)
+	}
+
+	timeout, err := durationFromEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		log.Fatalf("could not configure shutdown: %v", err)
+	}
+
+	idleTimeout, err := durationFromEnv("ROOM_IDLE_TIMEOUT", defaultRoomIdleTimeout)
+	if err != nil {
+		log.Fatalf("could not configure idle rooms: %v", err)
+	}
+
 	storage.StartBackgroundSync(2 * time.Minute)
+	room.StartListening()
+	room.StartJanitor(idleTimeout)
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
@@ -118,25 +217,68 @@ func main() {
 			r.Use(auth.AuthMiddleware)
 			r.Get("/protected", auth.ProtectedRoute)
 
+			// instance stats
+			r.Get("/sync", handlers.HandleGetSyncStats)
+			r.Get("/metrics", handlers.HandleGetMetrics)
+
 			// room endpoints
 			r.Get("/rooms", handlers.HandleGetRooms)
-			r.Get("/rooms/{id}", handlers.HandleGetRoom)
 			r.Post("/rooms", handlers.HandleCreateRoom)
 
+			r.Route("/rooms/{id}", func(r chi.Router) {
+				roomCode := auth.RoomFromURLParam("id")
+
+				r.With(auth.RequireRoomRole(models.RoleViewer, roomCode)).Get("/", handlers.HandleGetRoom)
+				r.With(auth.RequireRoomRole(models.RoleOwner, roomCode)).Put("/", handlers.HandleUpdateRoom)
+				r.With(auth.RequireRoomRole(models.RoleOwner, roomCode)).Delete("/", handlers.HandleDeleteRoom)
+				r.With(auth.RequireRoomRole(models.RoleOwner, roomCode)).Post("/transfer", handlers.HandleTransferRoom)
+				r.With(auth.RequireRoomRole(models.RoleViewer, roomCode)).Get("/metrics", handlers.HandleGetRoomMetrics)
+
+				// member endpoints
+				r.With(auth.RequireRoomRole(models.RoleViewer, roomCode)).Get("/members", handlers.HandleGetMembers)
+				r.With(auth.RequireRoomRole(models.RoleOwner, roomCode)).Post("/members", handlers.HandleAddMember)
+				r.With(auth.RequireRoomRole(models.RoleOwner, roomCode)).Put("/members/{username}", handlers.HandleUpdateMember)
+				// members can remove themselves, the handler checks the rest
+				r.With(auth.RequireRoomRole(models.RoleViewer, roomCode)).Delete("/members/{username}", handlers.HandleRemoveMember)
+
+				// invite endpoints
+				r.With(auth.RequireRoomRole(models.RoleOwner, roomCode)).Get("/invites", handlers.HandleGetInvites)
+				r.With(auth.RequireRoomRole(models.RoleOwner, roomCode)).Post("/invites", handlers.HandleCreateInvite)
+				r.With(auth.RequireRoomRole(models.RoleOwner, roomCode)).Delete("/invites/{inviteId}", handlers.HandleRevokeInvite)
+			})
+
+			r.Post("/invites/{token}/redeem", handlers.HandleRedeemInvite)
+
 			// document endpoints
-			r.Get("/documents", handlers.HandleGetDocuments)
-			r.Post("/documents", handlers.HandleCreateDocument)
+			r.With(auth.RequireRoomRole(models.RoleViewer, auth.RoomFromQuery)).Get("/documents", handlers.HandleGetDocuments)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromQuery)).Post("/documents", handlers.HandleCreateDocument)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromQuery)).Put("/documents/{id}", handlers.HandleUpdateDocument)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromQuery)).Delete("/documents/{id}", handlers.HandleDeleteDocument)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromQuery)).Post("/documents/{id}/duplicate", handlers.HandleDuplicateDocument)
+			r.With(auth.RequireRoomRole(models.RoleViewer, auth.RoomFromQuery)).Get("/documents/{id}/revisions", handlers.HandleGetRevisions)
+			r.With(auth.RequireRoomRole(models.RoleViewer, auth.RoomFromQuery)).Get("/documents/{id}/revisions/{revision}", handlers.HandleGetRevision)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromQuery)).Post("/documents/{id}/revisions/{revision}/restore", handlers.HandleRestoreRevision)
+
+			// folder endpoints
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromQuery)).Post("/folders", handlers.HandleCreateFolder)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromQuery)).Put("/folders/{id}", handlers.HandleUpdateFolder)
 
 			// pdf endpoints
-			r.Get("/pdfs", handlers.HandleGetPDFs)
-			r.Post("/pdfs/upload", handlers.HandleUploadPDF)
-			r.Delete("/pdfs", handlers.HandleDeletePDF)
+			r.With(auth.RequireRoomRole(models.RoleViewer, auth.RoomFromQuery)).Get("/pdfs", handlers.HandleGetPDFs)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromQuery)).Post("/pdfs/upload", handlers.HandleUploadPDF)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromPDF)).Delete("/pdfs", handlers.HandleDeletePDF)
 
 			// ai endpoint
-			r.Post("/ai", handlers.AIHandler)
+			r.With(auth.RequireRoomRole(models.RoleEditor, auth.RoomFromBody)).Post("/ai", handlers.AIHandler)
+
+			// search endpoint, only searches rooms the caller can see
+			r.Get("/search", handlers.HandleSearch)
 
-			// websocket
-			r.Get("/ws", handlers.HandleWebSocket)
+			// websocket, viewers get a read-only connection
+			r.With(auth.RequireRoomRole(models.RoleViewer, auth.RoomFromQuery)).Get("/ws", handlers.HandleWebSocket)
+
+			// y-websocket endpoint for yjs editor bindings, one connection per document
+			r.With(auth.RequireRoomRole(models.RoleViewer, auth.RoomFromQuery)).Get("/yjs/{docId}", handlers.HandleYjsWebSocket)
 		})
 	})
 
@@ -147,8 +289,23 @@ func main() {
 		r.Handle("/*", fs)
 	}
 
-	fmt.Printf("Server starting on port %s\n", PORT)
-	if err := http.ListenAndServe(":"+PORT, r); err != nil {
-		log.Fatalf("could not start server: %v", err)
-	}
+	server := &http.Server{Addr: ":" + PORT, Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		fmt.Printf("Server starting on port %s\n", PORT)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("could not start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	// a second signal kills the server right away
+	stop()
+
+	fmt.Println("shutting down")
+	shutdown(server, timeout)
+	fmt.Println("server stopped")
 }
@@ -1,3 +1,6 @@
+-- only runs when the postgres volume is created. existing databases are brought up to date by
+-- the backend on start, so changes to tables here also need a migration in storage/migrations.go
+
 CREATE TABLE IF NOT EXISTS users (
     username VARCHAR(255) PRIMARY KEY,
     hashed_password VARCHAR(255),
@@ -11,28 +14,99 @@ CREATE TABLE IF NOT EXISTS rooms (
     code VARCHAR(10) PRIMARY KEY,
     name VARCHAR(255) NOT NULL DEFAULT 'Untitled Hub',
     public BOOLEAN,
+    -- archived rooms are hidden from the list of rooms and read-only
+    archived BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE TABLE IF NOT EXISTS room_members (
+    room_code VARCHAR(10) NOT NULL REFERENCES rooms(code) ON DELETE CASCADE,
+    username VARCHAR(255) NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (room_code, username)
+);
+
+CREATE TABLE IF NOT EXISTS room_invites (
+    id SERIAL PRIMARY KEY,
+    room_code VARCHAR(10) NOT NULL REFERENCES rooms(code) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    max_uses INTEGER NOT NULL DEFAULT 1,
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS folders (
+    id SERIAL PRIMARY KEY,
+    room_code VARCHAR(10) NOT NULL REFERENCES rooms(code) ON DELETE CASCADE,
+    -- null for folders at the top of the room
+    parent_id INTEGER REFERENCES folders(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE NULLS NOT DISTINCT (room_code, parent_id, name)
+);
+
 CREATE TABLE IF NOT EXISTS documents (
     id SERIAL PRIMARY KEY,
     title VARCHAR(255) NOT NULL DEFAULT 'Untitled Document',
     room_code VARCHAR(10) NOT NULL REFERENCES rooms(code) ON DELETE CASCADE,
+    -- null for documents at the top of the room
+    folder_id INTEGER REFERENCES folders(id) ON DELETE SET NULL,
     content TEXT,
+    revision INTEGER NOT NULL DEFAULT 0,
+    -- merged yjs updates of documents opened by yjs clients, its text is kept equal to content
+    yjs_state BYTEA,
+    position INTEGER NOT NULL DEFAULT 0,
+    -- kept up to date by postgres whenever the title changes or content is synced from redis.
+    -- only the start of the content is indexed, since a tsvector can not be larger than 1MB
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+        setweight(to_tsvector('english', left(COALESCE(content, ''), 50000)), 'B')
+    ) STORED,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     UNIQUE(room_code, title)
 );
 
+CREATE INDEX IF NOT EXISTS documents_search_idx ON documents USING GIN (search_vector);
+
+-- append-only log of every committed operation, revision is the one the operation produced
+CREATE TABLE IF NOT EXISTS document_revisions (
+    document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    operation JSONB NOT NULL,
+    author VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (document_id, revision)
+);
+
+-- full content of documents at some revisions, so that old revisions can be rebuilt without replaying everything
+CREATE TABLE IF NOT EXISTS document_snapshots (
+    document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (document_id, revision)
+);
+
 CREATE TABLE IF NOT EXISTS pdfs (
     id SERIAL PRIMARY KEY,
     filename VARCHAR(255) NOT NULL,
     room_code VARCHAR(10) NOT NULL REFERENCES rooms(code) ON DELETE CASCADE,
     github_url TEXT NOT NULL,
     uploaded_by VARCHAR(255) NOT NULL,
+    -- words of the filename, e.g. "fourier_transform.pdf" is searchable as fourier and transform
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        to_tsvector('simple', regexp_replace(filename, '[_.-]+', ' ', 'g'))
+    ) STORED,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     UNIQUE(room_code, filename)
 );
 
+CREATE INDEX IF NOT EXISTS pdfs_search_idx ON pdfs USING GIN (search_vector);
+
 INSERT INTO rooms (code, name, public) VALUES ('default', 'Default Hub', TRUE) ON CONFLICT (code) DO NOTHING;
 INSERT INTO documents (title, content, room_code) VALUES ('Untitled Document', '# Welcome!', 'default') ON CONFLICT (room_code, title) DO NOTHING;
\ No newline at end of file
@@ -42,6 +42,7 @@ marked.use({
 
 export default function Home() {
   const [documents, setDocuments] = useState<any[]>([]);
+  const [documentsLoaded, setDocumentsLoaded] = useState(false);
   const [pdfs, setPdfs] = useState<any[]>([]);
   const [room, setRoom] = useState<string>("");
   const [activeDocId, setActiveDocId] = useState<number | null>(null);
@@ -83,12 +84,18 @@ export default function Home() {
 
   const fetchDocumentsData = async (roomCode: string) => {
     try {
-      const documents = await apiService.fetchDocuments(roomCode);
+      const documents = (await apiService.fetchDocuments(roomCode)) ?? [];
       setDocuments(documents);
-
-      if (!activeDocId && documents && documents.length > 0) {
-        setActiveDocId(documents[0].id);
-      }
+      setDocumentsLoaded(true);
+
+      // the open document may have been deleted, and the room may have none left
+      setActiveDocId((current) =>
+        current && documents.some((d: any) => d.id === current)
+          ? current
+          : documents.length > 0
+            ? documents[0].id
+            : null,
+      );
     } catch (error) {
       console.error("error fetching documents:", error);
     }
@@ -395,7 +402,7 @@ export default function Home() {
             <button
               type="button"
               className={
-                (activePdfId ? "hidden " : "") +
+                (activePdfId || !activeDoc ? "hidden " : "") +
                 "shadow fixed top-36 right-10 z-50 text-black font-semibold rounded-full p-4 " +
                 (thinking
                   ? "bg-yellow-500"
@@ -445,6 +452,10 @@ export default function Home() {
               )}
             </div>
           </div>
+        ) : documentsLoaded && documents.length === 0 ? (
+          <div className="flex flex-1 items-center justify-center bg-white text-sm text-gray-500">
+            <p>This room has no documents yet. Create one from the sidebar.</p>
+          </div>
         ) : (
           <div className="grid grid-cols-2 gap-0 flex-1 overflow-hidden">
             <div className="flex flex-col overflow-hidden border-r border-gray-200">